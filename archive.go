@@ -0,0 +1,326 @@
+package pqueue
+
+import (
+	"bytes"
+	"container/list"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/linxGnu/pqueue/common"
+	"github.com/linxGnu/pqueue/entry"
+	"github.com/linxGnu/pqueue/vfs"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+const (
+	// archiveMagic identifies compressed archive of segment file.
+	archiveMagic = "PQAR"
+
+	// [Magic - 4 bytes][Codec ID - uint8][Size - uint64][Checksum - uint32]
+	archiveHeaderSize = 4 + 1 + 8 + 4
+
+	// archiveTempPrefix names files being written, which are not taken as segments.
+	archiveTempPrefix = "tmp_"
+)
+
+// Archived segment file is named as the segment, it's either a copy of segment file, or compressed
+// as a whole:
+//
+// [Magic - 4 bytes][Codec ID - uint8][Size - uint64][Checksum - uint32][Payload]
+//
+// Note:
+// - `Magic` is archiveMagic, segment files never start with it
+// - `Size` is size of segment file
+// - `Checksum` is crc32_IEEE of segment file
+// - `Payload` is segment file compressed by codec of `Codec ID`
+
+// runArchiving moves cold segments into ArchiveDir in background.
+func (q *queue) runArchiving(interval time.Duration) {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.closing:
+			return
+
+		case <-ticker.C:
+			q.archiveSegments()
+		}
+	}
+}
+
+// archiveSegments moves sealed segments beyond ArchiveHotSegments pending ones into ArchiveDir.
+// Failed ones are retried by the next pass.
+func (q *queue) archiveSegments() {
+	for {
+		seg, path := q.coldSegment()
+		if seg == nil || q.archiveSegment(seg, path) != nil {
+			return
+		}
+	}
+}
+
+// coldSegment returns the first segment which should be archived along with its path, nil if
+// there is none.
+func (q *queue) coldSegment() (cold *segment, path string) {
+	q.rLock.Lock()
+	q.wLock.RLock()
+	if node := q.coldNode(nil); node != nil {
+		cold = node.Value.(*segment)
+		path = cold.path
+	}
+	q.wLock.RUnlock()
+	q.rLock.Unlock()
+	return
+}
+
+// coldNode returns node of segment which should be archived: it's beyond hot window, neither
+// in memory nor the last segment file, whose entries are counted on loading. If seg is not nil,
+// only its node is taken. Both rLock and wLock must be held.
+func (q *queue) coldNode(seg *segment) *list.Element {
+	hot := q.settings.ArchiveHotSegments
+	if hot < 1 {
+		hot = 1 // head segment is being read
+	}
+
+	last := q.segments.Back()
+	for last != nil && len(last.Value.(*segment).path) == 0 {
+		last = last.Prev()
+	}
+
+	for node, i := q.segments.Front(), 0; node != nil && node != last; node, i = node.Next(), i+1 {
+		s := node.Value.(*segment)
+		if i >= hot && len(s.path) > 0 && !s.archived && (seg == nil || seg == s) {
+			return node
+		}
+	}
+	return nil
+}
+
+// archiveSegment copies segment file into ArchiveDir (compressed by ArchiveCodec if set), then
+// removes it from DataDir. Segment is left untouched if consumer reaches it meanwhile.
+func (q *queue) archiveSegment(seg *segment, path string) (err error) {
+	fs, name := q.settings.FS, filepath.Base(path)
+	dst := filepath.Join(q.settings.ArchiveDir, name)
+	tmp := filepath.Join(q.settings.ArchiveDir, archiveTempPrefix+name)
+
+	// segment file is sealed, it's copied without holding locks
+	if err = writeArchive(fs, path, tmp, q.settings.ArchiveCodec); err != nil {
+		_ = fs.Remove(tmp)
+		return
+	}
+
+	q.rLock.Lock()
+	q.wLock.RLock()
+	defer func() {
+		q.wLock.RUnlock()
+		q.rLock.Unlock()
+	}()
+
+	if q.coldNode(seg) == nil {
+		_ = fs.Remove(tmp)
+		return
+	}
+
+	// archive is complete before it's recorded, then the original file is removed
+	if err = fs.Rename(tmp, dst); err != nil {
+		_ = fs.Remove(tmp)
+		return
+	}
+	if err = q.manifest.setArchived(name, true); err != nil {
+		_ = fs.Remove(dst)
+		return
+	}
+
+	_ = fs.Rename(timeIndexFilePath(seg.path), timeIndexFilePath(dst))
+	_ = fs.Remove(seg.path)
+
+	// archived segment is read from its file, once it's restored
+	if seg.seg != nil {
+		_ = seg.seg.Close()
+		seg.seg = nil
+	}
+	seg.path, seg.archived = dst, true
+	return
+}
+
+// restoreSegment moves archived segment back into DataDir, so that it's read as usual. Caller
+// must hold rLock.
+func (q *queue) restoreSegment(seg *segment) (err error) {
+	fs, name := q.settings.FS, filepath.Base(seg.path)
+	dst := filepath.Join(q.settings.DataDir, name)
+	tmp := filepath.Join(q.settings.DataDir, archiveTempPrefix+name)
+
+	if err = readArchive(fs, seg.path, tmp); err == nil {
+		err = fs.Rename(tmp, dst)
+	}
+	if err == nil {
+		err = q.manifest.setArchived(name, false)
+	}
+	if err != nil {
+		_ = fs.Remove(tmp)
+		return
+	}
+
+	// offset tracker of retained segment and time index move along
+	_ = fs.Rename(offsetFilePath(seg.path), offsetFilePath(dst))
+	_ = fs.Rename(timeIndexFilePath(seg.path), timeIndexFilePath(dst))
+	_ = fs.Remove(seg.path)
+
+	seg.path, seg.archived = dst, false
+	return
+}
+
+// isRestoreTransient returns true if restoring archived segment failed by err might succeed later,
+// i.e its codec is registered. Missing or corrupted archive is dropped as broken segment file.
+func isRestoreTransient(err error) bool {
+	return !os.IsNotExist(err) && err != common.ErrArchiveCorrupted
+}
+
+// writeArchive writes archive of segment file at src into dst, compressed by codec unless it's nil.
+// Segment file is streamed, it's never loaded into memory as a whole.
+func writeArchive(fs vfs.FS, src, dst string, codec entry.Codec) error {
+	in, err := vfs.Open(fs, src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+
+	out, err := fs.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if codec == nil {
+		_, err = io.Copy(out, in)
+	} else {
+		err = compressArchive(out, in, codec)
+	}
+
+	if err == nil {
+		err = out.Sync()
+	}
+	return multierror.Append(err, out.Close()).ErrorOrNil()
+}
+
+// compressArchive writes header and segment file compressed by codec into out. Size and checksum
+// are filled into header once segment file is read.
+func compressArchive(out vfs.File, in io.Reader, codec entry.Codec) error {
+	var header [archiveHeaderSize]byte
+	copy(header[:], archiveMagic)
+	header[4] = codec.ID()
+	if _, err := out.Write(header[:]); err != nil {
+		return err
+	}
+
+	w, err := codec.NewWriter(out)
+	if err != nil {
+		return err
+	}
+
+	hash := crc32.NewIEEE()
+	size, err := io.Copy(w, io.TeeReader(in, hash))
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	common.Endianese.PutUint64(header[5:], uint64(size))
+	common.Endianese.PutUint32(header[13:], hash.Sum32())
+	_, err = out.WriteAt(header[5:], 5)
+	return err
+}
+
+// readArchive writes segment file from its archive at src into dst. Archive is streamed, it's
+// never loaded into memory as a whole.
+func readArchive(fs vfs.FS, src, dst string) error {
+	in, err := vfs.Open(fs, src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+
+	var header [archiveHeaderSize]byte
+	n, err := io.ReadFull(in, header[:])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	out, err := fs.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if n == archiveHeaderSize && bytes.Equal(header[:4], []byte(archiveMagic)) {
+		err = decompressArchive(out, in, header[:])
+	} else {
+		_, err = io.Copy(out, io.MultiReader(bytes.NewReader(header[:n]), in))
+	}
+
+	if err == nil {
+		err = out.Sync()
+	}
+	return multierror.Append(err, out.Close()).ErrorOrNil()
+}
+
+// decompressArchive writes segment file decompressed from in, which follows header, into out.
+// Failure of decompressing is reported as common.ErrArchiveCorrupted, while one of reading
+// archive is kept, so that restoring is retried.
+func decompressArchive(out io.Writer, in io.Reader, header []byte) error {
+	codec := entry.LookupCodec(header[4])
+	if codec == nil {
+		return common.ErrEntryUnknownCodec
+	}
+
+	file := &errReader{Reader: in}
+	r, err := codec.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+
+	size := common.Endianese.Uint64(header[5:])
+	decoded := &errReader{Reader: io.LimitReader(r, int64(size)+1)}
+	hash := crc32.NewIEEE()
+
+	n, err := io.Copy(io.MultiWriter(out, hash), decoded)
+	switch {
+	case file.err != nil:
+		return file.err
+	case decoded.err != nil:
+		return common.ErrArchiveCorrupted
+	case err != nil:
+		return err
+	case uint64(n) != size || hash.Sum32() != common.Endianese.Uint32(header[13:]):
+		return common.ErrArchiveCorrupted
+	}
+	return nil
+}
+
+// errReader keeps the first failure of reading, other than io.EOF.
+type errReader struct {
+	io.Reader
+	err error
+}
+
+func (r *errReader) Read(p []byte) (n int, err error) {
+	if n, err = r.Reader.Read(p); err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return
+}
@@ -25,6 +25,82 @@ const (
 	// - `Entry` always starts with non-zero `Length` header
 	// - `Length` == 0 means ending, Payload won't be written in this case.
 	EntryV1 EntryFormat = iota
+
+	// EntryV2 layout:
+	//
+	// [Length - uint32][Checksum - uint32][Flags - uint8][Metadata - bytes][Payload - bytes]
+	//
+	// Note:
+	// - `Length` is size of [Flags][Metadata][Payload]
+	// - `Checksum` is crc32_IEEE([Flags][Metadata][Payload])
+	// - `Metadata` depends on `Flags`, in order:
+	//   - EntryFlagID: [ID Length - uvarint][ID - bytes]
+	//   - EntryFlagChunk: [Total Size - uvarint][Chunk Offset - uvarint]
+	//   - EntryFlagCompressed: [Codec ID - uint8]
+	//   - EntryFlagBatch: [Count - uvarint]
+	// - `Length` == 0 means ending, same as EntryV1.
+	// - Large entry is split into consecutive chunks, which are flagged with EntryFlagChunk.
+	//   The last chunk ends at `Total Size`.
+	// - `Payload` is compressed if flagged with EntryFlagCompressed, `Checksum` covers compressed one.
+	// - Batch frame packs `Count` entries into its `Payload`: [Length - uvarint][Entry - bytes]...
+	EntryV2
+
+	// EntryV3 layout is the same as EntryV2, but `Payload` is encrypted with AES-GCM:
+	//
+	// [Length - uint32][Checksum - uint32][Flags - uint8][Metadata - bytes][Nonce - 12 bytes][Sealed Payload - bytes]
+	//
+	// Note:
+	// - Payload is compressed (if flagged) before encrypting.
+	// - Key is selected by ID, which is stored in segment header.
+	EntryV3
+
+	// EntryV4 layout is the same as EntryV2, followed by HMAC-SHA256 of entry:
+	//
+	// [Length - uint32][Checksum - uint32][Flags - uint8][Metadata - bytes][Payload - bytes][MAC - 32 bytes]
+	//
+	// Note:
+	// - `Length` is size of [Flags][Metadata][Payload][MAC]
+	// - `Checksum` is crc32_IEEE([Flags][Metadata][Payload][MAC])
+	// - `MAC` is hmac_sha256([Flags][Metadata][Payload]), entries failing verification are forged.
+	// - Key is selected by ID, which is stored in segment header.
+	EntryV4
+
+	// EntryV5 layout is the same as EntryV2, but `Checksum` is crc32_Castagnoli([Flags][Metadata][Payload]),
+	// which is hardware accelerated on modern CPUs.
+	EntryV5
+
+	// EntryV6 layout is the same as EntryV2, but `Checksum` is 64-bit, which is less likely to miss
+	// corruption of large entries:
+	//
+	// [Length - uint32][Checksum - uint64][Flags - uint8][Metadata - bytes][Payload - bytes]
+	//
+	// Note:
+	// - `Checksum` is crc64_ECMA([Flags][Metadata][Payload])
+	EntryV6
+
+	// EntryV7 layout is compact for small entries, entries written at once (i.e batch) share one block:
+	//
+	// [Header - uvarint][Length - uvarint][Payload - bytes]...[Length - uvarint][Payload - bytes][Checksum - uint32]
+	//
+	// Note:
+	// - `Header` is (`Count` << 1 | has `Checksum`), `Count` is number of entries inside block.
+	// - `Checksum` is crc32_Castagnoli([Header][Length][Payload]...), it is optional.
+	// - `Header` == 0 means ending, same as EntryV1.
+	// - Metadata is not supported.
+	EntryV7
+)
+
+// Flags of EntryV2.
+const (
+	EntryFlagID uint8 = 1 << iota
+	EntryFlagChunk
+	EntryFlagCompressed
+	EntryFlagBatch
+)
+
+const (
+	// MaxEntryIDSize indicates max size of entry ID.
+	MaxEntryIDSize = 1 << 10
 )
 
 var (
@@ -36,6 +112,39 @@ var (
 
 	// ErrEntryInvalidCheckSum indicates entry invalid checksum.
 	ErrEntryInvalidCheckSum = fmt.Errorf("invalid checksum")
+
+	// ErrEntryIncomplete indicates chunks of large entry are missing or out of order.
+	ErrEntryIncomplete = fmt.Errorf("incomplete chunked entry")
+
+	// ErrEntryCorruptedMeta indicates entry metadata is malformed.
+	ErrEntryCorruptedMeta = fmt.Errorf("corrupted entry metadata")
+
+	// ErrEntryKeyRequired indicates encryption/authentication key is required by entry format but missing.
+	ErrEntryKeyRequired = fmt.Errorf("key is required")
+
+	// ErrKeyIDTooLong indicates ID of key is longer than 255 bytes.
+	ErrKeyIDTooLong = fmt.Errorf("key ID is longer than 255 bytes")
+
+	// ErrEntryDecryption indicates entry could not be decrypted, it is corrupted or tampered.
+	ErrEntryDecryption = fmt.Errorf("failed to decrypt entry")
+
+	// ErrEntryAuthentication indicates entry fails HMAC verification, it is forged or tampered.
+	ErrEntryAuthentication = fmt.Errorf("entry authentication failed")
+
+	// ErrEntryUnknownCodec indicates entry is compressed with unregistered codec.
+	ErrEntryUnknownCodec = fmt.Errorf("unknown codec of entry")
+
+	// ErrCodecInvalidID indicates codec ID is zero.
+	ErrCodecInvalidID = fmt.Errorf("invalid codec ID")
+
+	// ErrCodecRequired indicates codec is required but missing.
+	ErrCodecRequired = fmt.Errorf("codec is required")
+
+	// ErrCodecInvalidLevel indicates compression level is out of range.
+	ErrCodecInvalidLevel = fmt.Errorf("invalid compression level")
+
+	// ErrEntryIDTooLong indicates entry ID is longer than MaxEntryIDSize.
+	ErrEntryIDTooLong = fmt.Errorf("entry ID is longer than limitation of 1KB")
 )
 
 // SegmentFormat layout
@@ -45,12 +154,69 @@ const (
 	// SegmentV1 layout:
 	//
 	// [Segment Format - uin32][Entry Format - uint32][Entries]
+	//
+	// Note:
+	// - EntryV3/EntryV4 segment has [Key ID Length - uint8][Key ID - bytes] right after `Entry Format`.
 	SegmentV1 SegmentFormat = iota
+
+	// SegmentV2 layout:
+	//
+	// [Segment Format - uint32][Magic - 4 bytes][Created - int64][Sequence - uint64][Base - uint64][Checksum - uint32]
+	// [Entry Format - uint32][Entries][Ending][Footer]
+	//
+	// Footer layout:
+	//
+	// [Entries - uint64][Bytes - uint64][Index Length - uint32][[Entry - uint64][Offset - uint64]...]
+	// [Footer Size - uint32][Checksum - uint32][Magic - 4 bytes]
+	//
+	// Note:
+	// - `Magic` is SegmentMagic
+	// - `Created` is unix nano when segment was created
+	// - `Base` is position of the first entry inside segment
+	// - header `Checksum` is crc32_IEEE of preceding bytes of header
+	// - entries are laid out as SegmentV1, right after header
+	// - footer is written when segment is sealed, it's missing if writer crashed
+	// - `Bytes` is size of entries along with their `Entry Format`, excluding `Ending`
+	// - index points to the entry of given ordinal inside segment, every few entries. `Offset`
+	// is relative to `Entry Format`
+	// - `Footer Size` is size of whole footer, footer `Checksum` is crc32_IEEE of footer bytes
+	// preceding it
+	SegmentV2
+
+	// SegmentV3 layout:
+	//
+	// [Segment Format - uint32][Entry Format - uint32][Entries][Zeros]
+	//
+	// Note:
+	// - segment file is preallocated with fixed size and memory-mapped, see package segment/mmap
+	// - only EntryV1 is supported, entries are followed by zeros up to the end of file
+	SegmentV3
 )
 
+// SegmentMagic identifies SegmentV2 files.
+const SegmentMagic = "PQSG"
+
 var (
 	// ErrSegmentUnsupportedFormat indicates invalid segment format.
 	ErrSegmentUnsupportedFormat = fmt.Errorf("unsupported segment format")
+
+	// ErrSegmentCorruptedHeader indicates segment header is corrupted or segment is not written by pqueue.
+	ErrSegmentCorruptedHeader = fmt.Errorf("corrupted segment header")
+
+	// ErrSegmentFooterMissing indicates segment is not sealed or its footer is corrupted.
+	ErrSegmentFooterMissing = fmt.Errorf("segment footer is missing or corrupted")
+
+	// ErrSegmentNotMappable indicates segment file could not be memory-mapped, i.e platform is not supported.
+	ErrSegmentNotMappable = fmt.Errorf("segment file is not mappable")
+
+	// ErrSegmentTooSmall indicates fixed size of segment could not hold its header.
+	ErrSegmentTooSmall = fmt.Errorf("segment size is too small")
+
+	// ErrDirectIOUnsupported indicates direct I/O is not supported on the platform or file system.
+	ErrDirectIOUnsupported = fmt.Errorf("direct I/O is not supported")
+
+	// ErrFileLocked indicates file is locked already, i.e data directory is used by another queue.
+	ErrFileLocked = fmt.Errorf("file is locked already")
 )
 
 var (
@@ -71,6 +237,8 @@ const (
 	EntryUnsupportedFormat
 	EntryWriteErr
 	EntryNoMore
+	EntryUnauthenticated
+	EntryUndecryptable
 
 	SegmentNoMoreReadWeak
 	SegmentNoMoreReadStrong
@@ -78,7 +246,38 @@ const (
 	SegmentCorrupted
 )
 
+// KeyNotFoundError indicates encryption/authentication key of segment is missing. Segment is kept untouched until
+// the key is provided.
+type KeyNotFoundError struct {
+	KeyID string
+	Err   error // error from key provider, if any
+}
+
+func (e *KeyNotFoundError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("key %q not found: %v", e.KeyID, e.Err)
+	}
+	return fmt.Sprintf("key %q not found", e.KeyID)
+}
+
+// Unwrap returns error from key provider.
+func (e *KeyNotFoundError) Unwrap() error {
+	return e.Err
+}
+
 var (
 	// ErrQueueCorrupted indicates queue corrupted.
 	ErrQueueCorrupted = fmt.Errorf("queue corrupted")
+
+	// ErrDedupDisabled indicates deduplication is not enabled in queue settings.
+	ErrDedupDisabled = fmt.Errorf("deduplication is disabled")
+
+	// ErrSeekOutOfRange indicates seeking position is beyond the last entry of queue.
+	ErrSeekOutOfRange = fmt.Errorf("seek position out of range")
+
+	// ErrArchiveCorrupted indicates compressed archive of segment is corrupted.
+	ErrArchiveCorrupted = fmt.Errorf("corrupted segment archive")
+
+	// ErrArchiveDirRequired indicates queue has archived segments, but archive directory is not set.
+	ErrArchiveDirRequired = fmt.Errorf("archive directory is required")
 )
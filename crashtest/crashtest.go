@@ -0,0 +1,373 @@
+// Package crashtest checks crash consistency of queue. Randomized workload of enqueuing and dequeuing
+// runs against queue whose file system crashes at arbitrary points, see FS. Queue is reopened after
+// every crash, then invariants are checked:
+//
+//   - Acknowledged entries are not lost: enqueuing returned no error and they are not dequeued yet.
+//     Entries whose enqueuing failed or was interrupted by crash might be stored or not.
+//   - Entries are dequeued in order of enqueuing, intact.
+//   - Entries are not duplicated, except those dequeued right before crash: their consumption might
+//     not be committed yet, so they are delivered again (at-least-once).
+//
+// Segment files are not synced by queue, entries do not survive crashes dropping unsynced writes
+// (Options.DropUnsynced, as of power loss). Then only order and integrity of remaining entries are
+// checked.
+//
+// Entries buffered in memory (QueueSettings.MemoryBuffer) are lost on crash unless they're flushed.
+// Workload flushes queue from time to time, entries enqueued after the last flush (or reopening)
+// might be missing after crash, or after closing queue failed.
+package crashtest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+
+	"github.com/linxGnu/pqueue"
+	"github.com/linxGnu/pqueue/entry"
+	"github.com/linxGnu/pqueue/vfs"
+)
+
+const dataDir = "/data"
+
+// Options of crash test.
+type Options struct {
+	// Settings of queue under test. DataDir and FS are replaced. Settings requiring files of operating
+	// system (DirectIO, SegmentV3) are not supported. MemoryBuffer is supported, see package doc.
+	// Single entries are enqueued with unique IDs if deduplication is enabled.
+	Settings pqueue.QueueSettings
+
+	// Rounds is number of times queue is crashed, or closed, then reopened.
+	Rounds int
+
+	// Ops is max number of enqueuing and dequeuing per round.
+	Ops int
+
+	// MaxEntrySize is max size of enqueued entries, not smaller than 8 bytes.
+	MaxEntrySize int
+
+	// DropUnsynced reverts files to their last synced content on crashing.
+	DropUnsynced bool
+
+	// TearWrites applies random prefix of write interrupted by crash.
+	TearWrites bool
+
+	// FaultRate is probability that renaming or removing file fails, without crashing.
+	FaultRate float64
+
+	// Seed of randomness. The same seed reproduces the same run, unless queue runs background
+	// routines (MaxSegmentAge, retention).
+	Seed int64
+}
+
+// Violation of invariants, found by Run.
+type Violation struct {
+	Round int
+	Seed  int64
+	Msg   string
+}
+
+func (v *Violation) Error() string {
+	return fmt.Sprintf("crashtest: round %d (seed %d): %s", v.Round, v.Seed, v.Msg)
+}
+
+// Run crash test. Violation is returned if invariants are broken, or queue could not be reopened.
+func Run(opts Options) error {
+	if opts.Rounds <= 0 {
+		opts.Rounds = 100
+	}
+	if opts.Ops <= 0 {
+		opts.Ops = 100
+	}
+	if opts.MaxEntrySize < 8 {
+		opts.MaxEntrySize = 64
+	}
+
+	r := &runner{
+		opts: opts,
+		rnd:  rand.New(rand.NewSource(opts.Seed)),
+		fs:   NewFS(vfs.NewMem(), opts.Seed),
+	}
+	r.fs.SetTearWrites(opts.TearWrites)
+
+	if err := r.fs.MkdirAll(dataDir, 0o700); err != nil {
+		return err
+	}
+
+	r.settings = opts.Settings
+	r.settings.DataDir, r.settings.FS = dataDir, r.fs
+
+	for r.round = 0; r.round < opts.Rounds; r.round++ {
+		if err := r.runRound(); err != nil {
+			return err
+		}
+	}
+
+	// everything acknowledged is still there
+	r.fs.SetFaultRate(0)
+	q, err := pqueue.NewWithSettings(r.settings)
+	if err != nil {
+		return r.violation("reopening: %v", err)
+	}
+	defer func() {
+		_ = q.Close()
+	}()
+	return r.drain(q)
+}
+
+// item is expected entry of queue.
+type item struct {
+	seq     uint64
+	certain bool // entry must be dequeued
+	replay  bool // entry was dequeued before crash, it might be delivered again
+}
+
+type runner struct {
+	opts     Options
+	settings pqueue.QueueSettings
+	rnd      *rand.Rand
+	fs       *FS
+	round    int
+
+	nextSeq  uint64
+	flushed  uint64   // sequence of the first entry which is not flushed, see QueueSettings.MemoryBuffer
+	expected []item   // entries of queue, in order
+	consumed []uint64 // dequeued entries, since the last reopening
+	dequeued bool     // crashed while dequeuing
+}
+
+func (r *runner) violation(format string, args ...interface{}) error {
+	return &Violation{Round: r.round, Seed: r.opts.Seed, Msg: fmt.Sprintf(format, args...)}
+}
+
+// runRound opens queue, runs workload until crashing or closing queue, then restarts file system.
+func (r *runner) runRound() error {
+	r.fs.SetFaultRate(r.opts.FaultRate)
+
+	q, err := pqueue.NewWithSettings(r.settings)
+	if err != nil {
+		if isInjected(err) {
+			return nil // try again next round
+		}
+		return r.violation("reopening: %v", err)
+	}
+	r.consumed, r.dequeued = r.consumed[:0], false
+	r.flushed = r.nextSeq
+
+	// crash point is roughly uniform over operations of round, some rounds are closed cleanly
+	r.fs.CrashAfter(1 + r.rnd.Intn(2*r.opts.Ops))
+
+	for i := 0; i < r.opts.Ops && !r.fs.Crashed(); i++ {
+		switch n := r.rnd.Intn(10); {
+		case n < 4:
+			r.enqueue(q, 1)
+
+		case n < 5:
+			r.enqueue(q, 1+r.rnd.Intn(5))
+
+		default:
+			if err = r.dequeue(q); err != nil {
+				_ = q.Close()
+				return err
+			}
+			r.dequeued = r.fs.Crashed()
+		}
+
+		if r.settings.MemoryBuffer > 0 && r.rnd.Intn(20) == 0 {
+			r.flush(q)
+		}
+	}
+
+	closeErr := q.Close()
+	crashed := r.fs.Crashed()
+	if err = r.fs.Restart(crashed && r.opts.DropUnsynced); err != nil {
+		return err
+	}
+
+	if crashed {
+		r.afterCrash()
+	} else {
+		r.consumed = r.consumed[:0]
+		if closeErr != nil { // buffered entries might not be spilled
+			r.forgetUnflushed()
+		}
+	}
+	return nil
+}
+
+// forgetUnflushed marks entries which are not flushed yet as they might be lost.
+func (r *runner) forgetUnflushed() {
+	if r.settings.MemoryBuffer == 0 {
+		return
+	}
+	for i := range r.expected {
+		if r.expected[i].seq >= r.flushed {
+			r.expected[i].certain = false
+		}
+	}
+}
+
+// afterCrash marks entries dequeued right before crash to be delivered again.
+func (r *runner) afterCrash() {
+	replay := r.consumed
+	if !r.opts.DropUnsynced {
+		// consumption is committed on every dequeuing, the last one might be interrupted
+		if !r.dequeued {
+			replay = nil
+		} else if len(replay) > 1 {
+			replay = replay[len(replay)-1:]
+		}
+	}
+
+	items := make([]item, 0, len(replay)+len(r.expected))
+	for _, seq := range replay {
+		items = append(items, item{seq: seq, replay: true})
+	}
+	for _, it := range r.expected {
+		if r.opts.DropUnsynced {
+			it.certain = false
+		}
+		items = append(items, it)
+	}
+	r.expected = items
+	r.forgetUnflushed()
+}
+
+func (r *runner) enqueue(q pqueue.Queue, n int) {
+	b := entry.NewBatch(n)
+	for i := 0; i < n; i++ {
+		b.Append(r.newEntry(r.nextSeq + uint64(i)))
+	}
+
+	var err error
+	switch {
+	case n == 1 && (r.settings.DedupMaxIDs > 0 || r.settings.DedupWindow > 0):
+		// IDs are unique, entries are never deduplicated
+		_, err = q.EnqueueWithID(fmt.Sprint(r.nextSeq), b.Entry(0))
+
+	case n == 1:
+		_, err = q.Enqueue(b.Entry(0))
+
+	default:
+		_, err = q.EnqueueBatch(b)
+	}
+
+	for i := 0; i < n; i++ {
+		r.expected = append(r.expected, item{seq: r.nextSeq, certain: err == nil})
+		r.nextSeq++
+	}
+}
+
+// flush buffered entries, they survive crash once it's done.
+func (r *runner) flush(q pqueue.Queue) {
+	if q.Flush() == nil && !r.fs.Crashed() {
+		r.flushed = r.nextSeq
+	}
+}
+
+func (r *runner) dequeue(q pqueue.Queue) error {
+	var e entry.Entry
+	if !q.Dequeue(&e) {
+		if r.fs.Crashed() || isInjected(q.Err()) {
+			return nil
+		}
+		for _, it := range r.expected {
+			if it.certain {
+				return r.violation("entry %d is lost, queue error: %v", it.seq, q.Err())
+			}
+		}
+		return nil
+	}
+
+	// process is gone once file system crashes, entry is never delivered
+	if r.fs.Crashed() {
+		return nil
+	}
+
+	seq, err := r.checkEntry(e)
+	if err != nil {
+		return err
+	}
+	r.consumed = append(r.consumed, seq)
+	return nil
+}
+
+// checkEntry verifies dequeued entry against expected ones, returns its sequence.
+func (r *runner) checkEntry(e entry.Entry) (uint64, error) {
+	seq, ok := parseEntry(e)
+	if !ok {
+		return 0, r.violation("corrupted entry of %d bytes", len(e))
+	}
+
+	i := 0
+	for i < len(r.expected) && r.expected[i].seq != seq {
+		i++
+	}
+	if i == len(r.expected) {
+		return 0, r.violation("unexpected entry %d, duplicated or out of order", seq)
+	}
+
+	// skipped entries might be missing
+	for _, it := range r.expected[:i] {
+		if it.certain {
+			return 0, r.violation("entry %d is lost, dequeued %d instead", it.seq, seq)
+		}
+	}
+
+	// redelivery continues with the following entries
+	replay := r.expected[i].replay
+	r.expected = r.expected[i+1:]
+	if replay {
+		for j := range r.expected {
+			if r.expected[j].replay {
+				r.expected[j].certain = true
+			}
+		}
+	}
+	return seq, nil
+}
+
+// drain queue, verifying every entry.
+func (r *runner) drain(q pqueue.Queue) error {
+	var e entry.Entry
+	for q.Dequeue(&e) {
+		if _, err := r.checkEntry(e); err != nil {
+			return err
+		}
+	}
+
+	for _, it := range r.expected {
+		if it.certain {
+			return r.violation("entry %d is lost, queue error: %v", it.seq, q.Err())
+		}
+	}
+	return nil
+}
+
+func isInjected(err error) bool {
+	return errors.Is(err, ErrInjected)
+}
+
+// newEntry of sequence, filled with bytes derived from it.
+func (r *runner) newEntry(seq uint64) entry.Entry {
+	e := make(entry.Entry, 8+r.rnd.Intn(r.opts.MaxEntrySize-7))
+	binary.BigEndian.PutUint64(e, seq)
+	for i := 8; i < len(e); i++ {
+		e[i] = byte(seq) + byte(i)
+	}
+	return e
+}
+
+func parseEntry(e entry.Entry) (seq uint64, ok bool) {
+	if len(e) < 8 {
+		return
+	}
+
+	seq = binary.BigEndian.Uint64(e)
+	for i := 8; i < len(e); i++ {
+		if e[i] != byte(seq)+byte(i) {
+			return
+		}
+	}
+	return seq, true
+}
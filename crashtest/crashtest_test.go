@@ -0,0 +1,88 @@
+package crashtest
+
+import (
+	"compress/flate"
+	"testing"
+	"time"
+
+	"github.com/linxGnu/pqueue"
+	"github.com/linxGnu/pqueue/common"
+	"github.com/linxGnu/pqueue/entry"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	settings := pqueue.QueueSettings{
+		SegmentFormat:        common.SegmentV1,
+		EntryFormat:          common.EntryV1,
+		MaxEntriesPerSegment: 10,
+	}
+
+	t.Run("Crash", func(t *testing.T) {
+		require.NoError(t, Run(Options{Settings: settings, Seed: 1}))
+	})
+
+	t.Run("TearWrites", func(t *testing.T) {
+		require.NoError(t, Run(Options{Settings: settings, TearWrites: true, Seed: 2}))
+	})
+
+	t.Run("DropUnsynced", func(t *testing.T) {
+		require.NoError(t, Run(Options{Settings: settings, TearWrites: true, DropUnsynced: true, Seed: 3}))
+	})
+
+	t.Run("Faults", func(t *testing.T) {
+		require.NoError(t, Run(Options{Settings: settings, FaultRate: 0.1, Seed: 4}))
+	})
+
+	t.Run("RetainConsumed", func(t *testing.T) {
+		retain := settings
+		retain.RetainConsumed = true
+		require.NoError(t, Run(Options{Settings: retain, TearWrites: true, Seed: 5}))
+	})
+
+	t.Run("MemoryBuffer", func(t *testing.T) {
+		buffered := settings
+		buffered.MemoryBuffer = 5
+		require.NoError(t, Run(Options{Settings: buffered, TearWrites: true, FaultRate: 0.1, Seed: 6}))
+	})
+}
+
+func TestRunSettings(t *testing.T) {
+	codec, err := entry.NewFlateCodec(flate.BestSpeed)
+	require.NoError(t, err)
+
+	v2 := pqueue.QueueSettings{
+		SegmentFormat:        common.SegmentV2,
+		EntryFormat:          common.EntryV2,
+		MaxEntriesPerSegment: 10,
+	}
+
+	cases := map[string]func(s *pqueue.QueueSettings){
+		"SegmentV2": func(s *pqueue.QueueSettings) {},
+		"EntryV5":   func(s *pqueue.QueueSettings) { s.EntryFormat = common.EntryV5 },
+		"EntryV6":   func(s *pqueue.QueueSettings) { s.EntryFormat = common.EntryV6 },
+		"EntryV7":   func(s *pqueue.QueueSettings) { s.EntryFormat = common.EntryV7 },
+		"MaxBytesPerSegment": func(s *pqueue.QueueSettings) {
+			s.MaxEntriesPerSegment, s.MaxBytesPerSegment = 0, 512
+		},
+		"CompressBatch": func(s *pqueue.QueueSettings) {
+			s.Codec, s.CompressionThreshold, s.CompressBatch = codec, 16, true
+		},
+		"Dedup":          func(s *pqueue.QueueSettings) { s.DedupMaxIDs = 50 },
+		"TimeIndex":      func(s *pqueue.QueueSettings) { s.TimeIndexInterval = time.Nanosecond },
+		"RetainConsumed": func(s *pqueue.QueueSettings) { s.RetainConsumed = true },
+		"MemoryBuffer":   func(s *pqueue.QueueSettings) { s.MemoryBuffer = 5 },
+	}
+
+	for name, apply := range cases {
+		settings := v2
+		apply(&settings)
+
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, Run(Options{Settings: settings, TearWrites: true, Seed: 11}))
+			require.NoError(t, Run(Options{Settings: settings, TearWrites: true, DropUnsynced: true, Seed: 12}))
+			require.NoError(t, Run(Options{Settings: settings, FaultRate: 0.1, Seed: 13}))
+		})
+	}
+}
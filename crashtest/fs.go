@@ -0,0 +1,397 @@
+package crashtest
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/linxGnu/pqueue/vfs"
+)
+
+var (
+	// ErrCrashed is returned by every operation of crashed FS, until it's restarted.
+	ErrCrashed = fmt.Errorf("file system crashed")
+
+	// ErrInjected is returned by failing renaming or removing, see FS.SetFaultRate.
+	ErrInjected = fmt.Errorf("injected fault")
+)
+
+// FS wraps file system and injects faults: it crashes after given number of mutating operations
+// (writing, syncing, creating, renaming, removing...), then rejects everything until restarted.
+//
+// Content of files is considered durable once synced. Creating, renaming and removing files are
+// durable right away.
+type FS struct {
+	inner vfs.FS
+
+	mu      sync.Mutex
+	rnd     *rand.Rand
+	gen     int // increased by restarting, files opened before are rejected
+	ops     int // number of mutating operations so far
+	crashAt int // zero means never
+	crashed bool
+	tear    bool
+	fault   float64
+	synced  map[string][]byte // the last synced content of files written since then
+	locks   []io.Closer
+}
+
+// NewFS wraps inner file system, randomness of faults is seeded by seed.
+func NewFS(inner vfs.FS, seed int64) *FS {
+	return &FS{
+		inner:  inner,
+		rnd:    rand.New(rand.NewSource(seed)),
+		synced: make(map[string][]byte),
+	}
+}
+
+// CrashAfter crashes file system on the n-th mutating operation from now. If it's writing and
+// tearing is enabled, random prefix of data is written before crashing. Renaming is either applied
+// or not. Zero n cancels crashing.
+func (fs *FS) CrashAfter(n int) {
+	fs.mu.Lock()
+	if n > 0 {
+		fs.crashAt = fs.ops + n
+	} else {
+		fs.crashAt = 0
+	}
+	fs.mu.Unlock()
+}
+
+// SetTearWrites makes crashing write to be applied partially.
+func (fs *FS) SetTearWrites(tear bool) {
+	fs.mu.Lock()
+	fs.tear = tear
+	fs.mu.Unlock()
+}
+
+// SetFaultRate sets probability that renaming or removing fails with ErrInjected, without crashing.
+func (fs *FS) SetFaultRate(rate float64) {
+	fs.mu.Lock()
+	fs.fault = rate
+	fs.mu.Unlock()
+}
+
+// Crashed returns true if file system crashed.
+func (fs *FS) Crashed() bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.crashed
+}
+
+// Restart file system after crashing, as machine is rebooted: locks are released and opened files
+// are rejected. If dropUnsynced, files are reverted to their last synced content.
+func (fs *FS) Restart(dropUnsynced bool) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, lock := range fs.locks {
+		_ = lock.Close()
+	}
+	fs.locks = nil
+
+	if dropUnsynced {
+		for name, data := range fs.synced {
+			if err = fs.revert(name, data); err != nil {
+				return
+			}
+		}
+	}
+
+	fs.synced = make(map[string][]byte)
+	fs.gen++
+	fs.crashAt, fs.crashed = 0, false
+	return
+}
+
+func (fs *FS) revert(name string, data []byte) error {
+	f, err := fs.inner.OpenFile(name, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// step accounts mutating operation. It returns true if file system crashes right now.
+func (fs *FS) step(gen int) (crash bool, err error) {
+	if fs.crashed || gen != fs.gen {
+		return false, ErrCrashed
+	}
+
+	fs.ops++
+	if fs.crashAt > 0 && fs.ops >= fs.crashAt {
+		fs.crashed = true
+		return true, nil
+	}
+	return false, nil
+}
+
+// check rejects operations of crashed file system.
+func (fs *FS) check(gen int) error {
+	if fs.crashed || gen != fs.gen {
+		return ErrCrashed
+	}
+	return nil
+}
+
+// dirty remembers synced content of file before it's modified.
+func (fs *FS) dirty(name string) {
+	if _, ok := fs.synced[name]; ok {
+		return
+	}
+
+	data, err := vfs.ReadFile(fs.inner, name)
+	if err == nil {
+		fs.synced[name] = data
+	}
+}
+
+func (fs *FS) faulty() bool {
+	return fs.fault > 0 && fs.rnd.Float64() < fs.fault
+}
+
+func (fs *FS) OpenFile(name string, flag int, perm os.FileMode) (vfs.File, error) {
+	name = filepath.Clean(name)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if flag&(os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_RDWR) == 0 {
+		if err := fs.check(fs.gen); err != nil {
+			return nil, err
+		}
+	} else if crash, err := fs.step(fs.gen); err != nil || crash {
+		return nil, ErrCrashed
+	}
+
+	if flag&os.O_TRUNC != 0 {
+		fs.dirty(name)
+	}
+
+	f, err := fs.inner.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &file{File: f, fs: fs, name: name, gen: fs.gen}, nil
+}
+
+func (fs *FS) Remove(name string) error {
+	name = filepath.Clean(name)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if crash, err := fs.step(fs.gen); err != nil || crash {
+		return ErrCrashed
+	}
+	if fs.faulty() {
+		return &os.PathError{Op: "remove", Path: name, Err: ErrInjected}
+	}
+
+	err := fs.inner.Remove(name)
+	if err == nil {
+		delete(fs.synced, name)
+	}
+	return err
+}
+
+func (fs *FS) Rename(oldpath, newpath string) error {
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	crash, err := fs.step(fs.gen)
+	if err != nil || crash && fs.rnd.Intn(2) == 0 {
+		return ErrCrashed
+	}
+	if !crash && fs.faulty() {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: ErrInjected}
+	}
+
+	if err = fs.inner.Rename(oldpath, newpath); err == nil {
+		data, ok := fs.synced[oldpath]
+		delete(fs.synced, oldpath)
+		delete(fs.synced, newpath)
+		if ok {
+			fs.synced[newpath] = data
+		}
+	}
+
+	if crash {
+		return ErrCrashed // renamed right before crashing
+	}
+	return err
+}
+
+func (fs *FS) SyncDir(dir string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if crash, err := fs.step(fs.gen); err != nil || crash {
+		return ErrCrashed
+	}
+	return fs.inner.SyncDir(dir)
+}
+
+func (fs *FS) ReadDir(dir string) ([]string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.check(fs.gen); err != nil {
+		return nil, err
+	}
+	return fs.inner.ReadDir(dir)
+}
+
+func (fs *FS) MkdirAll(dir string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if crash, err := fs.step(fs.gen); err != nil || crash {
+		return ErrCrashed
+	}
+	return fs.inner.MkdirAll(dir, perm)
+}
+
+func (fs *FS) Stat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.check(fs.gen); err != nil {
+		return nil, err
+	}
+	return fs.inner.Stat(name)
+}
+
+func (fs *FS) Lock(name string) (io.Closer, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.check(fs.gen); err != nil {
+		return nil, err
+	}
+
+	lock, err := fs.inner.Lock(name)
+	if err == nil {
+		fs.locks = append(fs.locks, lock)
+	}
+	return lock, err
+}
+
+// file of FS, rejected once file system crashed or restarted.
+type file struct {
+	vfs.File
+	fs   *FS
+	name string
+	gen  int
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	return f.File.Read(p)
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	return f.File.Seek(offset, whence)
+}
+
+func (f *file) Stat() (os.FileInfo, error) {
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	return f.File.Stat()
+}
+
+func (f *file) check() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return f.fs.check(f.gen)
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	return f.write(p, func(p []byte) (int, error) {
+		return f.File.Write(p)
+	})
+}
+
+func (f *file) WriteAt(p []byte, off int64) (int, error) {
+	return f.write(p, func(p []byte) (int, error) {
+		return f.File.WriteAt(p, off)
+	})
+}
+
+// write p, or random prefix of it if file system crashes right now.
+func (f *file) write(p []byte, fn func([]byte) (int, error)) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	crash, err := f.fs.step(f.gen)
+	if err != nil {
+		return 0, err
+	}
+	f.fs.dirty(f.name)
+
+	if !crash {
+		return fn(p)
+	}
+
+	if f.fs.tear && len(p) > 0 {
+		n, _ := fn(p[:f.fs.rnd.Intn(len(p))])
+		return n, ErrCrashed
+	}
+	return 0, ErrCrashed
+}
+
+func (f *file) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if crash, err := f.fs.step(f.gen); err != nil || crash {
+		return ErrCrashed
+	}
+	f.fs.dirty(f.name)
+	return f.File.Truncate(size)
+}
+
+func (f *file) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if crash, err := f.fs.step(f.gen); err != nil || crash {
+		return ErrCrashed
+	}
+	if err := f.File.Sync(); err != nil {
+		return err
+	}
+	delete(f.fs.synced, f.name)
+	return nil
+}
+
+func (f *file) Close() error {
+	err := f.File.Close()
+	if e := f.check(); e != nil {
+		return e
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+package crashtest
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/linxGnu/pqueue/vfs"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFS(t *testing.T) {
+	t.Run("Crash", func(t *testing.T) {
+		fs := NewFS(vfs.NewMem(), 1)
+
+		f, err := vfs.CreateExclusive(fs, "a", 0o600)
+		require.NoError(t, err)
+
+		fs.CrashAfter(2)
+		_, err = f.Write([]byte("hello"))
+		require.NoError(t, err)
+		_, err = f.Write([]byte("world"))
+		require.ErrorIs(t, err, ErrCrashed)
+		require.True(t, fs.Crashed())
+
+		// everything is rejected
+		_, err = f.Write([]byte("!"))
+		require.ErrorIs(t, err, ErrCrashed)
+		_, err = vfs.Open(fs, "a")
+		require.ErrorIs(t, err, ErrCrashed)
+		_, err = fs.ReadDir(".")
+		require.ErrorIs(t, err, ErrCrashed)
+
+		// unsynced writes survive crash of process
+		require.NoError(t, fs.Restart(false))
+		require.False(t, fs.Crashed())
+
+		_, err = f.Write([]byte("!")) // opened before restarting
+		require.ErrorIs(t, err, ErrCrashed)
+
+		data, err := vfs.ReadFile(fs, "a")
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(data))
+	})
+
+	t.Run("TearWrites", func(t *testing.T) {
+		fs := NewFS(vfs.NewMem(), 1)
+		fs.SetTearWrites(true)
+
+		f, err := vfs.CreateExclusive(fs, "a", 0o600)
+		require.NoError(t, err)
+
+		payload := bytes.Repeat([]byte{1}, 100)
+		fs.CrashAfter(1)
+		n, err := f.Write(payload)
+		require.ErrorIs(t, err, ErrCrashed)
+		require.Less(t, n, len(payload))
+
+		require.NoError(t, fs.Restart(false))
+		data, err := vfs.ReadFile(fs, "a")
+		require.NoError(t, err)
+		require.Equal(t, payload[:n], data)
+	})
+
+	t.Run("DropUnsynced", func(t *testing.T) {
+		fs := NewFS(vfs.NewMem(), 1)
+
+		f, err := vfs.CreateExclusive(fs, "a", 0o600)
+		require.NoError(t, err)
+		_, err = f.Write([]byte("synced"))
+		require.NoError(t, err)
+		require.NoError(t, f.Sync())
+		_, err = f.Write([]byte("unsynced"))
+		require.NoError(t, err)
+
+		g, err := vfs.CreateExclusive(fs, "b", 0o600)
+		require.NoError(t, err)
+		_, err = g.Write([]byte("unsynced"))
+		require.NoError(t, err)
+		require.NoError(t, fs.Rename("b", "c"))
+
+		fs.CrashAfter(1)
+		require.ErrorIs(t, f.Sync(), ErrCrashed)
+		require.NoError(t, fs.Restart(true))
+
+		data, err := vfs.ReadFile(fs, "a")
+		require.NoError(t, err)
+		require.Equal(t, "synced", string(data))
+
+		// renamed file exists, without its content
+		data, err = vfs.ReadFile(fs, "c")
+		require.NoError(t, err)
+		require.Empty(t, data)
+	})
+
+	t.Run("Faults", func(t *testing.T) {
+		fs := NewFS(vfs.NewMem(), 1)
+
+		f, err := vfs.CreateExclusive(fs, "a", 0o600)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		fs.SetFaultRate(1)
+		require.ErrorIs(t, fs.Rename("a", "b"), ErrInjected)
+		require.ErrorIs(t, fs.Remove("a"), ErrInjected)
+		require.False(t, fs.Crashed())
+
+		fs.SetFaultRate(0)
+		require.NoError(t, fs.Rename("a", "b"))
+		require.NoError(t, fs.Remove("b"))
+		_, err = fs.Stat("b")
+		require.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("Lock", func(t *testing.T) {
+		fs := NewFS(vfs.NewMem(), 1)
+
+		_, err := fs.Lock("lock")
+		require.NoError(t, err)
+
+		// released by restarting
+		require.NoError(t, fs.Restart(false))
+		lock, err := fs.Lock("lock")
+		require.NoError(t, err)
+		require.NoError(t, lock.Close())
+	})
+}
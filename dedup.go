@@ -0,0 +1,329 @@
+package pqueue
+
+import (
+	"container/list"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/linxGnu/pqueue/common"
+	"github.com/linxGnu/pqueue/entry"
+	"github.com/linxGnu/pqueue/vfs"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+const (
+	dedupFileName = "dedup"
+
+	// [Timestamp - int64][Position - uint64][ID Length - uint16]
+	dedupRecordHeaderSize = 18
+)
+
+var errDedupCorrupted = fmt.Errorf("corrupted dedup file")
+
+// Dedup file layout:
+//
+// [Record][Record]...
+//
+// Record layout:
+//
+// [Timestamp - int64][Position - uint64][ID Length - uint16][ID - bytes][Checksum - uint32]
+//
+// Note:
+// - `Timestamp` is unix nano when entry was enqueued
+// - `Checksum` is crc32_IEEE of preceding bytes of record
+type dedupRecord struct {
+	id  string
+	pos uint64
+	ts  int64
+}
+
+// dedupIndex remembers recent IDs in enqueuing order, bounded by count and/or time window.
+// IDs are persisted in file at path, unless it's empty.
+type dedupIndex struct {
+	maxIDs  int
+	window  time.Duration
+	ids     map[string]*list.Element
+	records *list.List // of *dedupRecord
+
+	fs      vfs.FS
+	path    string
+	f       vfs.File
+	written int // number of records in file
+}
+
+func newDedupIndex(fs vfs.FS, path string, maxIDs int, window time.Duration) *dedupIndex {
+	return &dedupIndex{
+		maxIDs:  maxIDs,
+		window:  window,
+		ids:     make(map[string]*list.Element),
+		records: list.New(),
+		fs:      fs,
+		path:    path,
+	}
+}
+
+// load records from file. Error is returned if file is missing or corrupted.
+func (d *dedupIndex) load(now time.Time) error {
+	data, err := vfs.ReadFile(d.fs, d.path)
+	if err != nil {
+		return err
+	}
+
+	for len(data) > 0 {
+		rec, n, err := decodeDedupRecord(data)
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+
+		d.insert(rec)
+	}
+	d.evict(now)
+
+	return nil
+}
+
+// reset drops all remembered IDs.
+func (d *dedupIndex) reset() {
+	d.ids = make(map[string]*list.Element)
+	d.records.Init()
+}
+
+func (d *dedupIndex) lookup(id string, now time.Time) (pos uint64, ok bool) {
+	d.evict(now)
+
+	var e *list.Element
+	if e, ok = d.ids[id]; ok {
+		pos = e.Value.(*dedupRecord).pos
+	}
+	return
+}
+
+// add an ID and persist it.
+func (d *dedupIndex) add(id string, pos uint64, now time.Time) (err error) {
+	rec := &dedupRecord{id: id, pos: pos, ts: now.UnixNano()}
+	d.insert(rec)
+	d.evict(now)
+
+	if len(d.path) == 0 { // not persisted
+		return nil
+	}
+
+	// rewrite file when it contains too many stale records
+	if d.written >= 2*d.records.Len()+1024 {
+		return d.compact()
+	}
+
+	if d.f == nil {
+		return os.ErrClosed
+	}
+	if _, err = d.f.Write(encodeDedupRecord(nil, rec)); err == nil {
+		d.written++
+	}
+	return
+}
+
+func (d *dedupIndex) insert(rec *dedupRecord) {
+	if e, ok := d.ids[rec.id]; ok {
+		d.records.Remove(e)
+	}
+	d.ids[rec.id] = d.records.PushBack(rec)
+}
+
+// forget IDs of entries at or after pos, which are lost (i.e buffered in memory on crash). Their
+// positions are taken by upcoming entries.
+func (d *dedupIndex) forget(pos uint64) {
+	for e := d.records.Front(); e != nil; {
+		next := e.Next()
+		if rec := e.Value.(*dedupRecord); rec.pos >= pos {
+			d.records.Remove(e)
+			delete(d.ids, rec.id)
+		}
+		e = next
+	}
+}
+
+// purge IDs of entries before floor, which are purged (see Purge).
+func (d *dedupIndex) purge(floor uint64) {
+	for e := d.records.Front(); e != nil; {
+		next := e.Next()
+		if rec := e.Value.(*dedupRecord); rec.pos < floor {
+			d.records.Remove(e)
+			delete(d.ids, rec.id)
+		}
+		e = next
+	}
+}
+
+// evict oldest IDs which are out of window.
+func (d *dedupIndex) evict(now time.Time) {
+	for {
+		front := d.records.Front()
+		if front == nil {
+			return
+		}
+
+		rec := front.Value.(*dedupRecord)
+		if (d.maxIDs <= 0 || d.records.Len() <= d.maxIDs) &&
+			(d.window <= 0 || now.UnixNano()-rec.ts <= int64(d.window)) {
+			return
+		}
+
+		d.records.Remove(front)
+		delete(d.ids, rec.id)
+	}
+}
+
+// compact rewrites file with remembered IDs only: write-temp-then-rename.
+func (d *dedupIndex) compact() (err error) {
+	if d.f != nil {
+		_ = d.f.Close()
+		d.f = nil
+	}
+
+	var buf []byte
+	for e := d.records.Front(); e != nil; e = e.Next() {
+		buf = encodeDedupRecord(buf, e.Value.(*dedupRecord))
+	}
+
+	tmp := d.path + ".tmp"
+	f, err := d.fs.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return
+	}
+
+	if _, err = f.Write(buf); err == nil {
+		err = f.Sync()
+	}
+	if err = multierror.Append(err, f.Close()).ErrorOrNil(); err == nil {
+		err = d.fs.Rename(tmp, d.path)
+	}
+	if err != nil {
+		_ = d.fs.Remove(tmp)
+		return
+	}
+
+	if d.f, err = d.fs.OpenFile(d.path, os.O_WRONLY|os.O_APPEND, 0o644); err == nil {
+		d.written = d.records.Len()
+	}
+	return
+}
+
+func (d *dedupIndex) close() (err error) {
+	if d.f != nil {
+		err = d.f.Close()
+		d.f = nil
+	}
+	return
+}
+
+func encodeDedupRecord(buf []byte, rec *dedupRecord) []byte {
+	start := len(buf)
+
+	var header [dedupRecordHeaderSize]byte
+	common.Endianese.PutUint64(header[:], uint64(rec.ts))
+	common.Endianese.PutUint64(header[8:], rec.pos)
+	common.Endianese.PutUint16(header[16:], uint16(len(rec.id)))
+
+	buf = append(buf, header[:]...)
+	buf = append(buf, rec.id...)
+
+	var sum [4]byte
+	common.Endianese.PutUint32(sum[:], crc32.ChecksumIEEE(buf[start:]))
+	return append(buf, sum[:]...)
+}
+
+func decodeDedupRecord(data []byte) (rec *dedupRecord, n int, err error) {
+	if len(data) < dedupRecordHeaderSize {
+		return nil, 0, errDedupCorrupted
+	}
+
+	idLen := int(common.Endianese.Uint16(data[16:]))
+	n = dedupRecordHeaderSize + idLen + 4
+	if len(data) < n ||
+		crc32.ChecksumIEEE(data[:n-4]) != common.Endianese.Uint32(data[n-4:]) {
+		return nil, 0, errDedupCorrupted
+	}
+
+	rec = &dedupRecord{
+		ts:  int64(common.Endianese.Uint64(data)),
+		pos: common.Endianese.Uint64(data[8:]),
+		id:  string(data[dedupRecordHeaderSize : n-4]),
+	}
+	return
+}
+
+// loadDedup loads remembered IDs, rebuilds them from segments if persisted ones are missing
+// or corrupted.
+func (q *queue) loadDedup(now time.Time) error {
+	d := newDedupIndex(
+		q.settings.FS,
+		filepath.Join(q.settings.DataDir, dedupFileName),
+		q.settings.DedupMaxIDs,
+		q.settings.DedupWindow,
+	)
+
+	if err := d.load(now); err != nil {
+		d.reset()
+		q.rebuildDedup(d, now)
+	}
+	d.forget(q.nextPos)
+	if q.manifest != nil {
+		d.purge(q.manifest.floor)
+	}
+
+	if err := d.compact(); err != nil {
+		return err
+	}
+
+	q.dedup = d
+	return nil
+}
+
+// rebuildDedup collects IDs from the newest segments.
+func (q *queue) rebuildDedup(d *dedupIndex, now time.Time) {
+	var (
+		collected [][]*dedupRecord
+		total     int
+	)
+
+	for node := q.segments.Back(); node != nil; node = node.Prev() {
+		seg := node.Value.(*segment)
+
+		info, err := q.settings.FS.Stat(seg.path)
+		if err != nil {
+			continue
+		}
+		if d.window > 0 && now.Sub(info.ModTime()) > d.window {
+			break
+		}
+
+		// enqueuing time is unknown, last modification of segment is the closest one
+		var records []*dedupRecord
+		_, _ = q.scanEntries(seg, func(r *entry.Record) {
+			if len(r.ID) > 0 {
+				records = append(records, &dedupRecord{
+					id:  string(r.ID),
+					pos: r.Position,
+					ts:  info.ModTime().UnixNano(),
+				})
+			}
+		})
+
+		collected = append(collected, records)
+		if total += len(records); d.maxIDs > 0 && total >= d.maxIDs {
+			break
+		}
+	}
+
+	for i := len(collected) - 1; i >= 0; i-- {
+		for _, rec := range collected[i] {
+			d.insert(rec)
+		}
+	}
+	d.evict(now)
+}
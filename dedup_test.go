@@ -0,0 +1,202 @@
+package pqueue
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/linxGnu/pqueue/common"
+	"github.com/linxGnu/pqueue/entry"
+	"github.com/linxGnu/pqueue/vfs"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedupIndex(t *testing.T) {
+	path := filepath.Join(tmpDir, "pqueue_dedup_index")
+	_ = os.Remove(path)
+	defer func() {
+		_ = os.Remove(path)
+	}()
+
+	now := time.Now()
+
+	t.Run("MaxIDs", func(t *testing.T) {
+		d := newDedupIndex(vfs.OS, path, 2, 0)
+		require.Error(t, d.load(now))
+		require.NoError(t, d.compact())
+
+		require.NoError(t, d.add("a", 1, now))
+		require.NoError(t, d.add("b", 2, now))
+		require.NoError(t, d.add("c", 3, now))
+
+		_, ok := d.lookup("a", now)
+		require.False(t, ok)
+
+		pos, ok := d.lookup("c", now)
+		require.True(t, ok)
+		require.EqualValues(t, 3, pos)
+		require.NoError(t, d.close())
+
+		// reload
+		d = newDedupIndex(vfs.OS, path, 2, 0)
+		require.NoError(t, d.load(now))
+		require.Equal(t, 2, d.records.Len())
+
+		pos, ok = d.lookup("b", now)
+		require.True(t, ok)
+		require.EqualValues(t, 2, pos)
+	})
+
+	t.Run("Window", func(t *testing.T) {
+		d := newDedupIndex(vfs.OS, path, 0, time.Minute)
+		require.NoError(t, d.compact())
+
+		require.NoError(t, d.add("a", 1, now))
+		require.NoError(t, d.add("b", 2, now.Add(time.Minute)))
+
+		_, ok := d.lookup("a", now.Add(time.Minute))
+		require.True(t, ok)
+
+		_, ok = d.lookup("a", now.Add(90*time.Second))
+		require.False(t, ok)
+
+		_, ok = d.lookup("b", now.Add(90*time.Second))
+		require.True(t, ok)
+		require.NoError(t, d.close())
+	})
+
+	t.Run("Corrupted", func(t *testing.T) {
+		data := encodeDedupRecord(nil, &dedupRecord{id: "a", pos: 1, ts: now.UnixNano()})
+		data = append(data, encodeDedupRecord(nil, &dedupRecord{id: "b", pos: 2, ts: now.UnixNano()})...)
+
+		require.NoError(t, os.WriteFile(path, data, 0o644))
+		require.NoError(t, newDedupIndex(vfs.OS, path, 0, 0).load(now))
+
+		require.NoError(t, os.WriteFile(path, data[:len(data)-1], 0o644))
+		require.Equal(t, errDedupCorrupted, newDedupIndex(vfs.OS, path, 0, 0).load(now))
+
+		data[0]++
+		require.NoError(t, os.WriteFile(path, data, 0o644))
+		require.Equal(t, errDedupCorrupted, newDedupIndex(vfs.OS, path, 0, 0).load(now))
+	})
+}
+
+func TestQueueEnqueueWithID(t *testing.T) {
+	dataDir := filepath.Join(tmpDir, "pqueue_dedup")
+	_ = os.RemoveAll(dataDir)
+	err := os.MkdirAll(dataDir, 0o777)
+	require.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(dataDir)
+	}()
+
+	t.Run("Disabled", func(t *testing.T) {
+		q, err := New(dataDir, 3)
+		require.NoError(t, err)
+
+		_, err = q.EnqueueWithID("a", []byte{1})
+		require.Equal(t, common.ErrDedupDisabled, err)
+		require.NoError(t, q.Purge())
+		_ = q.Close()
+	})
+
+	settings := QueueSettings{
+		DataDir:              dataDir,
+		EntryFormat:          common.EntryV2,
+		MaxEntriesPerSegment: 3,
+		DedupMaxIDs:          100,
+	}
+
+	q, err := NewWithSettings(settings)
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		pos, err := q.EnqueueWithID(string(rune('a'+i)), []byte{byte(i)})
+		require.NoError(t, err)
+		require.EqualValues(t, i, pos)
+	}
+
+	// retry
+	pos, err := q.EnqueueWithID("c", []byte{2})
+	require.NoError(t, err)
+	require.EqualValues(t, 2, pos)
+
+	_, err = q.EnqueueWithID(string(make([]byte, common.MaxEntryIDSize+1)), []byte{1})
+	require.Equal(t, common.ErrEntryIDTooLong, err)
+
+	var r entry.Record
+	require.True(t, q.PeekRecord(&r))
+	require.EqualValues(t, "a", r.ID)
+	for i := 0; i < 5; i++ {
+		require.True(t, q.DequeueRecord(&r))
+		require.EqualValues(t, i, r.Position)
+		require.EqualValues(t, []byte{byte(i)}, r.Entry)
+		require.EqualValues(t, string(rune('a'+i)), r.ID)
+	}
+	require.False(t, q.DequeueRecord(&r))
+	_ = q.Close()
+
+	// persisted across restarts
+	q, err = NewWithSettings(settings)
+	require.NoError(t, err)
+
+	pos, err = q.EnqueueWithID("d", []byte{3})
+	require.NoError(t, err)
+	require.EqualValues(t, 3, pos)
+
+	pos, err = q.EnqueueWithID("f", []byte{5})
+	require.NoError(t, err)
+	require.EqualValues(t, 5, pos)
+	_ = q.Close()
+
+	// rebuilt from segments when dedup file is missing
+	require.NoError(t, os.Remove(filepath.Join(dataDir, dedupFileName)))
+
+	q, err = NewWithSettings(settings)
+	require.NoError(t, err)
+
+	pos, err = q.EnqueueWithID("f", []byte{5})
+	require.NoError(t, err)
+	require.EqualValues(t, 5, pos)
+
+	pos, err = q.EnqueueWithID("g", []byte{6})
+	require.NoError(t, err)
+	require.EqualValues(t, 6, pos)
+	_ = q.Close()
+
+	// rebuilt from segments when dedup file is corrupted
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, dedupFileName), []byte{1, 2, 3}, 0o644))
+
+	q, err = NewWithSettings(settings)
+	require.NoError(t, err)
+
+	pos, err = q.EnqueueWithID("g", []byte{6})
+	require.NoError(t, err)
+	require.EqualValues(t, 6, pos)
+
+	// purged entries are forgotten
+	require.NoError(t, q.Purge())
+	pos, err = q.EnqueueWithID("g", []byte{6})
+	require.NoError(t, err)
+	require.EqualValues(t, 7, pos)
+	_ = q.Close()
+
+	// so are they if dedup file is left behind by purging
+	data := encodeDedupRecord(nil, &dedupRecord{id: "a", pos: 0, ts: time.Now().UnixNano()})
+	data = append(data, encodeDedupRecord(nil, &dedupRecord{id: "g", pos: 7, ts: time.Now().UnixNano()})...)
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, dedupFileName), data, 0o644))
+
+	q, err = NewWithSettings(settings)
+	require.NoError(t, err)
+
+	pos, err = q.EnqueueWithID("g", []byte{6})
+	require.NoError(t, err)
+	require.EqualValues(t, 7, pos)
+
+	pos, err = q.EnqueueWithID("a", []byte{0})
+	require.NoError(t, err)
+	require.EqualValues(t, 8, pos)
+	_ = q.Close()
+}
@@ -0,0 +1,19 @@
+package pqueue
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"github.com/linxGnu/pqueue/common"
+)
+
+// openDirect opens file for writing, bypassing page cache. Writes are synchronous (O_DSYNC),
+// since O_DIRECT alone does not flush disk cache nor metadata needed to read data back.
+func openDirect(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|syscall.O_DIRECT|syscall.O_DSYNC, 0)
+	if errors.Is(err, syscall.EINVAL) { // file system does not support O_DIRECT
+		return nil, common.ErrDirectIOUnsupported
+	}
+	return f, err
+}
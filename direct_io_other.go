@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package pqueue
+
+import (
+	"os"
+
+	"github.com/linxGnu/pqueue/common"
+)
+
+// openDirect is not supported.
+func openDirect(string) (*os.File, error) {
+	return nil, common.ErrDirectIOUnsupported
+}
@@ -0,0 +1,89 @@
+package pqueue
+
+import (
+	"os"
+	"unsafe"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+const (
+	// directBlockSize is alignment of memory, offsets and sizes written with O_DIRECT.
+	directBlockSize = 4 << 10
+
+	// directBufferSize is size of aligned buffer of direct writer.
+	directBufferSize = 64 * directBlockSize
+)
+
+// directWriter writes segment file bypassing page cache, see QueueSettings.DirectIO.
+//
+// Data is written as whole aligned blocks: the last partial block is padded with zeros and kept
+// in buffer, it's rewritten along with following data. Padding is truncated on closing. Until then,
+// readers take it as ending of segment, they never read beyond bytes written so far.
+type directWriter struct {
+	f   *os.File // opened with O_DIRECT
+	buf []byte   // aligned, the last partial block is kept at its beginning
+	n   int      // number of buffered bytes
+	off int64    // offset of buffer inside file, aligned
+}
+
+func newDirectWriter(path string) (*directWriter, error) {
+	f, err := openDirect(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &directWriter{
+		f:   f,
+		buf: alignedBuffer(directBufferSize, directBlockSize),
+	}, nil
+}
+
+func (w *directWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		c := copy(w.buf[w.n:], p)
+		w.n += c
+
+		if err = w.flush(); err != nil {
+			return
+		}
+		n, p = n+c, p[c:]
+	}
+	return
+}
+
+// flush buffered data as whole blocks. The last partial block is padded with zeros, it's kept
+// in buffer.
+func (w *directWriter) flush() error {
+	size := (w.n + directBlockSize - 1) &^ (directBlockSize - 1)
+	for i := w.n; i < size; i++ {
+		w.buf[i] = 0
+	}
+
+	if _, err := w.f.WriteAt(w.buf[:size], w.off); err != nil {
+		return err
+	}
+
+	if full := w.n &^ (directBlockSize - 1); full > 0 {
+		w.n = copy(w.buf, w.buf[full:w.n])
+		w.off += int64(full)
+	}
+	return nil
+}
+
+// Close truncates padding of the last block, then closes file.
+func (w *directWriter) Close() error {
+	err := w.f.Truncate(w.off + int64(w.n))
+	return multierror.Append(err, w.f.Close()).ErrorOrNil()
+}
+
+// alignedBuffer allocates buffer of given size, whose address is aligned.
+func alignedBuffer(size, align int) []byte {
+	buf := make([]byte, size+align)
+
+	offset := int(uintptr(unsafe.Pointer(&buf[0])) & uintptr(align-1))
+	if offset > 0 {
+		offset = align - offset
+	}
+	return buf[offset : offset+size : offset+size]
+}
@@ -0,0 +1,71 @@
+package entry
+
+import (
+	"hash/crc32"
+	"hash/crc64"
+
+	"github.com/linxGnu/pqueue/common"
+)
+
+var (
+	castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+	ecmaTable       = crc64.MakeTable(crc64.ECMA)
+)
+
+// checksum of entry header, which is either 32-bit or 64-bit.
+type checksum struct {
+	size   int // bytes in header
+	update func(sum uint64, p []byte) uint64
+}
+
+var (
+	checksumIEEE = checksum{
+		size: 4,
+		update: func(sum uint64, p []byte) uint64 {
+			return uint64(crc32.Update(uint32(sum), crc32.IEEETable, p))
+		},
+	}
+
+	checksumCastagnoli = checksum{
+		size: 4,
+		update: func(sum uint64, p []byte) uint64 {
+			return uint64(crc32.Update(uint32(sum), castagnoliTable, p))
+		},
+	}
+
+	checksumECMA = checksum{
+		size: 8,
+		update: func(sum uint64, p []byte) uint64 {
+			return crc64.Update(sum, ecmaTable, p)
+		},
+	}
+)
+
+// checksumOf entry format, which has EntryV2 layout.
+func checksumOf(format common.EntryFormat) checksum {
+	switch format {
+	case common.EntryV5:
+		return checksumCastagnoli
+
+	case common.EntryV6:
+		return checksumECMA
+
+	default:
+		return checksumIEEE
+	}
+}
+
+func (c checksum) put(dst []byte, sum uint64) {
+	if c.size == 4 {
+		common.Endianese.PutUint32(dst, uint32(sum))
+	} else {
+		common.Endianese.PutUint64(dst, sum)
+	}
+}
+
+func (c checksum) get(src []byte) uint64 {
+	if c.size == 4 {
+		return uint64(common.Endianese.Uint32(src))
+	}
+	return common.Endianese.Uint64(src)
+}
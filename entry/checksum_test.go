@@ -0,0 +1,63 @@
+package entry
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/linxGnu/pqueue/common"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEntryChecksum(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		format common.EntryFormat
+		size   int // of entry without metadata
+	}{
+		{name: "CRC32C", format: common.EntryV5, size: 13},
+		{name: "CRC64", format: common.EntryV6, size: 17},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			var e Entry = []byte{1, 2, 3, 4}
+			_, err := e.MarshalWithMeta(&buf, c.format, Meta{ID: []byte("id")})
+			require.NoError(t, err)
+			_, err = e.Marshal(&buf, c.format)
+			require.NoError(t, err)
+			data := append([]byte{}, buf.Bytes()...)
+
+			var (
+				tmp  Entry
+				meta Meta
+			)
+			code, n, err := tmp.UnmarshalWithMeta(&buf, c.format, &meta)
+			require.NoError(t, err)
+			require.Equal(t, common.NoError, code)
+			require.Equal(t, c.size+3, n)
+			require.EqualValues(t, e, tmp)
+			require.EqualValues(t, "id", meta.ID)
+
+			code, n, err = tmp.UnmarshalWithMeta(&buf, c.format, &meta)
+			require.NoError(t, err)
+			require.Equal(t, common.NoError, code)
+			require.Equal(t, c.size, n)
+			require.EqualValues(t, e, tmp)
+			require.Empty(t, meta.ID)
+
+			// checksum differs from EntryV2
+			_, _, err = tmp.Unmarshal(bytes.NewReader(data), common.EntryV2)
+			require.Equal(t, common.ErrEntryInvalidCheckSum, err)
+
+			// corrupted
+			data[len(data)-1]++
+			r := bytes.NewReader(data)
+			_, _, err = tmp.Unmarshal(r, c.format)
+			require.NoError(t, err)
+			code, _, err = tmp.Unmarshal(r, c.format)
+			require.Equal(t, common.ErrEntryInvalidCheckSum, err)
+			require.Equal(t, common.EntryCorrupted, code)
+		})
+	}
+}
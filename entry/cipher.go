@@ -0,0 +1,125 @@
+package entry
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"hash"
+	"io"
+
+	"github.com/linxGnu/pqueue/common"
+)
+
+// KeyProvider supplies keys for encrypting entries with EntryV3 format, or authenticating entries
+// with EntryV4 format. Every segment records ID of its key, so that keys could be rotated.
+type KeyProvider interface {
+	// CurrentKey returns key for new segments along with its ID. Encryption key must be 16, 24 or
+	// 32 bytes to select AES-128, AES-192 or AES-256. ID must not be longer than 255 bytes.
+	CurrentKey() (id string, key []byte, err error)
+
+	// Key returns key by ID, nil if not found.
+	Key(id string) ([]byte, error)
+}
+
+// Sealer encrypts and decrypts payload of entries with AES-GCM.
+type Sealer struct {
+	aead cipher.AEAD
+	buf  []byte
+}
+
+// NewSealer creates Sealer with AES key.
+func NewSealer(key []byte) (*Sealer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Sealer{aead: aead}, nil
+}
+
+// seal payload into [Nonce][Ciphertext], which is valid until next call.
+func (s *Sealer) seal(payload []byte) ([]byte, error) {
+	nonceSize := s.aead.NonceSize()
+
+	buf := s.buf[:0]
+	if cap(buf) < nonceSize {
+		buf = make([]byte, 0, nonceSize+len(payload)+s.aead.Overhead())
+	}
+	buf = buf[:nonceSize]
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return nil, err
+	}
+
+	s.buf = s.aead.Seal(buf, buf, payload, nil)
+	return s.buf, nil
+}
+
+// open [Nonce][Ciphertext] in place.
+func (s *Sealer) open(sealed []byte) ([]byte, error) {
+	nonceSize := s.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, common.ErrEntryDecryption
+	}
+
+	payload, err := s.aead.Open(sealed[nonceSize:nonceSize], sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return nil, common.ErrEntryDecryption
+	}
+	return payload, nil
+}
+
+// macSize is size of HMAC-SHA256.
+const macSize = sha256.Size
+
+// Signer authenticates entries with HMAC-SHA256.
+type Signer struct {
+	mac hash.Hash
+	sum [macSize]byte
+}
+
+// NewSigner creates Signer with HMAC key.
+func NewSigner(key []byte) (*Signer, error) {
+	if len(key) == 0 {
+		return nil, common.ErrEntryKeyRequired
+	}
+	return &Signer{mac: hmac.New(sha256.New, key)}, nil
+}
+
+// sign parts of entry, returned MAC is valid until next call.
+func (s *Signer) sign(parts ...[]byte) []byte {
+	s.mac.Reset()
+	for _, p := range parts {
+		_, _ = s.mac.Write(p)
+	}
+	return s.mac.Sum(s.sum[:0])
+}
+
+// verify MAC of data.
+func (s *Signer) verify(data, mac []byte) bool {
+	return hmac.Equal(s.sign(data), mac)
+}
+
+// Encoding transforms payload of entries on writing, and reverts it on reading.
+type Encoding struct {
+	Compressor *Compressor // compresses on writing, decompressing is done by registered codecs
+	Sealer     *Sealer     // required by EntryV3 format
+	Signer     *Signer     // required by EntryV4 format
+	NoChecksum bool        // blocks of EntryV7 format are written without checksum
+
+	// Opaque reads entries of EntryV3/EntryV4 format without their key: payload is left sealed and
+	// MAC is not verified. Metadata is still read, so that entries could be counted.
+	Opaque bool
+}
+
+// opaqueSealer and opaqueSigner stand for missing keys of opaque Encoding.
+var (
+	opaqueSealer = &Sealer{}
+	opaqueSigner = &Signer{}
+)
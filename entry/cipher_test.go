@@ -0,0 +1,132 @@
+package entry
+
+import (
+	"bytes"
+	"hash/crc32"
+	"testing"
+
+	"github.com/linxGnu/pqueue/common"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSealer(t *testing.T) {
+	_, err := NewSealer([]byte{1, 2, 3})
+	require.Error(t, err)
+
+	sealer, err := NewSealer(bytes.Repeat([]byte{1}, 32))
+	require.NoError(t, err)
+
+	other, err := NewSealer(bytes.Repeat([]byte{2}, 32))
+	require.NoError(t, err)
+
+	codec, err := NewFlateCodec(1)
+	require.NoError(t, err)
+
+	enc := &Encoding{
+		Compressor: &Compressor{Codec: codec},
+		Sealer:     sealer,
+	}
+	payload := bytes.Repeat([]byte("secret"), 100)
+
+	t.Run("Happy", func(t *testing.T) {
+		var buf bytes.Buffer
+		_, err := Entry(payload).MarshalEncoded(&buf, common.EntryV3, Meta{ID: []byte("id")}, enc)
+		require.NoError(t, err)
+		require.False(t, bytes.Contains(buf.Bytes(), []byte("secret")))
+
+		var (
+			e    Entry
+			meta Meta
+		)
+		code, _, err := e.UnmarshalEncoded(bytes.NewReader(buf.Bytes()), common.EntryV3, &meta, &Encoding{Sealer: sealer})
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+		require.EqualValues(t, payload, e)
+		require.EqualValues(t, "id", meta.ID)
+		require.Equal(t, CodecFlate, meta.Codec)
+
+		// wrong key
+		code, _, err = e.UnmarshalEncoded(bytes.NewReader(buf.Bytes()), common.EntryV3, &meta, &Encoding{Sealer: other})
+		require.Equal(t, common.ErrEntryDecryption, err)
+		require.Equal(t, common.EntryUndecryptable, code)
+
+		// without key
+		code, n, err := e.UnmarshalEncoded(bytes.NewReader(buf.Bytes()), common.EntryV3, &meta, &Encoding{Opaque: true})
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+		require.Equal(t, buf.Len(), n)
+		require.EqualValues(t, "id", meta.ID)
+		require.NotEqual(t, payload, []byte(e))
+	})
+
+	t.Run("KeyRequired", func(t *testing.T) {
+		_, err := Entry(payload).MarshalWithMeta(&bytes.Buffer{}, common.EntryV3, Meta{})
+		require.Equal(t, common.ErrEntryKeyRequired, err)
+
+		var e Entry
+		_, _, err = e.Unmarshal(&bytes.Buffer{}, common.EntryV3)
+		require.Equal(t, common.ErrEntryKeyRequired, err)
+	})
+}
+
+func TestSigner(t *testing.T) {
+	_, err := NewSigner(nil)
+	require.Equal(t, common.ErrEntryKeyRequired, err)
+
+	signer, err := NewSigner([]byte("key"))
+	require.NoError(t, err)
+
+	other, err := NewSigner([]byte("other"))
+	require.NoError(t, err)
+
+	enc := &Encoding{Signer: signer}
+	payload := []byte("payload")
+
+	var buf bytes.Buffer
+	_, err = Entry(payload).MarshalEncoded(&buf, common.EntryV4, Meta{ID: []byte("id")}, enc)
+	require.NoError(t, err)
+	_, err = Entry(payload).MarshalEncoded(&buf, common.EntryV4, Meta{}, enc)
+	require.NoError(t, err)
+	data := buf.Bytes()
+
+	var (
+		e    Entry
+		meta Meta
+	)
+	code, _, err := e.UnmarshalEncoded(bytes.NewReader(data), common.EntryV4, &meta, enc)
+	require.NoError(t, err)
+	require.Equal(t, common.NoError, code)
+	require.EqualValues(t, payload, e)
+	require.EqualValues(t, "id", meta.ID)
+
+	// wrong key
+	code, _, err = e.UnmarshalEncoded(bytes.NewReader(data), common.EntryV4, &meta, &Encoding{Signer: other})
+	require.Equal(t, common.ErrEntryAuthentication, err)
+	require.Equal(t, common.EntryUnauthenticated, code)
+
+	// forged payload with valid checksum, the next entry is still readable
+	data[bytes.Index(data, payload)] = 'P'
+	size := common.Endianese.Uint32(data)
+	common.Endianese.PutUint32(data[4:], crc32.ChecksumIEEE(data[8:8+size]))
+
+	r := bytes.NewReader(data)
+	code, n, err := e.UnmarshalEncoded(r, common.EntryV4, &meta, enc)
+	require.Equal(t, common.ErrEntryAuthentication, err)
+	require.Equal(t, common.EntryUnauthenticated, code)
+	require.EqualValues(t, 8+size, n)
+
+	code, _, err = e.UnmarshalEncoded(r, common.EntryV4, &meta, enc)
+	require.NoError(t, err)
+	require.Equal(t, common.NoError, code)
+	require.EqualValues(t, payload, e)
+
+	// without key, MAC is not verified
+	code, _, err = e.UnmarshalEncoded(bytes.NewReader(data), common.EntryV4, &meta, &Encoding{Opaque: true})
+	require.NoError(t, err)
+	require.Equal(t, common.NoError, code)
+	require.EqualValues(t, "Payload", e)
+
+	_, err = Entry(payload).Marshal(&bytes.Buffer{}, common.EntryV4)
+	require.Equal(t, common.ErrEntryKeyRequired, err)
+}
@@ -0,0 +1,157 @@
+package entry
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+
+	"github.com/linxGnu/pqueue/common"
+)
+
+// CodecFlate is ID of compress/flate codec, which is registered by default.
+const CodecFlate uint8 = 1
+
+// Codec compresses and decompresses payload of entries.
+type Codec interface {
+	// ID identifies codec on disk, must be non-zero.
+	ID() uint8
+
+	// Encode appends compressed src to dst.
+	Encode(dst, src []byte) ([]byte, error)
+
+	// Decode appends decompressed src to dst. common.ErrEntryTooBig is returned if decompressed
+	// payload is bigger than limit.
+	Decode(dst, src []byte, limit int) ([]byte, error)
+
+	// NewWriter returns writer which compresses everything written to it into w, until it's
+	// closed. Closing does not close w.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+
+	// NewReader returns reader which decompresses r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var codecs struct {
+	sync.RWMutex
+	byID [256]Codec
+}
+
+func init() {
+	_ = RegisterCodec(&flateCodec{level: flate.DefaultCompression})
+}
+
+// RegisterCodec makes codec available for decompressing entries. Codec registered before with
+// the same ID is replaced.
+func RegisterCodec(c Codec) error {
+	if c == nil || c.ID() == 0 {
+		return common.ErrCodecInvalidID
+	}
+
+	codecs.Lock()
+	codecs.byID[c.ID()] = c
+	codecs.Unlock()
+	return nil
+}
+
+// LookupCodec returns registered codec by ID, nil if not found.
+func LookupCodec(id uint8) (c Codec) {
+	codecs.RLock()
+	c = codecs.byID[id]
+	codecs.RUnlock()
+	return
+}
+
+// Compressor compresses payload of entries, which are not smaller than Threshold, with Codec.
+type Compressor struct {
+	Codec     Codec
+	Threshold int
+
+	buf []byte
+}
+
+// Compress payload of entry and marks its codec in meta. Entry is returned as is if it's smaller
+// than threshold or compression does not help (or fails). Compressed payload is valid until
+// next call.
+func (c *Compressor) Compress(e Entry, meta *Meta) Entry {
+	if c == nil || c.Codec == nil || len(e) < c.Threshold {
+		return e
+	}
+
+	buf, err := c.Codec.Encode(c.buf[:0], e)
+	if err != nil {
+		return e
+	}
+	c.buf = buf
+
+	if len(buf) >= len(e) {
+		return e
+	}
+
+	meta.Codec = c.Codec.ID()
+	return buf
+}
+
+type flateCodec struct {
+	level   int
+	writers sync.Pool
+	readers sync.Pool
+}
+
+// NewFlateCodec creates compress/flate codec with given compression level.
+func NewFlateCodec(level int) (Codec, error) {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return nil, common.ErrCodecInvalidLevel
+	}
+	return &flateCodec{level: level}, nil
+}
+
+func (c *flateCodec) ID() uint8 {
+	return CodecFlate
+}
+
+func (c *flateCodec) Encode(dst, src []byte) (_ []byte, err error) {
+	buf := bytes.NewBuffer(dst)
+
+	w, _ := c.writers.Get().(*flate.Writer)
+	if w == nil {
+		if w, err = flate.NewWriter(buf, c.level); err != nil {
+			return nil, err
+		}
+	} else {
+		w.Reset(buf)
+	}
+
+	if _, err = w.Write(src); err == nil {
+		err = w.Close()
+	}
+	c.writers.Put(w)
+
+	return buf.Bytes(), err
+}
+
+func (c *flateCodec) Decode(dst, src []byte, limit int) ([]byte, error) {
+	r, _ := c.readers.Get().(io.ReadCloser)
+	if r == nil {
+		r = flate.NewReader(bytes.NewReader(src))
+	} else {
+		_ = r.(flate.Resetter).Reset(bytes.NewReader(src), nil)
+	}
+
+	buf := bytes.NewBuffer(dst)
+	n, err := buf.ReadFrom(io.LimitReader(r, int64(limit)+1))
+	c.readers.Put(r)
+
+	if err == nil && n > int64(limit) {
+		err = common.ErrEntryTooBig
+	}
+	return buf.Bytes(), err
+}
+
+func (c *flateCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, c.level)
+}
+
+func (c *flateCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
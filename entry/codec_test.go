@@ -0,0 +1,131 @@
+package entry
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"testing"
+
+	"github.com/linxGnu/pqueue/common"
+
+	"github.com/stretchr/testify/require"
+)
+
+type mockCodec struct{ id uint8 }
+
+func (c *mockCodec) ID() uint8 {
+	return c.id
+}
+
+func (c *mockCodec) Encode(dst, src []byte) ([]byte, error) {
+	return append(dst, src[:1]...), nil
+}
+
+func (c *mockCodec) Decode(dst, src []byte, limit int) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+func (c *mockCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func (c *mockCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(r), nil
+}
+
+func TestCodec(t *testing.T) {
+	_, err := NewFlateCodec(flate.BestCompression + 1)
+	require.Equal(t, common.ErrCodecInvalidLevel, err)
+
+	require.Equal(t, common.ErrCodecInvalidID, RegisterCodec(&mockCodec{}))
+	require.Nil(t, LookupCodec(123))
+
+	codec, err := NewFlateCodec(flate.BestSpeed)
+	require.NoError(t, err)
+
+	payload := bytes.Repeat([]byte(`{"key":"value"}`), 100)
+
+	t.Run("Flate", func(t *testing.T) {
+		encoded, err := codec.Encode([]byte{1}, payload)
+		require.NoError(t, err)
+		require.Less(t, len(encoded), len(payload))
+		require.EqualValues(t, 1, encoded[0])
+
+		decoded, err := codec.Decode([]byte{2}, encoded[1:], len(payload))
+		require.NoError(t, err)
+		require.Equal(t, append([]byte{2}, payload...), decoded)
+
+		_, err = codec.Decode(nil, encoded[1:], len(payload)-1)
+		require.Equal(t, common.ErrEntryTooBig, err)
+
+		// streamed
+		var buf bytes.Buffer
+		w, err := codec.NewWriter(&buf)
+		require.NoError(t, err)
+		_, err = w.Write(payload)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+
+		r, err := codec.NewReader(&buf)
+		require.NoError(t, err)
+		decoded, err = io.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, payload, decoded)
+		require.NoError(t, r.Close())
+	})
+
+	t.Run("Compressor", func(t *testing.T) {
+		c := &Compressor{Codec: codec, Threshold: 64}
+
+		var meta Meta
+		require.EqualValues(t, payload[:63], c.Compress(payload[:63], &meta))
+		require.Zero(t, meta.Codec)
+
+		var buf bytes.Buffer
+		_, err := c.Compress(payload, &meta).MarshalWithMeta(&buf, common.EntryV2, meta)
+		require.NoError(t, err)
+		require.Equal(t, CodecFlate, meta.Codec)
+		require.Less(t, buf.Len(), len(payload))
+
+		_, err = Entry(payload).MarshalWithMeta(&buf, common.EntryV1, meta)
+		require.Equal(t, common.ErrEntryUnsupportedFormat, err)
+
+		var e Entry
+		code, _, err := e.UnmarshalWithMeta(&buf, common.EntryV2, &meta)
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+		require.EqualValues(t, payload, e)
+		require.Equal(t, CodecFlate, meta.Codec)
+
+		// incompressible
+		meta = Meta{}
+		require.EqualValues(t, []byte{1, 2, 3}, (&Compressor{Codec: codec}).Compress([]byte{1, 2, 3}, &meta))
+		require.Zero(t, meta.Codec)
+	})
+
+	t.Run("UnknownCodec", func(t *testing.T) {
+		mock := &mockCodec{id: 200}
+		require.NoError(t, RegisterCodec(mock))
+
+		var (
+			buf  bytes.Buffer
+			meta Meta
+		)
+		c := &Compressor{Codec: mock}
+		_, err := c.Compress([]byte{1, 2, 3}, &meta).MarshalWithMeta(&buf, common.EntryV2, meta)
+		require.NoError(t, err)
+
+		codecs.byID[mock.id] = nil
+
+		var e Entry
+		code, _, err := e.Unmarshal(&buf, common.EntryV2)
+		require.Equal(t, common.ErrEntryUnknownCodec, err)
+		require.Equal(t, common.EntryCorrupted, code)
+	})
+}
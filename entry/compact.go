@@ -0,0 +1,229 @@
+package entry
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+
+	"github.com/linxGnu/pqueue/common"
+)
+
+// block of EntryV7 format, which is written by one call.
+type block struct {
+	buf     []byte // [Header][Length][Entry]...
+	payload int    // total size of entries
+	count   int
+}
+
+func (b *block) reset() {
+	if cap(b.buf) < binary.MaxVarintLen64 {
+		b.buf = make([]byte, binary.MaxVarintLen64, 256)
+	}
+	b.buf = b.buf[:binary.MaxVarintLen64] // reserved for header
+	b.payload, b.count = 0, 0
+}
+
+func (b *block) append(e Entry) {
+	var buf [binary.MaxVarintLen64]byte
+	b.buf = append(b.buf, buf[:binary.PutUvarint(buf[:], uint64(len(e)))]...)
+	b.buf = append(b.buf, e...)
+	b.payload += len(e)
+	b.count++
+}
+
+func blockHeader(count int, checksum bool) uint64 {
+	if checksum {
+		return uint64(count)<<1 | 1
+	}
+	return uint64(count) << 1
+}
+
+// [Header - uvarint][Length - uvarint][Entry - bytes]...[Checksum - uint32]
+func (b *block) marshal(w io.Writer, checksum bool) (code common.ErrCode, err error) {
+	// header is put right before entries
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], blockHeader(b.count, checksum))
+	data := b.buf[binary.MaxVarintLen64-n:]
+	copy(data, buf[:n])
+
+	if checksum {
+		data = append(data, 0, 0, 0, 0)
+		common.Endianese.PutUint32(data[len(data)-4:], crc32.Checksum(data[:len(data)-4], castagnoliTable))
+	}
+
+	if _, err = w.Write(data); err != nil {
+		return common.EntryWriteErr, err
+	}
+	return common.NoError, nil
+}
+
+// [Header - uvarint][Length - uvarint][Entry - bytes][Checksum - uint32]
+func (e Entry) marshalCompact(w io.Writer, checksum bool) (code common.ErrCode, err error) {
+	var buf [2*binary.MaxVarintLen64 + 4]byte
+	n := binary.PutUvarint(buf[:], blockHeader(1, checksum))
+	n += binary.PutUvarint(buf[n:], uint64(len(e)))
+
+	if _, err = w.Write(buf[:n]); err == nil {
+		if _, err = w.Write(e); err == nil && checksum {
+			sum := crc32.Update(crc32.Checksum(buf[:n], castagnoliTable), castagnoliTable, e)
+			common.Endianese.PutUint32(buf[n:], sum)
+			_, err = w.Write(buf[n : n+4])
+		}
+	}
+
+	if err != nil {
+		code = common.EntryWriteErr
+	} else {
+		code = common.NoError
+	}
+
+	return
+}
+
+// marshalCompact writes entries as blocks, each of them holds at most common.MaxEntrySize of entries.
+func (b *Batch) marshalCompact(w io.Writer, checksum bool) (code common.ErrCode, err error) {
+	var blk block
+	blk.reset()
+
+	for _, e := range b.entries {
+		if blk.count > 0 && blk.payload+len(e) > common.MaxEntrySize {
+			if code, err = blk.marshal(w, checksum); err != nil {
+				return
+			}
+			blk.reset()
+		}
+		blk.append(e)
+	}
+
+	if blk.count > 0 {
+		code, err = blk.marshal(w, checksum)
+	}
+	return
+}
+
+// [Header - uvarint][Length - uvarint][Entry - bytes]...[Checksum - uint32]
+//
+// Single entry is returned as is. Otherwise, entries are returned as batch frame, meta.Batch is
+// set to their count.
+func (e *Entry) unmarshalCompact(r io.Reader, meta *Meta) (code common.ErrCode, n int, err error) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = byteReader{r: r}
+	}
+
+	// read header
+	header, n, err := readUvarint(br)
+	if errors.Is(err, io.EOF) && n == 0 {
+		code, err = common.EntryNoMore, nil
+		return
+	}
+	if err != nil {
+		code = common.EntryCorrupted
+		return
+	}
+	if header == 0 {
+		code = common.EntryZeroSize
+		return
+	}
+
+	count := header >> 1
+	if count == 0 || count > common.MaxEntrySize {
+		code, err = common.EntryCorrupted, common.ErrEntryCorruptedMeta
+		return
+	}
+
+	var buf [binary.MaxVarintLen64]byte
+	sum := crc32.Update(0, castagnoliTable, buf[:binary.PutUvarint(buf[:], header)])
+
+	// read entries as frame: [Length][Entry]...
+	data, payload := (*e)[:0], 0
+	for i := uint64(0); i < count; i++ {
+		size, sz, err_ := readUvarint(br)
+		if n += sz; err_ != nil {
+			code, err = common.EntryCorrupted, err_
+			return
+		}
+		if size > common.MaxEntrySize || payload+int(size) > common.MaxEntrySize {
+			code, err = common.EntryCorrupted, common.ErrEntryTooBig
+			return
+		}
+
+		payload += int(size)
+		data = append(data, buf[:binary.PutUvarint(buf[:], size)]...)
+		start := len(data)
+		if cap(data)-start < int(size) {
+			data = append(data, make([]byte, size)...)
+		} else {
+			data = data[:start+int(size)]
+		}
+
+		sz, err_ = io.ReadFull(r, data[start:])
+		if n += sz; err_ != nil {
+			code, err = common.EntryCorrupted, err_
+			return
+		}
+	}
+
+	if header&1 != 0 {
+		var stored [4]byte
+		sz, err_ := io.ReadFull(r, stored[:])
+		if n += sz; err_ != nil {
+			code, err = common.EntryCorrupted, err_
+			return
+		}
+
+		if crc32.Update(sum, castagnoliTable, data) != common.Endianese.Uint32(stored[:]) {
+			code, err = common.EntryCorrupted, common.ErrEntryInvalidCheckSum
+			return
+		}
+	}
+
+	if count == 1 {
+		// entry is right after its length, move it to the front to keep buffer reusable
+		_, sz := binary.Uvarint(data)
+		data = data[:copy(data, data[sz:])]
+	} else if meta != nil {
+		meta.Batch = int(count)
+	}
+
+	*e = data
+	code = common.NoError
+	return
+}
+
+// readUvarint from r, returns number of read bytes.
+func readUvarint(r io.ByteReader) (x uint64, n int, err error) {
+	var s uint
+	for n < binary.MaxVarintLen64 {
+		var b byte
+		if b, err = r.ReadByte(); err != nil {
+			if n > 0 && errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+		n++
+
+		if b < 0x80 {
+			if n == binary.MaxVarintLen64 && b > 1 {
+				break // overflow
+			}
+			return x | uint64(b)<<s, n, nil
+		}
+		x |= uint64(b&0x7f) << s
+		s += 7
+	}
+	return x, n, common.ErrEntryCorruptedMeta
+}
+
+// byteReader reads byte by byte from r.
+type byteReader struct {
+	r   io.Reader
+	buf [1]byte
+}
+
+func (b byteReader) ReadByte() (byte, error) {
+	_, err := io.ReadFull(b.r, b.buf[:])
+	return b.buf[0], err
+}
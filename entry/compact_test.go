@@ -0,0 +1,90 @@
+package entry
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/linxGnu/pqueue/common"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEntryCompact(t *testing.T) {
+	payload := bytes.Repeat([]byte{1}, 16)
+
+	t.Run("Entry", func(t *testing.T) {
+		var buf bytes.Buffer
+
+		_, err := Entry(payload).Marshal(&buf, common.EntryV7)
+		require.NoError(t, err)
+		require.Equal(t, 22, buf.Len())
+
+		_, err = Entry(payload).MarshalEncoded(&buf, common.EntryV7, Meta{}, &Encoding{NoChecksum: true})
+		require.NoError(t, err)
+		require.Equal(t, 22+18, buf.Len())
+
+		// readers without io.ByteReader are supported too
+		r := struct{ io.Reader }{&buf}
+
+		var e Entry
+		for _, size := range []int{22, 18} {
+			code, n, err := e.Unmarshal(r, common.EntryV7)
+			require.NoError(t, err)
+			require.Equal(t, common.NoError, code)
+			require.Equal(t, size, n)
+			require.EqualValues(t, payload, e)
+		}
+
+		code, _, err := e.Unmarshal(r, common.EntryV7)
+		require.NoError(t, err)
+		require.Equal(t, common.EntryNoMore, code)
+
+		code, _, _ = e.Unmarshal(bytes.NewReader(make([]byte, 8)), common.EntryV7)
+		require.Equal(t, common.EntryZeroSize, code)
+
+		_, err = Entry(payload).MarshalWithMeta(&buf, common.EntryV7, Meta{Batch: 2})
+		require.Equal(t, common.ErrEntryUnsupportedFormat, err)
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		b := NewBatch(3)
+		b.Append(payload)
+		b.Append([]byte{2})
+		b.Append([]byte{3, 4})
+
+		var buf bytes.Buffer
+		_, err := b.Marshal(&buf, common.EntryV7)
+		require.NoError(t, err)
+		require.Equal(t, 1+17+2+3+4, buf.Len())
+		data := append([]byte{}, buf.Bytes()...)
+
+		var (
+			e    Entry
+			meta Meta
+		)
+		code, n, err := e.UnmarshalWithMeta(&buf, common.EntryV7, &meta)
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+		require.Equal(t, len(data), n)
+		require.Equal(t, 3, meta.Batch)
+
+		frame := Frame(e)
+		for _, expected := range []Entry{payload, {2}, {3, 4}} {
+			var next Entry
+			next, frame, err = frame.Next()
+			require.NoError(t, err)
+			require.EqualValues(t, expected, next)
+		}
+		require.Empty(t, frame)
+
+		// corrupted
+		data[5]++
+		code, _, err = e.UnmarshalWithMeta(bytes.NewReader(data), common.EntryV7, &meta)
+		require.Equal(t, common.ErrEntryInvalidCheckSum, err)
+		require.Equal(t, common.EntryCorrupted, code)
+
+		code, _, _ = e.UnmarshalWithMeta(bytes.NewReader(data[:10]), common.EntryV7, &meta)
+		require.Equal(t, common.EntryCorrupted, code)
+	})
+}
@@ -1,9 +1,11 @@
 package entry
 
 import (
+	"encoding/binary"
 	"errors"
 	"hash/crc32"
 	"io"
+	"math"
 
 	"github.com/linxGnu/pqueue/common"
 )
@@ -13,24 +15,102 @@ type Reader interface {
 	io.Closer
 	io.Seeker
 	ReadEntry(*Entry) (common.ErrCode, int, error)
+	ReadEntryWithMeta(*Entry, *Meta) (common.ErrCode, int, error)
 }
 
 // Writer interface.
 type Writer interface {
 	io.Closer
 	WriteEntry(Entry) (common.ErrCode, error)
+	WriteEntryWithMeta(Entry, Meta) (common.ErrCode, error)
 	WriteBatch(Batch) (common.ErrCode, error)
+	WriteStream(io.Reader, int64, int, Meta) (common.ErrCode, error)
 }
 
 // Entry represents queue entry.
 type Entry []byte
 
+// Meta is optional metadata stored along with entry. It's not persisted with EntryV1 format.
+type Meta struct {
+	ID    []byte
+	Chunk Chunk
+
+	// Codec is ID of codec which payload is compressed with, zero if not compressed.
+	// Payload is decompressed transparently on reading.
+	Codec uint8
+
+	// Batch is number of entries packed in batch frame, zero if payload is a single entry.
+	Batch int
+}
+
+// Chunk locates a chunk inside a large entry.
+type Chunk struct {
+	Total  int64 // size of whole entry, zero if entry is not chunked
+	Offset int64 // offset of chunk inside entry
+}
+
+// IsLast checks if chunk of given size is the last one of large entry.
+func (c Chunk) IsLast(size int) bool {
+	return c.Offset+int64(size) >= c.Total
+}
+
+const (
+	// maxMetaSize is max size of [Flags][Metadata] of EntryV2.
+	maxMetaSize = 1 + binary.MaxVarintLen64 + common.MaxEntryIDSize + 2*binary.MaxVarintLen64 + 1 + binary.MaxVarintLen64
+
+	// maxSealOverhead is max size of nonce and tag of sealed payload.
+	maxSealOverhead = 12 + 16
+)
+
 // Marshal writes entry to writer.
 func (e Entry) Marshal(w io.Writer, format common.EntryFormat) (code common.ErrCode, err error) {
+	return e.MarshalWithMeta(w, format, Meta{})
+}
+
+// MarshalWithMeta writes entry along with its metadata to writer. Metadata is ignored
+// if format does not support it.
+func (e Entry) MarshalWithMeta(w io.Writer, format common.EntryFormat, meta Meta) (code common.ErrCode, err error) {
+	return e.MarshalEncoded(w, format, meta, nil)
+}
+
+// MarshalEncoded writes entry along with its metadata to writer, payload is transformed by enc.
+func (e Entry) MarshalEncoded(w io.Writer, format common.EntryFormat, meta Meta, enc *Encoding) (code common.ErrCode, err error) {
 	switch format {
 	case common.EntryV1:
+		if meta.Codec != 0 || meta.Batch > 0 { // could not be told apart from plain payload
+			return common.EntryUnsupportedFormat, common.ErrEntryUnsupportedFormat
+		}
 		return e.marshalV1(w)
 
+	case common.EntryV7:
+		if meta.Codec != 0 || meta.Batch > 0 || meta.Chunk.Total > 0 {
+			return common.EntryUnsupportedFormat, common.ErrEntryUnsupportedFormat
+		}
+		return e.marshalCompact(w, enc == nil || !enc.NoChecksum)
+
+	case common.EntryV2, common.EntryV5, common.EntryV6:
+		if enc != nil {
+			e = enc.Compressor.Compress(e, &meta)
+		}
+		return e.marshalV2(w, meta, nil, checksumOf(format))
+
+	case common.EntryV3:
+		if enc == nil || enc.Sealer == nil {
+			return common.EntryWriteErr, common.ErrEntryKeyRequired
+		}
+
+		// compress before encrypting, ciphertext is not compressible
+		if e, err = enc.Sealer.seal(enc.Compressor.Compress(e, &meta)); err != nil {
+			return common.EntryWriteErr, err
+		}
+		return e.marshalV2(w, meta, nil, checksumIEEE)
+
+	case common.EntryV4:
+		if enc == nil || enc.Signer == nil {
+			return common.EntryWriteErr, common.ErrEntryKeyRequired
+		}
+		return enc.Compressor.Compress(e, &meta).marshalV2(w, meta, enc.Signer, checksumIEEE)
+
 	default:
 		return common.EntryUnsupportedFormat, common.ErrEntryUnsupportedFormat
 	}
@@ -53,12 +133,118 @@ func (e Entry) marshalV1(w io.Writer) (code common.ErrCode, err error) {
 	return
 }
 
+// [Length - uint32][Checksum - uint32/uint64][Flags - uint8][Metadata - bytes][Payload - bytes]
+// followed by [MAC] if signer is not nil.
+func (e Entry) marshalV2(w io.Writer, meta Meta, signer *Signer, cs checksum) (code common.ErrCode, err error) {
+	if len(meta.ID) > common.MaxEntryIDSize {
+		return common.EntryTooBig, common.ErrEntryIDTooLong
+	}
+
+	var buf [12 + 1 + 4*binary.MaxVarintLen64 + 1]byte
+	h := 4 + cs.size // header size
+
+	// flags and metadata: [ID Length][ID][Total Size][Chunk Offset][Codec ID][Count]
+	n := h + 1
+	if len(meta.ID) > 0 {
+		buf[h] |= common.EntryFlagID
+		n += binary.PutUvarint(buf[n:], uint64(len(meta.ID)))
+	}
+	m := n
+	if meta.Chunk.Total > 0 {
+		buf[h] |= common.EntryFlagChunk
+		m += binary.PutUvarint(buf[m:], uint64(meta.Chunk.Total))
+		m += binary.PutUvarint(buf[m:], uint64(meta.Chunk.Offset))
+	}
+	if meta.Codec != 0 {
+		buf[h] |= common.EntryFlagCompressed
+		buf[m] = meta.Codec
+		m++
+	}
+	if meta.Batch > 0 {
+		buf[h] |= common.EntryFlagBatch
+		m += binary.PutUvarint(buf[m:], uint64(meta.Batch))
+	}
+
+	var mac []byte
+	if signer != nil {
+		mac = signer.sign(buf[h:n], meta.ID, buf[n:m], e)
+	}
+
+	size := m - h + len(meta.ID) + len(e) + len(mac)
+	sum := cs.update(0, buf[h:n])
+	sum = cs.update(sum, meta.ID)
+	sum = cs.update(sum, buf[n:m])
+	sum = cs.update(sum, e)
+	sum = cs.update(sum, mac)
+	common.Endianese.PutUint32(buf[:], uint32(size))
+	cs.put(buf[4:h], sum)
+
+	if _, err = w.Write(buf[:n]); err == nil {
+		if _, err = w.Write(meta.ID); err == nil {
+			if _, err = w.Write(buf[n:m]); err == nil {
+				if _, err = w.Write(e); err == nil && len(mac) > 0 {
+					_, err = w.Write(mac)
+				}
+			}
+		}
+	}
+
+	if err != nil {
+		code = common.EntryWriteErr
+	} else {
+		code = common.NoError
+	}
+
+	return
+}
+
 // Unmarshal from reader.
 func (e *Entry) Unmarshal(r io.Reader, format common.EntryFormat) (common.ErrCode, int, error) {
+	return e.UnmarshalWithMeta(r, format, nil)
+}
+
+// UnmarshalWithMeta reads entry along with its metadata from reader. Metadata is discarded if meta is nil.
+func (e *Entry) UnmarshalWithMeta(r io.Reader, format common.EntryFormat, meta *Meta) (common.ErrCode, int, error) {
+	return e.UnmarshalEncoded(r, format, meta, nil)
+}
+
+// UnmarshalEncoded reads entry along with its metadata from reader, payload is reverted by enc.
+func (e *Entry) UnmarshalEncoded(r io.Reader, format common.EntryFormat, meta *Meta, enc *Encoding) (common.ErrCode, int, error) {
+	if meta != nil {
+		meta.ID = meta.ID[:0]
+		meta.Chunk = Chunk{}
+		meta.Codec = 0
+		meta.Batch = 0
+	}
+
 	switch format {
 	case common.EntryV1:
 		return e.unmarshalV1(r)
 
+	case common.EntryV7:
+		return e.unmarshalCompact(r, meta)
+
+	case common.EntryV2, common.EntryV5, common.EntryV6:
+		return e.unmarshalV2(r, meta, nil, nil, checksumOf(format))
+
+	case common.EntryV3:
+		if enc != nil && enc.Opaque {
+			return e.unmarshalV2(r, meta, opaqueSealer, nil, checksumIEEE)
+		}
+		if enc == nil || enc.Sealer == nil {
+			return common.EntryUnsupportedFormat, 0, common.ErrEntryKeyRequired
+		}
+		return e.unmarshalV2(r, meta, enc.Sealer, nil, checksumIEEE)
+
+	case common.EntryV4:
+		if enc != nil && enc.Opaque {
+			return e.unmarshalV2(r, meta, nil, opaqueSigner, checksumIEEE)
+		}
+		if enc == nil || enc.Signer == nil {
+			return common.EntryUnsupportedFormat, 0, common.ErrEntryKeyRequired
+		}
+		return e.unmarshalV2(r, meta, nil, enc.Signer, checksumIEEE)
+
 	default:
 		return common.EntryUnsupportedFormat, 0, common.ErrEntryUnsupportedFormat
 	}
@@ -113,6 +299,173 @@ func (e *Entry) unmarshalV1(r io.Reader) (code common.ErrCode, n int, err error)
 	return
 }
 
+// [Length - uint32][Checksum - uint32/uint64][Flags - uint8][Metadata - bytes][Payload - bytes]
+// sealed payload is opened by sealer if any, trailing [MAC] is verified by signer if any. Opaque
+// sealer keeps payload sealed, opaque signer strips [MAC] without verifying it.
+func (e *Entry) unmarshalV2(r io.Reader, meta *Meta, sealer *Sealer, signer *Signer, cs checksum) (code common.ErrCode, n int, err error) {
+	var buffer [12]byte
+
+	// read length and checksum
+	n, err = io.ReadFull(r, buffer[:4+cs.size])
+	if errors.Is(err, io.EOF) {
+		code, err = common.EntryNoMore, nil
+		return
+	}
+	if err != nil {
+		code = common.EntryCorrupted
+		return
+	}
+
+	// check length
+	size := common.Endianese.Uint32(buffer[:])
+	if size == 0 {
+		code = common.EntryZeroSize
+		return
+	}
+	if size > common.MaxEntrySize+maxMetaSize+maxSealOverhead+macSize {
+		code = common.EntryTooBig
+		return
+	}
+
+	// read whole body: [Flags][Metadata][Payload]
+	data := e.alloc(int(size))
+
+	n_, err := io.ReadFull(r, data)
+	n += n_
+
+	if err != nil {
+		code = common.EntryCorrupted
+		return
+	}
+
+	// checksum
+	if cs.update(0, data) != cs.get(buffer[4:]) {
+		code, err = common.EntryCorrupted, common.ErrEntryInvalidCheckSum
+		return
+	}
+
+	if signer != nil {
+		if len(data) <= macSize {
+			code, err = common.EntryCorrupted, common.ErrEntryCorruptedMeta
+			return
+		}
+
+		// whole entry is read, reader could continue with the next one
+		if mac := data[len(data)-macSize:]; signer != opaqueSigner && !signer.verify(data[:len(data)-macSize], mac) {
+			code, err = common.EntryUnauthenticated, common.ErrEntryAuthentication
+			return
+		}
+		data = data[:len(data)-macSize]
+	}
+
+	// parse metadata
+	var chunk Chunk
+	flags, body := data[0], data[1:]
+	if flags&common.EntryFlagID != 0 {
+		idLen, sz := binary.Uvarint(body)
+		if sz <= 0 || idLen > uint64(len(body)-sz) {
+			code, err = common.EntryCorrupted, common.ErrEntryCorruptedMeta
+			return
+		}
+
+		if meta != nil {
+			meta.ID = append(meta.ID, body[sz:sz+int(idLen)]...)
+		}
+		body = body[sz+int(idLen):]
+	}
+	if flags&common.EntryFlagChunk != 0 {
+		total, sz1 := binary.Uvarint(body)
+		if sz1 <= 0 {
+			code, err = common.EntryCorrupted, common.ErrEntryCorruptedMeta
+			return
+		}
+		offset, sz2 := binary.Uvarint(body[sz1:])
+		if sz2 <= 0 || offset > total || total > math.MaxInt64 {
+			code, err = common.EntryCorrupted, common.ErrEntryCorruptedMeta
+			return
+		}
+
+		chunk = Chunk{Total: int64(total), Offset: int64(offset)}
+		body = body[sz1+sz2:]
+	}
+
+	var codecID uint8
+	if flags&common.EntryFlagCompressed != 0 {
+		if len(body) == 0 {
+			code, err = common.EntryCorrupted, common.ErrEntryCorruptedMeta
+			return
+		}
+		codecID, body = body[0], body[1:]
+	}
+	if flags&common.EntryFlagBatch != 0 {
+		count, sz := binary.Uvarint(body)
+		if sz <= 0 || count == 0 || count > common.MaxEntrySize {
+			code, err = common.EntryCorrupted, common.ErrEntryCorruptedMeta
+			return
+		}
+
+		if meta != nil {
+			meta.Batch = int(count)
+		}
+		body = body[sz:]
+	}
+
+	if sealer == opaqueSealer {
+		*e = data[:copy(data, body)]
+		code = common.NoError
+		return
+	}
+	if sealer != nil {
+		if body, err = sealer.open(body); err != nil {
+			code = common.EntryUndecryptable // key might be wrong, entry is not taken as corrupted
+			return
+		}
+	}
+
+	var payload []byte
+	if codecID != 0 {
+		codec := LookupCodec(codecID)
+		if codec == nil {
+			code, err = common.EntryCorrupted, common.ErrEntryUnknownCodec
+			return
+		}
+
+		// decompress after body, then move to the front if possible
+		var decoded []byte
+		if decoded, err = codec.Decode(data[len(data):], body, common.MaxEntrySize); err != nil {
+			code = common.EntryCorrupted
+			return
+		}
+
+		if len(decoded) <= cap(data) {
+			payload = append(data[:0], decoded...)
+		} else {
+			payload = decoded
+		}
+		if meta != nil {
+			meta.Codec = codecID
+		}
+	} else {
+		// payload is at the end of body, move it to the front to keep buffer reusable
+		payload = data[:copy(data, body)]
+	}
+
+	if chunk.Total > 0 {
+		if chunk.Offset+int64(len(payload)) > chunk.Total { // chunk must end within entry
+			code, err = common.EntryCorrupted, common.ErrEntryCorruptedMeta
+			return
+		}
+		if meta != nil {
+			meta.Chunk = chunk
+		}
+	}
+
+	*e = payload
+	code = common.NoError
+
+	return
+}
+
 // CloneFrom other entry.
 func (e *Entry) CloneFrom(other Entry) {
 	data := e.alloc(len(other))
@@ -131,6 +484,13 @@ func (e *Entry) alloc(expected int) (data []byte) {
 	return
 }
 
+// Record is an entry along with its position in queue and metadata.
+type Record struct {
+	Meta
+	Position uint64
+	Entry    Entry
+}
+
 // Batch of entries.
 type Batch struct {
 	entries []Entry
@@ -158,6 +518,19 @@ func (b *Batch) Len() int {
 	return len(b.entries)
 }
 
+// Entry returns i-th entry of Batch.
+func (b *Batch) Entry(i int) Entry {
+	return b.entries[i]
+}
+
+// Size is total size of entries inside Batch.
+func (b *Batch) Size() (size int) {
+	for _, e := range b.entries {
+		size += len(e)
+	}
+	return
+}
+
 // Append an entry.
 func (b *Batch) Append(e Entry) {
 	if len(e) > 0 {
@@ -167,9 +540,18 @@ func (b *Batch) Append(e Entry) {
 
 // Marshal into writer.
 func (b *Batch) Marshal(w io.Writer, format common.EntryFormat) (code common.ErrCode, err error) {
+	return b.MarshalEncoded(w, format, nil)
+}
+
+// MarshalEncoded writes entries into writer, their payloads are transformed by enc.
+func (b *Batch) MarshalEncoded(w io.Writer, format common.EntryFormat, enc *Encoding) (code common.ErrCode, err error) {
+	if format == common.EntryV7 { // entries share block header and checksum
+		return b.marshalCompact(w, enc == nil || !enc.NoChecksum)
+	}
+
 	if b.Len() > 0 {
 		for _, e := range b.entries {
-			if code, err = e.Marshal(w, format); err != nil {
+			if code, err = e.MarshalEncoded(w, format, Meta{}, enc); err != nil {
 				return code, err
 			}
 		}
@@ -177,6 +559,29 @@ func (b *Batch) Marshal(w io.Writer, format common.EntryFormat) (code common.Err
 	return
 }
 
+// AppendFrame appends entries packed as payload of batch frame to dst.
+func (b *Batch) AppendFrame(dst []byte) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	for _, e := range b.entries {
+		dst = append(dst, buf[:binary.PutUvarint(buf[:], uint64(len(e)))]...)
+		dst = append(dst, e...)
+	}
+	return dst
+}
+
+// Frame is payload of batch frame: [Length - uvarint][Entry - bytes]...
+type Frame []byte
+
+// Next entry of frame, returns it along with the remaining frame. Returned entry refers to frame.
+func (f Frame) Next() (Entry, Frame, error) {
+	size, n := binary.Uvarint(f)
+	if n <= 0 || size == 0 || size > uint64(len(f)-n) {
+		return nil, nil, common.ErrEntryCorruptedMeta
+	}
+	end := n + int(size)
+	return Entry(f[n:end]), f[end:], nil
+}
+
 // Reset batch.
 func (b *Batch) Reset() {
 	if b.Len() > 0 {
@@ -3,6 +3,7 @@ package entry
 import (
 	"bytes"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"testing"
 
@@ -209,7 +210,107 @@ func TestBatch(t *testing.T) {
 
 	b.Append([]byte{1, 2, 3})
 	require.Equal(t, 1, b.Len())
+	require.EqualValues(t, []byte{1, 2, 3}, b.Entry(0))
 
 	b.Reset()
 	require.Equal(t, 0, b.Len())
 }
+
+func TestEntryV2(t *testing.T) {
+	t.Run("Happy", func(t *testing.T) {
+		var buf bytes.Buffer
+
+		var e Entry = []byte{1, 2, 3, 4}
+		code, err := e.MarshalWithMeta(&buf, common.EntryV2, Meta{ID: []byte("id")})
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+
+		code, err = e.Marshal(&buf, common.EntryV2)
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+
+		var (
+			tmp  Entry
+			meta Meta
+		)
+		code, n, err := tmp.UnmarshalWithMeta(&buf, common.EntryV2, &meta)
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+		require.Equal(t, 16, n)
+		require.EqualValues(t, e, tmp)
+		require.EqualValues(t, "id", meta.ID)
+
+		code, n, err = tmp.UnmarshalWithMeta(&buf, common.EntryV2, &meta)
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+		require.Equal(t, 13, n)
+		require.EqualValues(t, e, tmp)
+		require.Empty(t, meta.ID)
+
+		code, _, err = tmp.Unmarshal(&buf, common.EntryV2)
+		require.NoError(t, err)
+		require.Equal(t, common.EntryNoMore, code)
+	})
+
+	t.Run("IDTooLong", func(t *testing.T) {
+		var e Entry = []byte{1}
+		code, err := e.MarshalWithMeta(&bytes.Buffer{}, common.EntryV2, Meta{ID: make([]byte, common.MaxEntryIDSize+1)})
+		require.Equal(t, common.ErrEntryIDTooLong, err)
+		require.Equal(t, common.EntryTooBig, code)
+	})
+
+	t.Run("Chunk", func(t *testing.T) {
+		var buf bytes.Buffer
+
+		var e Entry = []byte{1, 2, 3}
+		code, err := e.MarshalWithMeta(&buf, common.EntryV2, Meta{ID: []byte("id"), Chunk: Chunk{Total: 300, Offset: 297}})
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+
+		var (
+			tmp  Entry
+			meta Meta
+		)
+		code, _, err = tmp.UnmarshalWithMeta(&buf, common.EntryV2, &meta)
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+		require.EqualValues(t, e, tmp)
+		require.EqualValues(t, "id", meta.ID)
+		require.Equal(t, Chunk{Total: 300, Offset: 297}, meta.Chunk)
+		require.True(t, meta.Chunk.IsLast(len(tmp)))
+
+		// chunk exceeds total size
+		_, err = e.MarshalWithMeta(&buf, common.EntryV2, Meta{Chunk: Chunk{Total: 300, Offset: 298}})
+		require.NoError(t, err)
+
+		code, _, err = tmp.UnmarshalWithMeta(&buf, common.EntryV2, &meta)
+		require.Equal(t, common.ErrEntryCorruptedMeta, err)
+		require.Equal(t, common.EntryCorrupted, code)
+	})
+
+	t.Run("Corrupted", func(t *testing.T) {
+		var e Entry
+
+		// zero size
+		code, _, err := e.Unmarshal(bytes.NewBuffer([]byte{0, 0, 0, 0, 0, 0, 0, 0}), common.EntryV2)
+		require.NoError(t, err)
+		require.Equal(t, common.EntryZeroSize, code)
+
+		// invalid sum
+		code, _, err = e.Unmarshal(bytes.NewBuffer([]byte{0, 0, 0, 2, 1, 1, 1, 1, 0, 1}), common.EntryV2)
+		require.Equal(t, common.ErrEntryInvalidCheckSum, err)
+		require.Equal(t, common.EntryCorrupted, code)
+
+		// ID length is out of range
+		body := []byte{common.EntryFlagID, 5, 'i'}
+		var buf bytes.Buffer
+		var header [8]byte
+		common.Endianese.PutUint64(header[:], uint64(len(body))<<32|uint64(crc32.ChecksumIEEE(body)))
+		buf.Write(header[:])
+		buf.Write(body)
+
+		code, _, err = e.Unmarshal(&buf, common.EntryV2)
+		require.Equal(t, common.ErrEntryCorruptedMeta, err)
+		require.Equal(t, common.EntryCorrupted, code)
+	})
+}
@@ -19,10 +19,10 @@ func main() {
 	}()
 
 	// enqueue
-	if err = q.Enqueue([]byte{1, 2, 3, 4}); err != nil {
+	if _, err = q.Enqueue([]byte{1, 2, 3, 4}); err != nil {
 		log.Fatal(err)
 	}
-	if err = q.Enqueue([]byte{5, 6, 7, 8}); err != nil {
+	if _, err = q.Enqueue([]byte{5, 6, 7, 8}); err != nil {
 		log.Fatal(err)
 	}
 
@@ -0,0 +1,24 @@
+package pqueue
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"github.com/linxGnu/pqueue/vfs"
+)
+
+// fallocate allocates disk space of file up to size, file is extended with zeros. It's no-op
+// if filesystem does not support it, or file does not belong to operating system.
+func fallocate(f vfs.File, size int64) error {
+	osFile, ok := f.(*os.File)
+	if !ok {
+		return nil
+	}
+
+	err := syscall.Fallocate(int(osFile.Fd()), 0, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) {
+		return nil
+	}
+	return err
+}
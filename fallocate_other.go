@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package pqueue
+
+import "github.com/linxGnu/pqueue/vfs"
+
+// fallocate is not supported, space of segment is allocated while being written.
+func fallocate(vfs.File, int64) error {
+	return nil
+}
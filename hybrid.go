@@ -0,0 +1,245 @@
+package pqueue
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"os"
+
+	"github.com/linxGnu/pqueue/common"
+	"github.com/linxGnu/pqueue/entry"
+	segmentPkg "github.com/linxGnu/pqueue/segment"
+)
+
+// Flush spills entries buffered in memory into segment files, so that they survive crash.
+// Upcoming entries are buffered by a new segment. It's no-op unless QueueSettings.MemoryBuffer
+// is set.
+func (q *queue) Flush() (err error) {
+	if q.settings.MemoryBuffer == 0 {
+		return nil
+	}
+
+	q.rLock.Lock()
+	q.wLock.Lock()
+	if err = q.spill(true); err == nil {
+		var tail *segment
+		if tail, err = q.newSegment(); err == nil {
+			q.segments.PushBack(tail)
+		}
+	}
+	q.wLock.Unlock()
+	q.rLock.Unlock()
+	return
+}
+
+// pushTail appends new writable segment. Buffered segments which are full now are spilled,
+// failed ones are retried by the next rotation.
+func (q *queue) pushTail(seg *segment) {
+	q.segments.PushBack(seg)
+	if q.settings.MemoryBuffer > 0 {
+		_ = q.spill(false)
+	}
+}
+
+// spill replaces in-memory segments by segment files, keeping their order. If all, head and tail
+// segments are spilled too: caller must hold rLock, since reading state of head segment is
+// touched. Otherwise, they're left to concurrent reader and writers. Caller must hold wLock.
+func (q *queue) spill(all bool) error {
+	front, back := q.segments.Front(), q.segments.Back()
+	for node := front; node != nil; {
+		next := node.Next()
+		if seg := node.Value.(*segment); len(seg.path) == 0 && (all || node != front && node != back) {
+			if err := q.spillSegment(node, node == front); err != nil {
+				return err
+			}
+		}
+		node = next
+	}
+	return nil
+}
+
+// spillSegment writes pending entries of in-memory segment into segment files, which take its
+// place in the list. Entries of head segment which are consumed already are dropped. Nothing is
+// changed on failure.
+func (q *queue) spillSegment(node *list.Element, head bool) (err error) {
+	mem := node.Value.(*segment)
+
+	var consumed uint64
+	if head && mem.readable {
+		if consumed = q.offsetTracker.index; q.peek.Entry != nil {
+			consumed = q.peek.Position - mem.base
+		}
+	}
+
+	var (
+		spilled []*segment
+		out     *segment
+		points  = mem.points
+	)
+
+	// write entry of given index by fn, into a new segment file once the current one is full
+	write := func(index uint64, fn func(segmentPkg.Segment) (common.ErrCode, error)) error {
+		pos := mem.base + index
+		for attempt := 0; attempt < 2; attempt++ {
+			if out == nil {
+				seq := q.nextSeq
+				if len(spilled) == 0 {
+					seq = mem.seq
+				}
+
+				s, err := q.newFileSegment(seq, pos, q.settings.MemoryBuffer)
+				if err != nil {
+					return err
+				}
+				out, spilled = s, append(spilled, s)
+			}
+
+			offset := out.seg.Size()
+			code, err := fn(out.seg)
+			switch code {
+			case common.NoError:
+				q.spillTimePoint(out, &points, index, pos, offset)
+				return nil
+
+			case common.SegmentNoMoreWrite:
+				out.seg.Seal()
+				out = nil
+
+			default:
+				return err
+			}
+		}
+		return common.ErrQueueCorrupted
+	}
+
+	if _, err = mem.seg.Reading(nil); err == nil {
+		err = q.spillEntries(mem.seg, consumed, write)
+	}
+	if err != nil {
+		q.dropSpilled(spilled)
+		if head && mem.readable { // read cursor is restored
+			_ = mem.seg.SeekToRead(q.offsetTracker.offset)
+		}
+		return
+	}
+
+	// spilled segments are read from their files, as loaded ones
+	for _, seg := range spilled {
+		seg.seg.Seal()
+		_ = seg.seg.Close()
+		seg.seg = nil
+		q.segments.InsertBefore(seg, node)
+	}
+	q.segments.Remove(node)
+	_ = mem.seg.Close()
+
+	if head && mem.readable {
+		q.peek = entry.Record{}
+		q.offsetTracker.offset = 0
+		q.offsetTracker.index = 0
+		q.offsetTracker.skip = 0
+	}
+	return nil
+}
+
+// spillEntries reads entries of in-memory segment from the beginning, writes the ones following
+// the first skipped entries. Chunks of large entry are written as a whole.
+func (q *queue) spillEntries(seg segmentPkg.Segment, skip uint64,
+	write func(uint64, func(segmentPkg.Segment) (common.ErrCode, error)) error,
+) error {
+	var (
+		index  uint64 // of the next entry
+		meta   entry.Meta
+		chunks []entry.Entry // of large entry
+	)
+
+	for {
+		var (
+			e entry.Entry
+			m entry.Meta
+		)
+		if code, _, _ := seg.ReadEntryWithMeta(&e, &m); code != common.NoError {
+			return nil
+		}
+
+		if m.Chunk.Total == 0 {
+			if index >= skip {
+				if err := write(index, func(s segmentPkg.Segment) (common.ErrCode, error) {
+					return s.WriteEntryWithMeta(e, m)
+				}); err != nil {
+					return err
+				}
+			}
+			index++
+			continue
+		}
+
+		// large entry is kept as a whole by in-memory segment
+		if m.Chunk.Offset == 0 {
+			meta, chunks = m, chunks[:0]
+		}
+		chunks = append(chunks, e)
+		if !m.Chunk.IsLast(len(e)) {
+			continue
+		}
+
+		if index >= skip {
+			if err := write(index, func(s segmentPkg.Segment) (common.ErrCode, error) {
+				return s.WriteStream(newChunksReader(chunks), meta.Chunk.Total, q.settings.StreamChunkSize,
+					entry.Meta{ID: meta.ID})
+			}); err != nil {
+				return err
+			}
+		}
+		index++
+	}
+}
+
+// streamSupported returns true if segment files support large entries.
+func (q *queue) streamSupported() bool {
+	switch q.settings.EntryFormat {
+	case common.EntryV1, common.EntryV3, common.EntryV7:
+		return false
+	}
+	return q.settings.SegmentFormat != common.SegmentV3
+}
+
+// spillTimePoint copies time index point of the entry of given index inside in-memory segment, if
+// any, into time index of segment file. Points are consumed in order of entries.
+func (q *queue) spillTimePoint(out *segment, points *[]timePoint, index, pos uint64, offset int64) {
+	for len(*points) > 0 && (*points)[0].entry < index {
+		*points = (*points)[1:]
+	}
+	if len(*points) == 0 || (*points)[0].entry != index {
+		return
+	}
+
+	_ = appendTimePoint(q.settings.FS, timeIndexFilePath(out.path), timePoint{
+		ts:     (*points)[0].ts,
+		entry:  pos - out.base,
+		offset: segmentHeaderSize(q.settings.SegmentFormat) + offset,
+	})
+}
+
+// dropSpilled removes segment files of failed spilling. They're truncated first, so that file
+// which could not be removed does not duplicate entries kept in memory after reopening.
+func (q *queue) dropSpilled(spilled []*segment) {
+	paths := make([]string, 0, len(spilled))
+	for _, seg := range spilled {
+		_ = seg.seg.Close()
+		if f, err := q.settings.FS.OpenFile(seg.path, os.O_WRONLY|os.O_TRUNC, 0o600); err == nil {
+			_ = f.Close()
+		}
+		paths = append(paths, seg.path)
+	}
+	q.removeSegmentFiles(paths...)
+}
+
+// newChunksReader reads chunks of large entry one after another.
+func newChunksReader(chunks []entry.Entry) io.Reader {
+	readers := make([]io.Reader, len(chunks))
+	for i := range chunks {
+		readers[i] = bytes.NewReader(chunks[i])
+	}
+	return io.MultiReader(readers...)
+}
@@ -0,0 +1,304 @@
+package pqueue
+
+import (
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/linxGnu/pqueue/common"
+	"github.com/linxGnu/pqueue/vfs"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+const (
+	manifestFileName = "manifest"
+
+	// [Base - uint64][Name Length - uint16]
+	manifestRecordHeaderSize = 10
+
+	// manifestArchivedFlag marks Name Length of record whose segment is archived.
+	manifestArchivedFlag = 1 << 15
+)
+
+var errManifestCorrupted = fmt.Errorf("corrupted manifest file")
+
+// Manifest file layout:
+//
+// [Record][Record]...
+//
+// Record layout:
+//
+// [Base - uint64][Name Length - uint16][Name - bytes][Checksum - uint32]
+//
+// Note:
+// - records are in order of segments, from the oldest to the newest one
+// - `Base` is position of the first entry inside segment
+// - `Name` is file name of segment inside data directory
+// - the highest bit of `Name Length` is set if segment is archived, see QueueSettings.ArchiveDir
+// - `Checksum` is crc32_IEEE of preceding bytes of record
+// - record of empty `Name` goes first, it marks purging: segment files starting before its `Base`
+// are purged, they're removed on loading if left behind
+type manifestRecord struct {
+	name     string
+	base     uint64
+	archived bool
+}
+
+// manifest records ordered segments of data directory. It's rewritten as a whole (write-temp-then-rename)
+// whenever segments are created or removed.
+type manifest struct {
+	mu      sync.Mutex
+	fs      vfs.FS
+	path    string
+	records []manifestRecord
+	floor   uint64 // segment files starting before floor are purged
+}
+
+func newManifest(fs vfs.FS, path string) *manifest {
+	return &manifest{fs: fs, path: path}
+}
+
+// load records from file. Error is returned if file is missing or corrupted.
+func (m *manifest) load() error {
+	data, err := vfs.ReadFile(m.fs, m.path)
+	if err != nil {
+		return err
+	}
+
+	records := m.records[:0]
+	for len(data) > 0 {
+		rec, n, err := decodeManifestRecord(data)
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+
+		if len(rec.name) == 0 {
+			m.floor = rec.base
+			continue
+		}
+		records = append(records, rec)
+	}
+	m.records = records
+
+	return nil
+}
+
+// order files as recorded, base positions of legacy files are filled. Files which are not
+// recorded (i.e created right before crashing) follow the ones not starting after them, as add
+// does, or go last in order of sequence if they're legacy. Unrecorded files left behind by purging
+// are returned separately.
+func (m *manifest) order(files []file) (ordered, purged []file) {
+	index := make(map[string]int, len(m.records))
+	for i := range m.records {
+		index[m.records[i].name] = i
+	}
+
+	var recorded, unrecorded []file
+	for i := range files {
+		j, ok := index[filepath.Base(files[i].path)]
+		if !ok {
+			if m.floor > 0 && (!files[i].hasBase || files[i].base < m.floor) {
+				purged = append(purged, files[i])
+			} else {
+				unrecorded = append(unrecorded, files[i])
+			}
+			continue
+		}
+		if !files[i].hasBase {
+			files[i].base, files[i].hasBase = m.records[j].base, true
+		}
+		recorded = append(recorded, files[i])
+	}
+
+	sort.SliceStable(recorded, func(i, j int) bool {
+		return index[filepath.Base(recorded[i].path)] < index[filepath.Base(recorded[j].path)]
+	})
+
+	// unrecorded files are sorted by sequence already
+	ordered = recorded
+	var legacy []file
+	for _, f := range unrecorded {
+		if !f.hasBase {
+			legacy = append(legacy, f)
+			continue
+		}
+
+		i := sort.Search(len(ordered), func(i int) bool {
+			return ordered[i].base > f.base
+		})
+		ordered = append(ordered, file{})
+		copy(ordered[i+1:], ordered[i:])
+		ordered[i] = f
+	}
+	return append(ordered, legacy...), purged
+}
+
+// add segment and persist it. Segment follows the ones not starting after base, so that
+// segment spilled from memory (see QueueSettings.MemoryBuffer) precedes newer ones.
+func (m *manifest) add(path string, base uint64) error {
+	if m == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := sort.Search(len(m.records), func(i int) bool {
+		return m.records[i].base > base
+	})
+	m.records = append(m.records, manifestRecord{})
+	copy(m.records[i+1:], m.records[i:])
+	m.records[i] = manifestRecord{name: filepath.Base(path), base: base}
+	return m.write()
+}
+
+// remove segments and persist the rest.
+func (m *manifest) remove(paths ...string) error {
+	if m == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	removed := make(map[string]struct{}, len(paths))
+	for _, path := range paths {
+		removed[filepath.Base(path)] = struct{}{}
+	}
+
+	records := m.records[:0]
+	for _, rec := range m.records {
+		if _, ok := removed[rec.name]; !ok {
+			records = append(records, rec)
+		}
+	}
+	if len(records) == len(m.records) {
+		return nil
+	}
+	m.records = records
+
+	return m.write()
+}
+
+// purge segments: they're forgotten along with every segment file starting before floor, which
+// is persisted. Segment files are removed afterwards, so that they're not loaded again even if
+// removing fails.
+func (m *manifest) purge(floor uint64, paths ...string) error {
+	if m == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	purged := make(map[string]struct{}, len(paths))
+	for _, path := range paths {
+		purged[filepath.Base(path)] = struct{}{}
+	}
+
+	records := make([]manifestRecord, 0, len(m.records))
+	for _, rec := range m.records {
+		if _, ok := purged[rec.name]; !ok {
+			records = append(records, rec)
+		}
+	}
+
+	prevRecords, prevFloor := m.records, m.floor
+	m.records, m.floor = records, floor
+	if err := m.write(); err != nil {
+		m.records, m.floor = prevRecords, prevFloor
+		return err
+	}
+	return nil
+}
+
+// setArchived marks segment of given name as archived or not, and persists it.
+func (m *manifest) setArchived(name string, archived bool) error {
+	if m == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.records {
+		if m.records[i].name == name {
+			m.records[i].archived = archived
+			return m.write()
+		}
+	}
+	return nil
+}
+
+// write records to file: write-temp-then-rename.
+func (m *manifest) write() (err error) {
+	var buf []byte
+	if m.floor > 0 {
+		buf = encodeManifestRecord(buf, &manifestRecord{base: m.floor})
+	}
+	for i := range m.records {
+		buf = encodeManifestRecord(buf, &m.records[i])
+	}
+
+	tmp := m.path + ".tmp"
+	f, err := m.fs.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return
+	}
+
+	if _, err = f.Write(buf); err == nil {
+		err = f.Sync()
+	}
+	if err = multierror.Append(err, f.Close()).ErrorOrNil(); err == nil {
+		err = m.fs.Rename(tmp, m.path)
+	}
+	if err != nil {
+		_ = m.fs.Remove(tmp)
+		return
+	}
+	return m.fs.SyncDir(filepath.Dir(m.path)) // renaming is durable
+}
+
+func encodeManifestRecord(buf []byte, rec *manifestRecord) []byte {
+	start := len(buf)
+
+	var header [manifestRecordHeaderSize]byte
+	common.Endianese.PutUint64(header[:], rec.base)
+	nameLen := uint16(len(rec.name))
+	if rec.archived {
+		nameLen |= manifestArchivedFlag
+	}
+	common.Endianese.PutUint16(header[8:], nameLen)
+
+	buf = append(buf, header[:]...)
+	buf = append(buf, rec.name...)
+
+	var sum [4]byte
+	common.Endianese.PutUint32(sum[:], crc32.ChecksumIEEE(buf[start:]))
+	return append(buf, sum[:]...)
+}
+
+func decodeManifestRecord(data []byte) (rec manifestRecord, n int, err error) {
+	if len(data) < manifestRecordHeaderSize {
+		return rec, 0, errManifestCorrupted
+	}
+
+	nameLen := common.Endianese.Uint16(data[8:])
+	n = manifestRecordHeaderSize + int(nameLen&^manifestArchivedFlag) + 4
+	if len(data) < n ||
+		crc32.ChecksumIEEE(data[:n-4]) != common.Endianese.Uint32(data[n-4:]) {
+		return rec, 0, errManifestCorrupted
+	}
+
+	rec = manifestRecord{
+		base:     common.Endianese.Uint64(data),
+		name:     string(data[manifestRecordHeaderSize : n-4]),
+		archived: nameLen&manifestArchivedFlag != 0,
+	}
+	return
+}
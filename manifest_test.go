@@ -0,0 +1,179 @@
+package pqueue
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/linxGnu/pqueue/entry"
+	"github.com/linxGnu/pqueue/vfs"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifest(t *testing.T) {
+	dir := filepath.Join(tmpDir, "pqueue_manifest")
+	_ = os.RemoveAll(dir)
+	require.NoError(t, os.MkdirAll(dir, 0o777))
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	path := filepath.Join(dir, manifestFileName)
+
+	m := newManifest(vfs.OS, path)
+	require.Error(t, m.load())
+
+	require.NoError(t, m.add(filepath.Join(dir, "seg_5"), 0))
+	require.NoError(t, m.add(filepath.Join(dir, "seg_00000000000000000001_3"), 3))
+	require.NoError(t, m.add(filepath.Join(dir, "seg_00000000000000000002_6"), 6))
+	require.NoError(t, m.add(filepath.Join(dir, "seg_00000000000000000003_2"), 2)) // spilled from memory
+	require.NoError(t, m.remove(filepath.Join(dir, "seg_00000000000000000002_6")))
+	require.NoError(t, m.setArchived("seg_00000000000000000001_3", true))
+
+	m = newManifest(vfs.OS, path)
+	require.NoError(t, m.load())
+	require.Equal(t, []manifestRecord{
+		{name: "seg_5", base: 0},
+		{name: "seg_00000000000000000003_2", base: 2},
+		{name: "seg_00000000000000000001_3", base: 3, archived: true},
+	}, m.records)
+	require.NoError(t, m.setArchived("seg_00000000000000000001_3", false))
+	require.NoError(t, m.remove(filepath.Join(dir, "seg_00000000000000000003_2")))
+
+	// recorded ones keep their order, base of legacy file is filled. Unrecorded ones are placed
+	// by base
+	files := []file{
+		{path: filepath.Join(dir, "seg_00000000000000000001_3"), seq: 1, base: 3, hasBase: true},
+		{path: filepath.Join(dir, "seg_00000000000000000004_9"), seq: 4, base: 9, hasBase: true},
+		{path: filepath.Join(dir, "seg_5"), seq: 5},
+		{path: filepath.Join(dir, "seg_00000000000000000006_2"), seq: 6, base: 2, hasBase: true},
+	}
+	files, purged := m.order(files)
+	require.Empty(t, purged)
+	require.Equal(t, []file{
+		{path: filepath.Join(dir, "seg_5"), seq: 5, base: 0, hasBase: true},
+		{path: filepath.Join(dir, "seg_00000000000000000006_2"), seq: 6, base: 2, hasBase: true},
+		{path: filepath.Join(dir, "seg_00000000000000000001_3"), seq: 1, base: 3, hasBase: true},
+		{path: filepath.Join(dir, "seg_00000000000000000004_9"), seq: 4, base: 9, hasBase: true},
+	}, files)
+
+	// purged ones are forgotten, so are unrecorded files starting before floor
+	require.NoError(t, m.add(filepath.Join(dir, "seg_00000000000000000007_9"), 9))
+	require.NoError(t, m.purge(9, filepath.Join(dir, "seg_5"), filepath.Join(dir, "seg_00000000000000000001_3")))
+
+	m = newManifest(vfs.OS, path)
+	require.NoError(t, m.load())
+	require.EqualValues(t, 9, m.floor)
+	require.Equal(t, []manifestRecord{{name: "seg_00000000000000000007_9", base: 9}}, m.records)
+
+	files = []file{
+		{path: filepath.Join(dir, "seg_00000000000000000001_3"), seq: 1, base: 3, hasBase: true},
+		{path: filepath.Join(dir, "seg_5"), seq: 5},
+		{path: filepath.Join(dir, "seg_00000000000000000007_9"), seq: 7, base: 9, hasBase: true},
+		{path: filepath.Join(dir, "seg_00000000000000000008_9"), seq: 8, base: 9, hasBase: true},
+	}
+	files, purged = m.order(files)
+	require.Len(t, files, 2)
+	require.Len(t, purged, 2)
+	require.Equal(t, []string{"seg_00000000000000000007_9", "seg_00000000000000000008_9"},
+		[]string{filepath.Base(files[0].path), filepath.Base(files[1].path)})
+	require.Equal(t, []string{"seg_00000000000000000001_3", "seg_5"},
+		[]string{filepath.Base(purged[0].path), filepath.Base(purged[1].path)})
+
+	// renaming is followed by syncing directory
+	fs := &syncDirFS{FS: vfs.OS}
+	m = newManifest(fs, path)
+	require.NoError(t, m.load())
+	segPath := filepath.Join(dir, "seg_00000000000000000009_12")
+	require.NoError(t, m.add(segPath, 12))
+	require.Equal(t, []string{dir}, fs.synced)
+
+	require.NoError(t, os.WriteFile(segPath, []byte{0, 0, 0, 1}, 0o644))
+	_, err := markConsumed(fs, segPath, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{dir, dir}, fs.synced)
+
+	// corrupted
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data)-1]++
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+	require.Equal(t, errManifestCorrupted, newManifest(vfs.OS, path).load())
+}
+
+// syncDirFS records synced directories.
+type syncDirFS struct {
+	vfs.FS
+	synced []string
+}
+
+func (fs *syncDirFS) SyncDir(dir string) error {
+	fs.synced = append(fs.synced, dir)
+	return fs.FS.SyncDir(dir)
+}
+
+func TestQueueManifest(t *testing.T) {
+	dataDir := filepath.Join(tmpDir, "pqueue_queue_manifest")
+	_ = os.RemoveAll(dataDir)
+	require.NoError(t, os.MkdirAll(dataDir, 0o777))
+	defer func() {
+		_ = os.RemoveAll(dataDir)
+	}()
+
+	settings := QueueSettings{
+		DataDir:              dataDir,
+		MaxEntriesPerSegment: 2,
+	}
+
+	q, err := NewWithSettings(settings)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, enqueue(q, []byte{byte(i)}))
+	}
+
+	var e entry.Entry
+	require.True(t, q.Dequeue(&e))
+	require.True(t, q.Dequeue(&e))
+	require.True(t, q.Dequeue(&e)) // the first segment is removed
+	_ = q.Close()
+
+	m := newManifest(vfs.OS, filepath.Join(dataDir, manifestFileName))
+	require.NoError(t, m.load())
+	require.Len(t, m.records, 2)
+	require.EqualValues(t, 2, m.records[0].base)
+	require.EqualValues(t, 4, m.records[1].base)
+
+	files, err := loadFileInfos(vfs.OS, dataDir)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	for i := range files {
+		require.Equal(t, m.records[i].name, filepath.Base(files[i].path))
+	}
+
+	// timestamps do not matter
+	future := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(files[0].path, future, future))
+
+	check := func() {
+		q, err := NewWithSettings(settings)
+		require.NoError(t, err)
+		defer func() {
+			_ = q.Close()
+		}()
+
+		var r entry.Record
+		require.True(t, q.PeekRecord(&r))
+		require.EqualValues(t, 3, r.Position)
+		require.EqualValues(t, []byte{3}, r.Entry)
+	}
+	check()
+
+	// manifest is rebuilt if missing
+	require.NoError(t, os.Remove(filepath.Join(dataDir, manifestFileName)))
+	check()
+
+	m = newManifest(vfs.OS, filepath.Join(dataDir, manifestFileName))
+	require.NoError(t, m.load())
+	require.Len(t, m.records, 4) // along with tails of reopening
+}
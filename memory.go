@@ -0,0 +1,49 @@
+package pqueue
+
+import "container/list"
+
+// NewMemory creates non-durable queue, whose segments are kept in memory. It behaves as queue
+// created by New, but nothing is written to disk and entries are lost on closing.
+func NewMemory(maxEntriesPerSegment uint32) (Queue, error) {
+	return NewMemoryWithSettings(QueueSettings{
+		MaxEntriesPerSegment: maxEntriesPerSegment,
+	})
+}
+
+// NewMemoryWithSettings creates non-durable queue with custom settings. Segment limits, MaxSegmentAge,
+// TimeIndexInterval, deduplication and StreamChunkSize are applied as usual, remembered IDs are not
+// persisted.
+//
+// Settings of files and encoding (DataDir, formats, compression, keys, Preallocate, DirectIO,
+// MemoryBuffer and archiving) are ignored, entries are kept as they are. Consumed segments are released,
+// RetainConsumed is ignored too.
+func NewMemoryWithSettings(settings QueueSettings) (Queue, error) {
+	return loadMemory(settings)
+}
+
+func loadMemory(settings QueueSettings) (*queue, error) {
+	setDefaults(&settings)
+	settings.RetainConsumed = false
+	settings.MemoryBuffer = 0
+	settings.ArchiveDir = ""
+
+	q := &queue{
+		settings: settings,
+		segments: list.New(),
+		retained: list.New(),
+		memory:   true,
+	}
+
+	if settings.DedupMaxIDs > 0 || settings.DedupWindow > 0 {
+		q.dedup = newDedupIndex(nil, "", settings.DedupMaxIDs, settings.DedupWindow)
+	}
+
+	seg, err := q.newSegment()
+	if err != nil {
+		return nil, err
+	}
+	q.segments.PushBack(seg)
+
+	q.startBackground()
+	return q, nil
+}
@@ -0,0 +1,154 @@
+package pqueue
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/linxGnu/pqueue/common"
+	"github.com/linxGnu/pqueue/vfs"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// Offset tracker layout:
+//
+// [Magic - uint64][Offset - uint64][Index - uint64][Skip - uint64][Offset - uint64]...
+//
+// Note:
+// - `Offset` is byte offset of next entry (or batch frame containing it), `Index` is its index.
+// - `Skip` is number of consumed entries of batch frame at `Offset`.
+// - Only the last record is effective, records are appended on every commit.
+// - Legacy tracker has no `Magic` and only stores offsets: [Offset - uint64][Offset - uint64]...
+const (
+	offsetTrackerMagic uint64 = 0xff_70_71_6f_66_66_73_74 // never a valid legacy offset
+	offsetMagicSize           = 8
+	offsetRecordSize          = 24
+)
+
+type offsetRecord struct {
+	offset int64
+	index  uint64
+	skip   uint64
+	legacy bool // index is unknown
+}
+
+func putOffsetRecord(buf []byte, rec offsetRecord) {
+	common.Endianese.PutUint64(buf, uint64(rec.offset))
+	common.Endianese.PutUint64(buf[8:], rec.index)
+	common.Endianese.PutUint64(buf[16:], rec.skip)
+}
+
+func loadOffsetTracker(fs vfs.FS, path string) (rec offsetRecord, f vfs.File, err error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err = fs.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+		if err != nil {
+			return
+		}
+
+		if rec, err = readOffsetTracker(f); err == nil {
+			return
+		}
+
+		_ = f.Close()
+		_ = fs.Remove(path)
+	}
+	return
+}
+
+// readOffsetTracker reads the last record and prepares tracker for appending.
+func readOffsetTracker(f vfs.File) (rec offsetRecord, err error) {
+	info, err := f.Stat()
+	if err != nil {
+		return
+	}
+	size := info.Size()
+
+	var buf [offsetMagicSize + offsetRecordSize]byte
+	if size >= offsetMagicSize {
+		if _, err = f.ReadAt(buf[:offsetMagicSize], 0); err != nil {
+			return
+		}
+	}
+
+	var magic uint64
+	if size >= offsetMagicSize {
+		magic = common.Endianese.Uint64(buf[:])
+	}
+
+	switch {
+	case magic == offsetTrackerMagic:
+		records := (size - offsetMagicSize) / offsetRecordSize
+		if records > 0 {
+			if _, err = f.ReadAt(buf[:offsetRecordSize], offsetMagicSize+(records-1)*offsetRecordSize); err != nil {
+				return
+			}
+			rec.offset = int64(common.Endianese.Uint64(buf[:]))
+			rec.index = common.Endianese.Uint64(buf[8:])
+			rec.skip = common.Endianese.Uint64(buf[16:])
+		}
+
+		// drop torn record if any
+		if err = f.Truncate(offsetMagicSize + records*offsetRecordSize); err == nil {
+			_, err = f.Seek(0, io.SeekEnd)
+		}
+		return
+
+	case size >= 8: // legacy tracker
+		if _, err = f.ReadAt(buf[:8], size/8*8-8); err != nil {
+			return
+		}
+		rec.offset = int64(common.Endianese.Uint64(buf[:]))
+		rec.legacy = true
+	}
+
+	// (re)initialize tracker with current layout, keep known record
+	if err = f.Truncate(0); err == nil {
+		n := offsetMagicSize
+		common.Endianese.PutUint64(buf[:], offsetTrackerMagic)
+		if rec.offset > 0 && !rec.legacy {
+			putOffsetRecord(buf[n:], rec)
+			n += offsetRecordSize
+		}
+
+		if _, err = f.WriteAt(buf[:n], 0); err == nil {
+			_, err = f.Seek(0, io.SeekEnd)
+		}
+	}
+	return
+}
+
+// markConsumed stores end of segment file as its read offset. Tracker is replaced as a whole
+// (write-temp-then-rename), so that crash never leaves it empty or partial.
+func markConsumed(fs vfs.FS, segmentFilePath string, entries uint64) (info os.FileInfo, err error) {
+	if info, err = fs.Stat(segmentFilePath); err != nil {
+		return
+	}
+
+	path := offsetFilePath(segmentFilePath)
+	tmp := path + segTempFileSuffix
+	f, err := fs.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return
+	}
+
+	var buf [offsetMagicSize + offsetRecordSize]byte
+	common.Endianese.PutUint64(buf[:], offsetTrackerMagic)
+	putOffsetRecord(buf[offsetMagicSize:], offsetRecord{offset: info.Size(), index: entries})
+	if _, err = f.Write(buf[:]); err == nil {
+		err = f.Sync()
+	}
+	if err = multierror.Append(err, f.Close()).ErrorOrNil(); err == nil {
+		err = fs.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = fs.Remove(tmp)
+		return
+	}
+	err = fs.SyncDir(filepath.Dir(path)) // renaming is durable
+	return
+}
+
+func offsetFilePath(segmentFilePath string) string {
+	return segmentFilePath + segOffsetFileSuffix
+}
@@ -2,14 +2,28 @@ package pqueue
 
 import (
 	"io"
+	"time"
 
 	"github.com/linxGnu/pqueue/common"
 	"github.com/linxGnu/pqueue/entry"
+	"github.com/linxGnu/pqueue/vfs"
 )
 
 const (
 	// DefaultMaxEntriesPerSegment is default value for max entries per segment.
 	DefaultMaxEntriesPerSegment = 1000
+
+	// DefaultRetentionCheckInterval is default interval between retention cleanups.
+	DefaultRetentionCheckInterval = time.Minute
+
+	// DefaultStreamChunkSize is default size of chunks of large entries, see EnqueueReader.
+	DefaultStreamChunkSize = 1 << 20
+
+	// DefaultCompressionThreshold is default min size of entries to be compressed.
+	DefaultCompressionThreshold = 512
+
+	// DefaultArchiveCheckInterval is default interval between archiving of cold segments.
+	DefaultArchiveCheckInterval = time.Minute
 )
 
 // QueueSettings are settings for queue.
@@ -18,15 +32,181 @@ type QueueSettings struct {
 	SegmentFormat        common.SegmentFormat
 	EntryFormat          common.EntryFormat
 	MaxEntriesPerSegment uint32
+
+	// MaxBytesPerSegment is max size of segment file, which is enforced together with
+	// MaxEntriesPerSegment. Entries (or batch) which would exceed it are written to a new segment,
+	// unless the current one is empty. Zero means no limit.
+	//
+	// Size of entries is checked before encoding, so segment might exceed the limit slightly by
+	// framing overhead.
+	//
+	// If MaxBytesPerSegment is set, zero MaxEntriesPerSegment means no limit of entries.
+	//
+	// SegmentV3 files are preallocated with exactly MaxBytesPerSegment, or 64MB if it's zero.
+	// Entries larger than a whole segment are rejected.
+	MaxBytesPerSegment int64
+
+	// Preallocate allocates disk space of segment files up to MaxBytesPerSegment at creation
+	// (fallocate on Linux), so that they're not fragmented and full disk is discovered before
+	// writing entries. Unused space is truncated once segment is sealed. It's no-op if
+	// MaxBytesPerSegment is zero, except SegmentV3 files which are preallocated with their
+	// fixed size.
+	Preallocate bool
+
+	// DirectIO writes segment files bypassing page cache (O_DIRECT on Linux), so that enqueuing
+	// does not evict hot data of application and its latency is more predictable. Data is written
+	// as aligned blocks of 4KB: the last partial block is padded with zeros, then rewritten along
+	// with following entries. Padding is truncated once segment is sealed.
+	//
+	// Every write reaches disk before enqueuing returns (O_DSYNC), throughput is lower than
+	// buffered writes (see BenchmarkPQueueWritingDirectIO). It's not supported on other platforms
+	// nor file systems without direct I/O (common.ErrDirectIOUnsupported), and ignored by
+	// SegmentV3 whose files are memory-mapped.
+	DirectIO bool
+
+	// TimeIndexInterval enables time index of segments, so that SeekToTime locates entries
+	// without scanning. Enqueuing time is recorded at most once per interval, which is also
+	// precision of SeekToTime. Zero disables time index.
+	TimeIndexInterval time.Duration
+
+	// MaxSegmentAge is max age of writable segment. Once it's exceeded, the segment is sealed in
+	// background and upcoming entries are written to a new one, even if the segment is not full.
+	// Empty segment is not sealed, it's checked again after MaxSegmentAge. Zero means no limit.
+	MaxSegmentAge time.Duration
+
+	// RetainConsumed keeps fully consumed segments on disk instead of removing them,
+	// so that they could be replayed with SeekToPosition/SeekToTime.
+	RetainConsumed bool
+
+	// RetentionMaxAge is max age of retained segments, based on their last modification.
+	// Zero means no limit.
+	RetentionMaxAge time.Duration
+
+	// RetentionMaxBytes is max total size of retained segments, oldest ones are removed first.
+	// Zero means no limit.
+	RetentionMaxBytes int64
+
+	// RetentionCheckInterval is interval between retention cleanups in background.
+	RetentionCheckInterval time.Duration
+
+	// DedupMaxIDs is max number of recent IDs remembered by EnqueueWithID. Zero means no limit.
+	DedupMaxIDs int
+
+	// DedupWindow is max age of IDs remembered by EnqueueWithID. Zero means no limit.
+	//
+	// Deduplication is enabled if either DedupMaxIDs or DedupWindow is set. Remembered IDs are
+	// persisted in data directory. If they are missing or corrupted, they are rebuilt from
+	// segments written with EntryV2 format or its successors.
+	DedupWindow time.Duration
+
+	// StreamChunkSize is size of chunks which large entries are split into, see EnqueueReader.
+	StreamChunkSize int
+
+	// Codec compresses payload of entries, which are not smaller than CompressionThreshold.
+	// EntryV1 and EntryV7 formats do not support compression. Nil means no compression.
+	//
+	// Codec must be registered by entry.RegisterCodec for decompressing. Compress/flate codec
+	// is registered by default, see entry.NewFlateCodec.
+	Codec entry.Codec
+
+	// CompressionThreshold is min size of entries to be compressed.
+	CompressionThreshold int
+
+	// CompressBatch writes entries of EnqueueBatch as one frame compressed by Codec, which is
+	// better for many tiny entries. Codec is required.
+	CompressBatch bool
+
+	// KeyProvider supplies encryption keys for EntryV3 format, or authentication keys for EntryV4
+	// format. Segments record ID of their keys, so that keys could be rotated as long as old ones
+	// are still provided.
+	KeyProvider entry.KeyProvider
+
+	// AuthFailurePolicy decides what to do with entries failing authentication of EntryV4 format.
+	//
+	// With EntryV4 format, segment files of other entry formats are untrusted: they're taken as
+	// forged as a whole, and the policy applies to them. Pending segments must be drained before
+	// switching to EntryV4.
+	AuthFailurePolicy AuthFailurePolicy
+
+	// NoBlockChecksum writes blocks of EntryV7 format without checksum, which saves 4 bytes per
+	// block. Corruption is then detected only if framing of entries is broken.
+	NoBlockChecksum bool
+
+	// MemoryBuffer keeps up to given number of newest entries in memory, instead of writing them
+	// to segment files right away. Entries are spilled into segment files once buffer is full,
+	// on Flush and on Close, so that fast consumer dequeues them without touching disk. Order of
+	// entries is kept regardless. Zero disables buffering.
+	//
+	// Buffered entries are lost on crash unless they're flushed, so are they if Close fails to spill
+	// them. IDs of lost entries are forgotten by deduplication after reopening. Buffer being read
+	// by consumer is spilled only by Flush and Close, so that twice as many entries might be
+	// buffered.
+	//
+	// Entries consumed from buffer are released, RetainConsumed applies to segment files only.
+	// EntryV1, EntryV3, EntryV7 and SegmentV3 formats do not support buffering large entries, see
+	// EnqueueReader.
+	MemoryBuffer uint32
+
+	// ArchiveDir enables tiered storage: pending segments beyond ArchiveHotSegments are moved
+	// into ArchiveDir in background, compressed by ArchiveCodec if it's set. They're moved back
+	// into DataDir once consumer reaches them. Head and writable segments are never archived.
+	// Empty ArchiveDir disables archiving.
+	//
+	// ArchiveDir must not be shared with other queues. Queue having archived segments can not be
+	// opened without ArchiveDir (common.ErrArchiveDirRequired).
+	ArchiveDir string
+
+	// ArchiveHotSegments is number of pending segments, counted from head, which are kept in
+	// DataDir. Head segment is always kept.
+	ArchiveHotSegments int
+
+	// ArchiveCodec compresses archived segment files as a whole. It must be registered by
+	// entry.RegisterCodec. Nil means archived files are plain copies.
+	ArchiveCodec entry.Codec
+
+	// ArchiveCheckInterval is interval between archiving of cold segments in background.
+	ArchiveCheckInterval time.Duration
+
+	// FS is file system which DataDir is located on. Nil means file system of operating system,
+	// see vfs.OS. DirectIO and SegmentV3 require files of operating system.
+	FS vfs.FS
 }
 
+// AuthFailurePolicy is policy for entries failing authentication.
+type AuthFailurePolicy int
+
+const (
+	// AuthFailureError stops dequeuing at forged entry, Err returns common.ErrEntryAuthentication.
+	// Forged entry is not consumed, so dequeuing stops there again after reopening.
+	AuthFailureError AuthFailurePolicy = iota
+
+	// AuthFailureSkip skips forged entries, their positions are skipped too. Forged segment file is
+	// removed.
+	AuthFailureSkip
+
+	// AuthFailureQuarantine moves segment having forged entry into quarantine directory under
+	// DataDir for inspection. Dequeuing continues with the next segment.
+	AuthFailureQuarantine
+)
+
 // Queue interface.
 type Queue interface {
 	io.Closer
-	Enqueue(entry.Entry) error
-	EnqueueBatch(entry.Batch) error
+	Enqueue(entry.Entry) (uint64, error)
+	EnqueueWithID(string, entry.Entry) (uint64, error)
+	EnqueueBatch(entry.Batch) (uint64, error)
+	EnqueueReader(io.Reader, int64) (uint64, error)
 	Dequeue(*entry.Entry) bool
+	DequeueRecord(*entry.Record) bool
+	DequeueReader() (*Stream, bool)
 	Peek(*entry.Entry) bool
+	PeekRecord(*entry.Record) bool
+	Purge() error
+	DropHead(int) int
+	SeekToPosition(uint64) error
+	SeekToTime(time.Time) error
+	Flush() error
+	Err() error
 }
 
 // New queue from directory.
@@ -38,3 +218,8 @@ func New(dataDir string, maxEntriesPerSegment uint32) (Queue, error) {
 		EntryFormat:          common.EntryV1,
 	}, &segmentHeader{})
 }
+
+// NewWithSettings creates queue with custom settings.
+func NewWithSettings(settings QueueSettings) (Queue, error) {
+	return load(settings, &segmentHeader{})
+}
@@ -0,0 +1,46 @@
+package pqueue
+
+import (
+	"io"
+
+	"github.com/linxGnu/pqueue/common"
+	segmmap "github.com/linxGnu/pqueue/segment/mmap"
+	"github.com/linxGnu/pqueue/vfs"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// preallocatedFile is writable segment file, whose space is preallocated. Unused space is
+// truncated on closing, that's when segment is sealed.
+type preallocatedFile struct {
+	vfs.File
+}
+
+func (f preallocatedFile) Close() error {
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err == nil {
+		err = f.Truncate(offset)
+	}
+	return multierror.Append(err, f.File.Close()).ErrorOrNil()
+}
+
+// preallocateSize returns expected size of segment file, zero if preallocation is disabled.
+func (q *queue) preallocateSize() int64 {
+	if !q.settings.Preallocate {
+		return 0
+	}
+
+	switch q.settings.SegmentFormat {
+	case common.SegmentV3:
+		if q.settings.MaxBytesPerSegment > 0 {
+			return q.settings.MaxBytesPerSegment
+		}
+		return segmmap.DefaultSize
+
+	default:
+		if q.settings.MaxBytesPerSegment > 0 {
+			return segmentHeaderSize(q.settings.SegmentFormat) + q.settings.MaxBytesPerSegment
+		}
+		return 0
+	}
+}
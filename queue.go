@@ -1,28 +1,59 @@
 package pqueue
 
 import (
+	"bytes"
 	"container/list"
+	"errors"
 	"io"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/linxGnu/pqueue/common"
 	"github.com/linxGnu/pqueue/entry"
 	segmentPkg "github.com/linxGnu/pqueue/segment"
+	segmem "github.com/linxGnu/pqueue/segment/memory"
+	segmmap "github.com/linxGnu/pqueue/segment/mmap"
 	segv1 "github.com/linxGnu/pqueue/segment/v1"
+	"github.com/linxGnu/pqueue/vfs"
 
 	"github.com/hashicorp/go-multierror"
 )
 
 const (
 	segPrefix           = "seg_"
+	segBaseSeparator    = "_"
 	segOffsetFileSuffix = ".offset"
+
+	segTimeIndexFileSuffix = ".tindex"
+
+	// segTempFileSuffix names files being replaced, e.g offset tracker of consumed segment.
+	segTempFileSuffix = ".tmp"
+
+	quarantineDirName = "quarantine"
+
+	// lockFileName is locked while data directory is used by queue.
+	lockFileName = "lock"
 )
 
 type segment struct {
 	seg      segmentPkg.Segment
 	path     string
 	readable bool
+	base     uint64    // position of the first entry inside segment
+	created  time.Time // creation time of writable segment, for rotation
+
+	indexedAt time.Time   // enqueuing time of the last time index point of writable segment
+	points    []timePoint // time index of in-memory segment
+	seq       uint64      // sequence reserved for segment file which buffered segment is spilled into
+	archived  bool        // segment file is in ArchiveDir, see QueueSettings.ArchiveDir
+
+	// size and modTime of consumed segment, for retention. ModTime of in-memory segment is
+	// enqueuing time of its last entry.
+	size    int64
+	modTime time.Time
 }
 
 type queue struct {
@@ -30,15 +61,44 @@ type queue struct {
 	wLock         sync.RWMutex
 	segHeadWriter segmentHeadWriter
 	segments      *list.List
+	retained      *list.List // consumed segments, kept when settings.RetainConsumed
 	offsetTracker struct {
-		f      *os.File
+		f      vfs.File
 		offset int64
+		index  uint64 // index of next entry inside head segment
+		skip   uint64 // number of consumed entries of batch frame at offset
 	}
-	peek     entry.Entry
+	peek     entry.Record
+	err      error  // error which stops dequeuing, guarded by rLock
+	nextPos  uint64 // position of next enqueued entry
+	nextSeq  uint64 // sequence of next segment file
+	manifest *manifest
+	dedup    *dedupIndex
 	settings QueueSettings
+	memory   bool      // segments are kept in memory, see NewMemory
+	lock     io.Closer // lock of data directory, released on closing
+
+	closing chan struct{}
+	wg      sync.WaitGroup
 }
 
 func (q *queue) Close() (err error) {
+	// stop background routines
+	if q.closing != nil {
+		close(q.closing)
+		q.wg.Wait()
+		q.closing = nil
+	}
+
+	// buffered entries are kept on disk for reopening
+	if q.settings.MemoryBuffer > 0 {
+		q.rLock.Lock()
+		q.wLock.Lock()
+		err = q.spill(true)
+		q.wLock.Unlock()
+		q.rLock.Unlock()
+	}
+
 	for {
 		node := q.segments.Front()
 		if node == nil {
@@ -51,23 +111,69 @@ func (q *queue) Close() (err error) {
 		}
 	}
 	err = multierror.Append(err, q.closeOffsetTracker()).ErrorOrNil()
+	if q.dedup != nil {
+		err = multierror.Append(err, q.dedup.close()).ErrorOrNil()
+	}
+	if q.lock != nil {
+		err = multierror.Append(err, q.lock.Close()).ErrorOrNil()
+		q.lock = nil
+	}
 	return
 }
 
 func (q *queue) Peek(dst *entry.Entry) (hasEntry bool) {
 	q.rLock.Lock()
+	if hasEntry = q.loadPeek(); hasEntry {
+		dst.CloneFrom(q.peek.Entry)
+	}
+	q.rLock.Unlock()
+	return
+}
 
-	hasEntry = q.peek != nil || q.dequeue(&q.peek)
-	if hasEntry {
-		dst.CloneFrom(q.peek)
+// PeekRecord peeks an entry along with its position and metadata.
+func (q *queue) PeekRecord(dst *entry.Record) (hasEntry bool) {
+	q.rLock.Lock()
+	if hasEntry = q.loadPeek(); hasEntry {
+		dst.Entry.CloneFrom(q.peek.Entry)
+		dst.ID = append(dst.ID[:0], q.peek.ID...)
+		dst.Position = q.peek.Position
 	}
+	q.rLock.Unlock()
+	return
+}
 
+// Err returns the error which stops dequeuing, i.e *common.KeyNotFoundError if encryption key
+// of head segment is missing, common.ErrEntryDecryption if head entry could not be decrypted (key
+// is wrong), common.ErrEntryAuthentication if head entry is forged, or error of restoring archived
+// head segment. Dequeuing is resumed once the cause is solved, entries which could not be
+// decrypted or are forged are read again only after reopening.
+func (q *queue) Err() (err error) {
+	q.rLock.Lock()
+	err = q.err
 	q.rLock.Unlock()
 	return
 }
 
+func (q *queue) loadPeek() bool {
+	return q.peek.Entry != nil || q.dequeue(&q.peek)
+}
+
 func (q *queue) Dequeue(dst *entry.Entry) (hasEntry bool) {
 	q.rLock.Lock()
+
+	r := entry.Record{Entry: *dst}
+	if hasEntry = q.dequeue(&r); hasEntry {
+		*dst = r.Entry
+		q.commitOffset()
+	}
+
+	q.rLock.Unlock()
+	return
+}
+
+// DequeueRecord dequeues an entry along with its position and metadata.
+func (q *queue) DequeueRecord(dst *entry.Record) (hasEntry bool) {
+	q.rLock.Lock()
 	if hasEntry = q.dequeue(dst); hasEntry {
 		q.commitOffset()
 	}
@@ -75,65 +181,233 @@ func (q *queue) Dequeue(dst *entry.Entry) (hasEntry bool) {
 	return
 }
 
-func (q *queue) dequeue(dst *entry.Entry) bool {
-	if q.peek != nil {
+func (q *queue) dequeue(dst *entry.Record) bool {
+	return q.dequeueEntry(dst, true)
+}
+
+// dequeueEntry dequeues next entry. Payload of large entry is assembled into dst if assemble,
+// discarded otherwise.
+func (q *queue) dequeueEntry(dst *entry.Record, assemble bool) bool {
+	for {
+		front, ok := q.dequeueHead(dst)
+		if !ok {
+			return false
+		}
+
+		if dst.Chunk.Total == 0 || q.readChunks(front, dst, assemble) {
+			return true
+		}
+		if q.err != nil {
+			return false
+		}
+	}
+}
+
+// dequeueHead dequeues next entry. Only the first chunk of large entry is read, remaining
+// ones must be read by readChunk.
+func (q *queue) dequeueHead(dst *entry.Record) (*list.Element, bool) {
+	if q.peek.Entry != nil {
 		*dst = q.peek
-		q.peek = nil
-		return true
+		q.peek = entry.Record{}
+		return nil, true
 	}
 
 	for {
 		front := q.front()
 		if front == nil {
-			return false
+			return nil, false
 		}
 
 		head := front.Value.(*segment)
 		if !head.readable { // should open the file?
-			q.offsetTracker.f = nil
-			q.offsetTracker.offset = 0
-
-			format, file, err := q.openSegmentForRead(head.path)
-			if err == nil {
-				var n int
-				if n, err = q.startReadingSegment(format, head, file); err == nil {
-					q.offsetTracker.offset = 4 + int64(n)
-
-					var (
-						offset     int64
-						offsetFile *os.File
-					)
-					offset, offsetFile, err = loadOffsetTracker(offsetFilePath(head.path))
-					if err == nil {
-						q.offsetTracker.f = offsetFile
-						if offset > 0 && head.seg.SeekToRead(offset) == nil {
-							q.offsetTracker.offset = offset
-						}
+			if err := q.openHead(head); err != nil {
+				if err == common.ErrEntryAuthentication { // untrusted segment file
+					if q.authFailed(front, 0, err) {
+						continue
 					}
+					return nil, false
 				}
-			}
 
-			if err != nil {
-				if file != nil {
-					_ = file.Close()
+				if isKeyMissing(err) || head.archived && isRestoreTransient(err) {
+					// keep segment until its key is provided, or it's restored
+					q.err = err
+					return nil, false
 				}
-				if q.removeSegment(front) {
-					return false
+
+				if q.removeSegment(front, false) {
+					return nil, false
 				}
 				continue
 			}
+			q.err = nil
 
 			// now readable
 			head.readable = true
+		} else if q.err != nil { // stopped by forged or undecryptable entry
+			return nil, false
 		}
 
-		if n, hasElement, shouldCont := q.readEntryFromHead(head, front, dst); shouldCont {
+		n, hasElement, shouldCont := q.readEntryFromHead(head, front, dst)
+		if shouldCont {
 			continue
+		}
+
+		q.offsetTracker.offset += int64(n)
+		if hasElement && dst.Chunk.Offset > 0 {
+			continue // orphan chunk of broken large entry
+		}
+		if hasElement {
+			dst.Position = head.base + q.offsetTracker.index
+			q.offsetTracker.index++
+
+			// offset stays at batch frame until its last entry is read
+			if n == 0 {
+				q.offsetTracker.skip++
+			} else {
+				q.offsetTracker.skip = 0
+			}
+		}
+		return front, hasElement
+	}
+}
+
+// readChunks reads remaining chunks of large entry, whose first chunk is in dst.
+// False is returned if the entry is broken, its segment is dropped in this case.
+func (q *queue) readChunks(front *list.Element, dst *entry.Record, assemble bool) bool {
+	total, read := dst.Chunk.Total, int64(len(dst.Entry))
+	if assemble {
+		if int64(cap(dst.Entry)) >= total {
+			dst.Entry = dst.Entry[:total]
 		} else {
+			e := make(entry.Entry, total)
+			copy(e, dst.Entry)
+			dst.Entry = e
+		}
+	}
+
+	var chunk entry.Record
+	for read < total {
+		if q.readChunk(front, total, read, &chunk) != nil {
+			return false
+		}
+
+		if assemble {
+			copy(dst.Entry[read:], chunk.Entry)
+		}
+		read += int64(len(chunk.Entry))
+	}
+
+	if !assemble {
+		dst.Entry = dst.Entry[:0]
+	}
+	dst.Chunk = entry.Chunk{}
+	return true
+}
+
+// readChunk reads next chunk of large entry from head segment, the chunk must start at offset.
+// Head segment is dropped if the chunk is missing or broken.
+func (q *queue) readChunk(front *list.Element, total, offset int64, dst *entry.Record) error {
+	head := front.Value.(*segment)
+
+	code, n, err := head.seg.ReadEntryWithMeta(&dst.Entry, &dst.Meta)
+	if code == common.EntryUnauthenticated { // remaining chunks are orphans if skipped
+		_ = q.authFailed(front, n, err)
+		return err
+	}
+	if code == common.EntryUndecryptable {
+		q.err = err
+		return err
+	}
+
+	q.offsetTracker.offset += int64(n)
+	if code == common.NoError && dst.Chunk.Total == total && dst.Chunk.Offset == offset {
+		return nil
+	}
+
+	if err == nil {
+		err = common.ErrEntryIncomplete
+	}
+	_ = q.removeSegment(front, code == common.SegmentNoMoreReadStrong)
+	return err
+}
+
+// openHead opens head segment for reading, restores its read offset from tracker.
+func (q *queue) openHead(head *segment) error {
+	q.offsetTracker.f = nil
+	q.offsetTracker.offset = 0
+	q.offsetTracker.index = 0
+	q.offsetTracker.skip = 0
+
+	if len(head.path) == 0 { // in memory, nothing to restore
+		n, err := head.seg.Reading(nil)
+		q.offsetTracker.offset = int64(n)
+		return err
+	}
+
+	if head.archived {
+		if err := q.restoreSegment(head); err != nil {
+			return err
+		}
+	}
+
+	format, file, err := q.openSegmentForRead(head.path)
+	if err != nil {
+		return err
+	}
+
+	n, err := q.startReadingSegment(format, head, file)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	q.offsetTracker.offset = segmentHeaderSize(format) + int64(n)
+
+	rec, offsetFile, err := loadOffsetTracker(q.settings.FS, offsetFilePath(head.path))
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	q.offsetTracker.f = offsetFile
+
+	switch {
+	case rec.offset <= 0:
+
+	case rec.legacy:
+		// legacy tracker does not store index, count entries by reading them again
+		var e entry.Entry
+		for q.offsetTracker.offset < rec.offset {
+			code, n, _ := head.seg.ReadEntry(&e)
+			if code != common.NoError {
+				break
+			}
 			q.offsetTracker.offset += int64(n)
-			return hasElement
+			q.offsetTracker.index++
+		}
+		q.commitOffset()
+
+	default:
+		if head.seg.SeekToRead(rec.offset) != nil {
+			break
 		}
+		q.offsetTracker.offset = rec.offset
+
+		// consumed entries of batch frame are read again
+		var e entry.Entry
+		for q.offsetTracker.skip < rec.skip {
+			if code, n, _ := head.seg.ReadEntry(&e); code != common.NoError || n != 0 {
+				return common.ErrQueueCorrupted
+			}
+			q.offsetTracker.skip++
+		}
+		q.offsetTracker.index = rec.index
 	}
+
+	return nil
+}
+
+func isKeyMissing(err error) bool {
+	var keyErr *common.KeyNotFoundError
+	return errors.As(err, &keyErr)
 }
 
 func (q *queue) front() (fr *list.Element) {
@@ -143,8 +417,8 @@ func (q *queue) front() (fr *list.Element) {
 	return
 }
 
-func (q *queue) openSegmentForRead(path string) (format common.SegmentFormat, f *os.File, err error) {
-	f, err = os.Open(path)
+func (q *queue) openSegmentForRead(path string) (format common.SegmentFormat, f vfs.File, err error) {
+	f, err = vfs.Open(q.settings.FS, path)
 	if err == nil {
 		// read segment header
 		format, err = q.segHeadWriter.ReadHeader(f)
@@ -157,11 +431,33 @@ func (q *queue) openSegmentForRead(path string) (format common.SegmentFormat, f
 	return
 }
 
-func (q *queue) startReadingSegment(format common.SegmentFormat, s *segment, file *os.File) (n int, err error) {
+func (q *queue) startReadingSegment(format common.SegmentFormat, s *segment, file vfs.File) (n int, err error) {
 	switch format {
-	case common.SegmentV1:
+	case common.SegmentV1, common.SegmentV2: // entries of SegmentV2 are laid out as SegmentV1
+		if s.seg == nil {
+			newSegment := segv1.NewReadOnlySegmentWithKeys
+			if q.authenticated() {
+				newSegment = segv1.NewAuthenticatedSegment
+			}
+
+			var seg *segv1.Segment
+			if seg, n, err = newSegment(file, q.settings.KeyProvider); err == nil {
+				s.seg = seg
+			}
+		} else {
+			n, err = s.seg.Reading(file)
+		}
+
+	case common.SegmentV3:
 		if s.seg == nil {
-			s.seg, n, err = segv1.NewReadOnlySegment(file)
+			if q.authenticated() { // only EntryV1 is supported
+				return 0, common.ErrEntryAuthentication
+			}
+
+			var seg *segmmap.Segment
+			if seg, n, err = segmmap.NewReadOnlySegment(file); err == nil {
+				s.seg = seg
+			}
 		} else {
 			n, err = s.seg.Reading(file)
 		}
@@ -172,9 +468,22 @@ func (q *queue) startReadingSegment(format common.SegmentFormat, s *segment, fil
 	return
 }
 
-func (q *queue) readEntryFromHead(head *segment, front *list.Element, dst *entry.Entry) (n int, hasElement, shouldContinue bool) {
+// authenticated returns true if entries are authenticated (EntryV4). Segment files of other entry
+// formats are untrusted then, they are forged as a whole.
+func (q *queue) authenticated() bool {
+	return q.settings.EntryFormat == common.EntryV4
+}
+
+func (q *queue) readEntryFromHead(head *segment, front *list.Element, dst *entry.Record) (n int, hasElement, shouldContinue bool) {
 	// now read
-	code, n, _ := head.seg.ReadEntry(dst)
+	buf := dst.Entry
+	code, n, err := head.seg.ReadEntryWithMeta(&dst.Entry, &dst.Meta)
+
+	// entries of memory-mapped segment are views, they are copied before segment is unmapped
+	if _, mapped := head.seg.(*segmmap.Segment); mapped && code == common.NoError {
+		dst.Entry = append(buf[:0], dst.Entry...)
+	}
+
 	switch code {
 	case common.NoError:
 		hasElement = true
@@ -183,12 +492,24 @@ func (q *queue) readEntryFromHead(head *segment, front *list.Element, dst *entry
 	case common.SegmentNoMoreReadWeak:
 		return
 
+	case common.EntryUndecryptable:
+		// segment is kept, offset tracker stays at the entry so that it is read again after reopening
+		q.err, n = err, 0
+		return
+
+	case common.EntryUnauthenticated:
+		if shouldContinue = q.authFailed(front, n, err); shouldContinue {
+			q.offsetTracker.index++ // position of forged entry is skipped
+			q.offsetTracker.skip = 0
+		}
+		return
+
 	default:
 		// TODO: write log here
 		// if code != common.SegmentNoMoreReadStrong {
 		// }
 
-		if q.removeSegment(front) {
+		if q.removeSegment(front, code == common.SegmentNoMoreReadStrong) {
 			return // no need to continue
 		}
 
@@ -197,7 +518,65 @@ func (q *queue) readEntryFromHead(head *segment, front *list.Element, dst *entry
 	}
 }
 
-func (q *queue) removeSegment(e *list.Element) bool {
+// authFailed applies AuthFailurePolicy on forged entry of n bytes, which is read from head segment.
+// Head segment is forged as a whole if it could not be opened, i.e it's of untrusted entry format.
+// False is returned if dequeuing is stopped.
+func (q *queue) authFailed(front *list.Element, n int, err error) bool {
+	switch q.settings.AuthFailurePolicy {
+	case AuthFailureSkip:
+		if !front.Value.(*segment).readable {
+			return !q.removeSegment(front, false)
+		}
+		q.offsetTracker.offset += int64(n)
+		return true
+
+	case AuthFailureQuarantine:
+		if err = q.quarantineSegment(front); err == nil {
+			return true
+		}
+	}
+
+	// offset tracker stays at forged entry, so that it is read again after reopening
+	q.err = err
+	return false
+}
+
+// quarantineSegment moves segment and its offset tracker into quarantine directory. Tail is
+// replaced by new segment first.
+func (q *queue) quarantineSegment(e *list.Element) error {
+	dir := filepath.Join(q.settings.DataDir, quarantineDirName)
+	if err := q.settings.FS.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	q.wLock.Lock()
+	if e == q.segments.Back() {
+		seg, err := q.newSegment()
+		if err != nil {
+			q.wLock.Unlock()
+			return err
+		}
+		q.segments.PushBack(seg)
+	}
+	seg := q.segments.Remove(e).(*segment)
+	q.wLock.Unlock()
+
+	if seg.seg != nil {
+		_ = seg.seg.Close()
+	}
+	_ = q.closeOffsetTracker()
+	q.offsetTracker.f = nil
+
+	fs := q.settings.FS
+	_ = fs.Rename(offsetFilePath(seg.path), offsetFilePath(filepath.Join(dir, filepath.Base(seg.path))))
+	_ = fs.Rename(timeIndexFilePath(seg.path), timeIndexFilePath(filepath.Join(dir, filepath.Base(seg.path))))
+	if err := fs.Rename(seg.path, filepath.Join(dir, filepath.Base(seg.path))); err != nil {
+		return err
+	}
+	return q.manifest.remove(seg.path)
+}
+
+func (q *queue) removeSegment(e *list.Element, consumed bool) bool {
 	q.wLock.RLock()
 
 	// do not remove back/tail of segment list
@@ -207,6 +586,7 @@ func (q *queue) removeSegment(e *list.Element) bool {
 	}
 
 	// remove from list
+	next := e.Next().Value.(*segment)
 	val := q.segments.Remove(e)
 
 	q.wLock.RUnlock()
@@ -218,19 +598,469 @@ func (q *queue) removeSegment(e *list.Element) bool {
 		_ = seg.seg.Close()
 	}
 
-	// remove underlying file
-	if len(seg.path) > 0 {
-		_ = os.Remove(seg.path)
-		q.closeAndRemoveOffsetTracker(offsetFilePath(seg.path))
-	}
+	_ = q.closeOffsetTracker()
+	q.dropSegment(seg, consumed, next.base-seg.base)
 
 	return false
 }
 
+// dropSegment keeps consumed segment for replaying if configured. Otherwise, its underlying
+// files are removed.
+func (q *queue) dropSegment(seg *segment, consumed bool, entries uint64) {
+	if len(seg.path) == 0 {
+		return
+	}
+
+	// retained segments are kept in DataDir
+	if consumed && q.settings.RetainConsumed && (!seg.archived || q.restoreSegment(seg) == nil) {
+		retained := &segment{path: seg.path, base: seg.base}
+		if info, err := markConsumed(q.settings.FS, seg.path, entries); err == nil {
+			retained.size, retained.modTime = info.Size(), info.ModTime()
+		}
+		q.retained.PushBack(retained)
+	} else {
+		q.removeSegmentFiles(seg.path)
+	}
+}
+
+// removeSegmentFiles removes segment files along with their offset trackers and manifest records.
+// Segment file which could not be removed keeps them, so that its consumed entries are not read
+// again after reopening.
+func (q *queue) removeSegmentFiles(paths ...string) {
+	removed := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if err := q.settings.FS.Remove(path); err != nil && !os.IsNotExist(err) {
+			continue
+		}
+		_ = q.settings.FS.Remove(offsetFilePath(path))
+		_ = q.settings.FS.Remove(timeIndexFilePath(path))
+		removed = append(removed, path)
+	}
+	_ = q.manifest.remove(removed...)
+}
+
+// Purge drops every pending entry. All segments and their offset trackers are removed,
+// a fresh segment takes place as writable tail.
+//
+// Purging is persisted before segment files are removed, error of removing them is returned
+// but entries are purged anyway: files left behind are removed on reopening.
+func (q *queue) Purge() (err error) {
+	q.rLock.Lock()
+	q.wLock.Lock()
+	err = q.purge()
+	q.wLock.Unlock()
+	q.rLock.Unlock()
+	return
+}
+
+func (q *queue) purge() error {
+	tail, err := q.newSegment()
+	if err != nil {
+		return err
+	}
+
+	var paths []string
+	for node := q.segments.Front(); node != nil; node = node.Next() {
+		if seg := node.Value.(*segment); len(seg.path) > 0 {
+			paths = append(paths, seg.path)
+		}
+	}
+	if q.retained != nil {
+		for node := q.retained.Front(); node != nil; node = node.Next() {
+			paths = append(paths, node.Value.(*segment).path)
+		}
+	}
+
+	// purging is persisted first, segments are not loaded again even if removing them fails
+	if err = q.manifest.purge(tail.base, paths...); err != nil {
+		_ = tail.seg.Close()
+		if len(tail.path) > 0 {
+			q.removeSegmentFiles(tail.path)
+		}
+		return err
+	}
+
+	_ = q.closeOffsetTracker()
+	q.offsetTracker.f = nil
+	q.offsetTracker.offset = 0
+	q.offsetTracker.index = 0
+	q.offsetTracker.skip = 0
+	q.peek.Entry = nil
+
+	for {
+		node := q.segments.Front()
+		if node == nil {
+			break
+		}
+
+		seg := q.segments.Remove(node).(*segment)
+		if seg.seg != nil {
+			_ = seg.seg.Close()
+		}
+	}
+	if q.retained != nil {
+		q.retained.Init()
+	}
+	q.segments.PushBack(tail)
+
+	fs := q.settings.FS
+	for _, path := range paths {
+		if e := fs.Remove(path); e != nil && !os.IsNotExist(e) {
+			err = multierror.Append(err, e).ErrorOrNil()
+			continue
+		}
+		_ = fs.Remove(offsetFilePath(path))
+		_ = fs.Remove(timeIndexFilePath(path))
+	}
+
+	// IDs of purged entries are forgotten, they're purged on reopening if compacting fails
+	if q.dedup != nil {
+		q.dedup.reset()
+		if len(q.dedup.path) > 0 {
+			if e := q.dedup.compact(); e != nil {
+				err = multierror.Append(err, e).ErrorOrNil()
+			}
+		}
+	}
+	return err
+}
+
+// DropHead skips (at most) first n entries of the queue, returns number of dropped entries.
+func (q *queue) DropHead(n int) (dropped int) {
+	if n > 0 {
+		q.rLock.Lock()
+		dropped = int(q.skip(uint64(n)))
+		q.rLock.Unlock()
+	}
+	return
+}
+
+// SeekToPosition moves read cursor to the entry at position pos. Entries after the cursor
+// would be dequeued again.
+//
+// ErrSeekOutOfRange is returned if pos is not in range of retained (or pending if retention
+// is disabled) entries. The cursor is at the nearest end of queue in this case.
+func (q *queue) SeekToPosition(pos uint64) (err error) {
+	q.rLock.Lock()
+
+	q.wLock.Lock()
+	q.rewind()
+
+	// find the segment containing pos, the ones before are consumed
+	front := q.segments.Front()
+	for front != nil && front != q.segments.Back() {
+		next := front.Next()
+		if next.Value.(*segment).base > pos {
+			break
+		}
+
+		seg := q.segments.Remove(front).(*segment)
+		q.dropSegment(seg, true, next.Value.(*segment).base-seg.base)
+		front = next
+	}
+	q.wLock.Unlock()
+
+	if front == nil || pos < front.Value.(*segment).base {
+		err = common.ErrSeekOutOfRange
+	} else {
+		n := pos - front.Value.(*segment).base
+		if n -= q.seekByIndex(front, n); q.skip(n) < n {
+			err = common.ErrSeekOutOfRange
+		}
+	}
+
+	q.rLock.Unlock()
+	return
+}
+
+// seekByIndex moves read cursor of head segment forward, to the nearest index point at or before
+// its n-th entry. Footer of sealed SegmentV2 is required. Returns number of passed entries.
+func (q *queue) seekByIndex(front *list.Element, n uint64) uint64 {
+	head := front.Value.(*segment)
+	if head.readable || len(head.path) == 0 {
+		return 0
+	}
+
+	footer, err := q.readFooter(head.path)
+	if err != nil {
+		return 0
+	}
+
+	point, ok := footer.Seek(n)
+	if !ok || !q.seekHead(head, point.Entry, segmentHeaderV2Size+point.Offset) {
+		return 0
+	}
+	return point.Entry
+}
+
+// seekHead opens head segment and moves its read cursor to the entry of given index, which
+// is at offset. False is returned if head could not be opened, it's left to dequeuing.
+func (q *queue) seekHead(head *segment, index uint64, offset int64) bool {
+	if q.openHead(head) != nil {
+		return false
+	}
+	q.err = nil
+	head.readable = true
+
+	if head.seg.SeekToRead(offset) != nil {
+		return false
+	}
+	q.offsetTracker.offset = offset
+	q.offsetTracker.index = index
+	q.commitOffset()
+
+	return true
+}
+
+// readFooter reads footer of sealed SegmentV2.
+func (q *queue) readFooter(path string) (*segv1.Footer, error) {
+	format, f, err := q.openSegmentForRead(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	if format != common.SegmentV2 {
+		return nil, common.ErrSegmentFooterMissing
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return segv1.ReadFooter(f, info.Size(), segmentHeaderV2Size)
+}
+
+// SeekToTime moves read cursor to the first segment which might contain entries
+// enqueued at or after t. Earlier segments are considered as consumed.
+//
+// Segment is located by binary searching last modification of segments. If TimeIndexInterval
+// is set, time index of segments is taken instead and read cursor is moved further inside the
+// segment. Entries enqueued within the interval before t might be dequeued too.
+func (q *queue) SeekToTime(t time.Time) (err error) {
+	q.rLock.Lock()
+
+	q.wLock.Lock()
+	q.rewind()
+	var segs []*segment
+	for node := q.segments.Front(); node != nil; node = node.Next() {
+		segs = append(segs, node.Value.(*segment))
+	}
+	q.wLock.Unlock()
+
+	// the first segment which might contain entries enqueued at or after t, earlier ones are consumed
+	found := sort.Search(len(segs), func(i int) bool {
+		return q.enqueuedSince(segs[i], t)
+	})
+
+	for i := 0; i < found; i++ {
+		front := q.front()
+		if front == nil {
+			break
+		}
+
+		consumed := false
+		if path := front.Value.(*segment).path; len(path) > 0 {
+			_, e := q.settings.FS.Stat(path)
+			consumed = e == nil
+		}
+		if q.removeSegment(front, consumed) {
+			break // tail reached
+		}
+	}
+
+	if front := q.front(); front != nil && q.settings.TimeIndexInterval > 0 {
+		head := front.Value.(*segment)
+		if points, e := q.timeIndex(head); e == nil {
+			if point, ok := seekTimePoint(points, t, q.settings.TimeIndexInterval); ok && point.entry > 0 {
+				_ = q.seekHead(head, point.entry, point.offset)
+			}
+		}
+	}
+
+	q.rLock.Unlock()
+	return
+}
+
+// enqueuedSince returns true if segment might contain entries enqueued at or after t, judging
+// by its time index, or its last modification if time index is not available.
+func (q *queue) enqueuedSince(seg *segment, t time.Time) bool {
+	if interval := q.settings.TimeIndexInterval; interval > 0 {
+		if points, err := q.timeIndex(seg); err == nil && len(points) > 0 {
+			// entries following the last point are enqueued within interval after it
+			return points[len(points)-1].ts+int64(interval) > t.UnixNano()
+		}
+	}
+
+	if len(seg.path) == 0 {
+		q.wLock.RLock()
+		modTime := seg.modTime
+		q.wLock.RUnlock()
+		return !modTime.Before(t)
+	}
+
+	info, err := q.settings.FS.Stat(seg.path)
+	return err == nil && !info.ModTime().Before(t)
+}
+
+// timeIndex loads time index of segment, or takes the one kept along with in-memory segment.
+func (q *queue) timeIndex(seg *segment) (points []timePoint, err error) {
+	if len(seg.path) == 0 {
+		q.wLock.RLock()
+		points = seg.points
+		q.wLock.RUnlock()
+		return
+	}
+	return loadTimeIndex(q.settings.FS, timeIndexFilePath(seg.path))
+}
+
+// rewind moves read cursor to the beginning of retained segments. Offset trackers
+// of passed segments are removed, so that they would be read again from beginning.
+func (q *queue) rewind() {
+	q.peek.Entry = nil
+	_ = q.closeOffsetTracker()
+	q.offsetTracker.f = nil
+	q.offsetTracker.offset = 0
+	q.offsetTracker.index = 0
+	q.offsetTracker.skip = 0
+
+	// retained segments take place in front of pending ones
+	if q.retained != nil {
+		for {
+			node := q.retained.Back()
+			if node == nil {
+				break
+			}
+			q.segments.PushFront(q.retained.Remove(node))
+		}
+	}
+
+	back := q.segments.Back()
+	for node := q.segments.Front(); node != nil; node = node.Next() {
+		seg := node.Value.(*segment)
+		if seg.readable {
+			// tail is still being written, its reader is reset on next reading. So is reader
+			// of in-memory segment, which could not be reopened
+			if node != back && len(seg.path) > 0 {
+				_ = seg.seg.Close()
+				seg.seg = nil
+			}
+			seg.readable = false
+		}
+
+		if len(seg.path) > 0 {
+			_ = q.settings.FS.Remove(offsetFilePath(seg.path))
+		}
+	}
+}
+
+func (q *queue) runRetention(interval time.Duration) {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.closing:
+			return
+
+		case now := <-ticker.C:
+			q.rLock.Lock()
+			q.applyRetention(now)
+			q.rLock.Unlock()
+		}
+	}
+}
+
+func (q *queue) runRotation(maxAge time.Duration) {
+	defer q.wg.Done()
+
+	timer := time.NewTimer(maxAge)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-q.closing:
+			return
+
+		case now := <-timer.C:
+			q.wLock.Lock()
+			next := q.rotate(now, maxAge)
+			q.wLock.Unlock()
+			timer.Reset(next)
+		}
+	}
+}
+
+// rotate seals tail segment if it's older than maxAge, returns duration until the next check.
+// New segment is created by the next write, so that idle queue does not pile up empty ones.
+func (q *queue) rotate(now time.Time, maxAge time.Duration) time.Duration {
+	back := q.segments.Back()
+	if back == nil {
+		return maxAge
+	}
+
+	tail := back.Value.(*segment)
+	if age := now.Sub(tail.created); age < maxAge {
+		return maxAge - age
+	}
+
+	tail.seg.Seal()
+	return maxAge
+}
+
+// applyRetention removes retained segments which are older than RetentionMaxAge or
+// exceed RetentionMaxBytes in total. Only consumed segments are touched, the ones
+// being read are always in pending list.
+func (q *queue) applyRetention(now time.Time) {
+	var total int64
+	for node := q.retained.Front(); node != nil; node = node.Next() {
+		total += node.Value.(*segment).size
+	}
+
+	maxAge, maxBytes := q.settings.RetentionMaxAge, q.settings.RetentionMaxBytes
+	for {
+		node := q.retained.Front()
+		if node == nil {
+			return
+		}
+
+		seg := node.Value.(*segment)
+		if (maxAge <= 0 || now.Sub(seg.modTime) <= maxAge) &&
+			(maxBytes <= 0 || total <= maxBytes) {
+			return
+		}
+
+		q.retained.Remove(node)
+		total -= seg.size
+
+		q.removeSegmentFiles(seg.path)
+	}
+}
+
+// skip (at most) n entries, returns number of skipped entries.
+func (q *queue) skip(n uint64) (skipped uint64) {
+	var r entry.Record
+	for skipped < n && q.dequeueEntry(&r, false) {
+		skipped++
+	}
+	if skipped > 0 {
+		q.commitOffset()
+	}
+	return
+}
+
 func (q *queue) commitOffset() {
 	if q.offsetTracker.f != nil {
-		var buf [8]byte
-		common.Endianese.PutUint64(buf[:], uint64(q.offsetTracker.offset))
+		var buf [offsetRecordSize]byte
+		putOffsetRecord(buf[:], offsetRecord{
+			offset: q.offsetTracker.offset,
+			index:  q.offsetTracker.index,
+			skip:   q.offsetTracker.skip,
+		})
 		_, _ = q.offsetTracker.f.Write(buf[:])
 	}
 }
@@ -242,146 +1072,375 @@ func (q *queue) closeOffsetTracker() (err error) {
 	return
 }
 
-func (q *queue) closeAndRemoveOffsetTracker(path string) {
-	_ = q.closeOffsetTracker()
-	_ = os.Remove(path)
+// Enqueue an entry, returns its position. Empty entry is not stored.
+func (q *queue) Enqueue(e entry.Entry) (pos uint64, err error) {
+	q.wLock.Lock()
+	pos, err = q.enqueue(e, entry.Meta{})
+	q.wLock.Unlock()
+	return
 }
 
-func (q *queue) Enqueue(e entry.Entry) error {
+// EnqueueWithID enqueues an entry identified by id. If id was seen recently (within deduplication
+// window), the entry is skipped and the original position is returned.
+func (q *queue) EnqueueWithID(id string, e entry.Entry) (pos uint64, err error) {
+	if q.dedup == nil {
+		return 0, common.ErrDedupDisabled
+	}
+	if len(id) > common.MaxEntryIDSize {
+		return 0, common.ErrEntryIDTooLong
+	}
+
 	q.wLock.Lock()
-	err := q.enqueue(e)
+
+	now := time.Now()
+	if p, ok := q.dedup.lookup(id, now); ok {
+		pos = p
+	} else if pos, err = q.enqueue(e, entry.Meta{ID: []byte(id)}); err == nil && len(e) > 0 {
+		// entry is already durable, losing its ID only weakens deduplication after restarting
+		_ = q.dedup.add(id, pos, now)
+	}
+
 	q.wLock.Unlock()
-	return err
+	return
 }
 
-func (q *queue) enqueue(e entry.Entry) error {
+func (q *queue) enqueue(e entry.Entry, meta entry.Meta) (uint64, error) {
 	for attempt := 0; attempt < 2; attempt++ {
 		back := q.segments.Back()
 		if back == nil {
-			return common.ErrQueueCorrupted
+			return 0, common.ErrQueueCorrupted
 		}
 
 		tail := back.Value.(*segment)
+		offset := tail.seg.Size()
 
-		code, err := tail.seg.WriteEntry(e)
+		code, err := tail.seg.WriteEntryWithMeta(e, meta)
 		switch code {
-		case common.NoError, common.EntryTooBig:
-			return err
+		case common.NoError:
+			pos := q.nextPos
+			if len(e) > 0 {
+				q.indexTime(tail, pos, offset)
+				q.nextPos++
+			}
+			return pos, nil
+
+		case common.EntryTooBig:
+			return 0, err
 
 		default: // full? corrupted?
 			// try to write new one
 			seg, err := q.newSegment()
 			if err != nil {
-				return err
+				return 0, err
 			}
-			q.segments.PushBack(seg)
+			q.pushTail(seg)
 		}
 	}
 
-	return common.ErrQueueCorrupted
+	return 0, common.ErrQueueCorrupted
 }
 
-func (q *queue) EnqueueBatch(b entry.Batch) error {
+// EnqueueReader enqueues a large entry of given size, whose payload is read from r. The entry
+// is stored as chunks of StreamChunkSize, so that it could be bigger than limitation of
+// common.MaxEntrySize. EntryV1, EntryV3 and EntryV7 formats do not support large entries.
+//
+// Enqueuing is blocked until the whole entry is written. The first chunk is read from r before
+// that, remaining ones are read while other producers wait: slow r stalls every producer. If r
+// fails, the entry is discarded and the error is returned.
+func (q *queue) EnqueueReader(r io.Reader, size int64) (pos uint64, err error) {
+	if r, err = q.prefetchChunk(r, size); err != nil {
+		return
+	}
+
 	q.wLock.Lock()
-	err := q.enqueueBatch(b)
+	pos, err = q.enqueueStream(r, size, entry.Meta{})
 	q.wLock.Unlock()
-	return err
+	return
+}
+
+// prefetchChunk reads the first chunk of large entry from r, so that producers are not blocked
+// until r is ready. Short read is left to segment, which discards the entry then.
+func (q *queue) prefetchChunk(r io.Reader, size int64) (io.Reader, error) {
+	n := int64(q.settings.StreamChunkSize)
+	if size < n {
+		n = size
+	}
+	if n <= 0 {
+		return r, nil
+	}
+
+	buf := make([]byte, n)
+	read, err := io.ReadFull(r, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return io.MultiReader(bytes.NewReader(buf[:read]), r), nil
+}
+
+func (q *queue) enqueueStream(r io.Reader, size int64, meta entry.Meta) (uint64, error) {
+	// buffered entry must fit segment files, which it's spilled into
+	if q.settings.MemoryBuffer > 0 && size > 0 && !q.streamSupported() {
+		return 0, common.ErrEntryUnsupportedFormat
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		back := q.segments.Back()
+		if back == nil {
+			return 0, common.ErrQueueCorrupted
+		}
+
+		tail := back.Value.(*segment)
+		offset := tail.seg.Size()
+
+		code, err := tail.seg.WriteStream(r, size, q.settings.StreamChunkSize, meta)
+		switch code {
+		case common.NoError:
+			pos := q.nextPos
+			if size > 0 {
+				q.indexTime(tail, pos, offset)
+				q.nextPos++
+			}
+			return pos, nil
+
+		case common.SegmentNoMoreWrite:
+			// try to write new one
+			seg, err := q.newSegment()
+			if err != nil {
+				return 0, err
+			}
+			q.pushTail(seg)
+
+		default: // r is consumed partially, could not retry
+			return 0, err
+		}
+	}
+
+	return 0, common.ErrQueueCorrupted
 }
 
-func (q *queue) enqueueBatch(b entry.Batch) error {
+// EnqueueBatch of entries, returns position of the first one. Entries of batch have consecutive positions.
+func (q *queue) EnqueueBatch(b entry.Batch) (pos uint64, err error) {
+	q.wLock.Lock()
+	pos, err = q.enqueueBatch(b)
+	q.wLock.Unlock()
+	return
+}
+
+func (q *queue) enqueueBatch(b entry.Batch) (uint64, error) {
 	for attempt := 0; attempt < 2; attempt++ {
 		back := q.segments.Back()
 		if back == nil {
-			return common.ErrQueueCorrupted
+			return 0, common.ErrQueueCorrupted
 		}
 
 		tail := back.Value.(*segment)
+		offset := tail.seg.Size()
 
 		code, err := tail.seg.WriteBatch(b)
 		switch code {
-		case common.NoError, common.EntryTooBig:
-			return err
+		case common.NoError:
+			pos := q.nextPos
+			if b.Len() > 0 {
+				q.indexTime(tail, pos, offset)
+			}
+			q.nextPos += uint64(b.Len())
+			return pos, nil
+
+		case common.EntryTooBig:
+			return 0, err
 
 		default: // full? corrupted?
 			// try to write new one
 			seg, err := q.newSegment()
 			if err != nil {
-				return err
+				return 0, err
 			}
-			q.segments.PushBack(seg)
+			q.pushTail(seg)
 		}
 	}
 
-	return common.ErrQueueCorrupted
+	return 0, common.ErrQueueCorrupted
 }
 
-func (q *queue) newSegment() (*segment, error) {
-	f, err := createFile(q.settings.DataDir, segPrefix)
-	if err != nil {
-		return nil, err
+// indexTime records enqueuing time of entry at pos into time index of tail segment, at most
+// once per TimeIndexInterval. Offset is size of segment right before writing the entry.
+func (q *queue) indexTime(tail *segment, pos uint64, offset int64) {
+	interval, inMemory := q.settings.TimeIndexInterval, len(tail.path) == 0
+	if interval <= 0 && !inMemory {
+		return
 	}
-	path := f.Name()
 
-	// write header
-	if err = q.segHeadWriter.WriteHeader(f, q.settings.SegmentFormat); err != nil {
-		_ = os.Remove(path)
-		return nil, err
+	now := time.Now()
+	if inMemory {
+		tail.modTime = now // as last modification of segment file
+	}
+	if interval <= 0 || !tail.indexedAt.IsZero() && now.Sub(tail.indexedAt) < interval {
+		return
 	}
 
-	// no problem -> add to segments list
-	switch q.settings.SegmentFormat {
-	case common.SegmentV1:
-		seg, err := segv1.NewSegment(f, q.settings.EntryFormat, q.settings.MaxEntriesPerSegment)
-		if err != nil {
+	point := timePoint{
+		ts:    now.UnixNano(),
+		entry: pos - tail.base,
+	}
+	if inMemory {
+		point.offset = offset
+		tail.points = append(tail.points, point)
+		tail.indexedAt = now
+		return
+	}
+
+	point.offset = segmentHeaderSize(q.settings.SegmentFormat) + offset
+	if err := appendTimePoint(q.settings.FS, timeIndexFilePath(tail.path), point); err == nil {
+		tail.indexedAt = now
+	}
+}
+
+// segmentFileWriter returns writer of segment file: bypassing page cache, or truncating preallocated
+// space once segment is sealed. File is closed if it's reopened for direct I/O, which requires
+// file of operating system.
+func (q *queue) segmentFileWriter(f vfs.File, preallocated bool) (io.WriteCloser, error) {
+	switch {
+	case q.settings.SegmentFormat == common.SegmentV3: // memory-mapped
+		return f, nil
+
+	case q.settings.DirectIO:
+		if _, ok := f.(*os.File); !ok {
+			return nil, common.ErrDirectIOUnsupported
+		}
+		w, err := newDirectWriter(f.Name())
+		if err == nil {
 			_ = f.Close()
-			_ = os.Remove(path)
-			return nil, err
 		}
+		return w, err
 
-		return &segment{
-			path: path,
-			seg:  seg,
-		}, nil
+	case preallocated:
+		return preallocatedFile{File: f}, nil
 
 	default:
-		_ = f.Close()
-		_ = os.Remove(path)
-		return nil, common.ErrSegmentUnsupportedFormat
+		return f, nil
 	}
 }
 
-func loadOffsetTracker(path string) (offset int64, f *os.File, err error) {
-	for attempt := 0; attempt < 2; attempt++ {
-		f, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
-		if err != nil {
-			return
+// newSegment creates writable segment, starting at next enqueuing position. It's kept in memory
+// if queue is not durable, or buffers entries (see QueueSettings.MemoryBuffer).
+func (q *queue) newSegment() (*segment, error) {
+	switch {
+	case q.memory:
+		return q.newMemorySegment(q.settings.MaxEntriesPerSegment), nil
+
+	case q.settings.MemoryBuffer > 0:
+		// file of buffered segment takes its place in sequence of segments
+		seg := q.newMemorySegment(q.settings.MemoryBuffer)
+		seg.seq = q.nextSeq
+		q.nextSeq++
+		return seg, nil
+
+	default:
+		return q.newFileSegment(q.nextSeq, q.nextPos, q.settings.MaxEntriesPerSegment)
+	}
+}
+
+// newMemorySegment creates in-memory segment taking at most maxEntries, starting at next enqueuing
+// position.
+func (q *queue) newMemorySegment(maxEntries uint32) *segment {
+	return &segment{
+		seg: segmem.NewSegmentWithSettings(segmem.Settings{
+			MaxEntries: maxEntries,
+			MaxBytes:   q.settings.MaxBytesPerSegment,
+		}),
+		base:    q.nextPos,
+		created: time.Now(),
+	}
+}
+
+// newFileSegment creates segment file of given sequence (or the next free one), starting at
+// position base. Segment takes at most maxEntries.
+func (q *queue) newFileSegment(seq, base uint64, maxEntries uint32) (*segment, error) {
+	f, seq, err := createSegmentFile(q.settings.FS, q.settings.DataDir, seq, base)
+	if err != nil {
+		return nil, err
+	}
+	path := f.Name()
+	if seq >= q.nextSeq {
+		q.nextSeq = seq + 1
+	}
+
+	// preallocate disk space, full disk is discovered right now
+	size := q.preallocateSize()
+	if size > 0 {
+		if err = fallocate(f, size); err != nil {
+			_ = f.Close()
+			_ = q.settings.FS.Remove(path)
+			return nil, err
 		}
+	}
 
-		var info os.FileInfo
-		info, err = f.Stat()
-		if err == nil {
-			if info.Size() < 8 {
-				return
-			}
+	w, err := q.segmentFileWriter(f, size > 0)
+	if err != nil {
+		_ = f.Close()
+		_ = q.settings.FS.Remove(path)
+		return nil, err
+	}
 
-			// seek and read stored-offset
-			if _, err = f.Seek(-8, 2); err == nil {
-				var buf [8]byte
-				if _, err = io.ReadFull(f, buf[:]); err == nil {
-					offset = int64(common.Endianese.Uint64(buf[:]))
-					_, err = f.Seek(0, 2) // to the end
-				}
-			}
+	// write header
+	info := segmentInfo{created: time.Now(), seq: seq, base: base}
+	if err = q.segHeadWriter.WriteHeader(w, q.settings.SegmentFormat, info); err != nil {
+		_ = q.settings.FS.Remove(path)
+		return nil, err
+	}
+
+	// no problem -> add to segments list
+	var seg segmentPkg.Segment
+	switch q.settings.SegmentFormat {
+	case common.SegmentV1, common.SegmentV2:
+		seg, err = segv1.NewSegmentWithSettings(w, segv1.Settings{
+			EntryFormat:          q.settings.EntryFormat,
+			MaxEntries:           maxEntries,
+			Codec:                q.settings.Codec,
+			CompressionThreshold: q.settings.CompressionThreshold,
+			CompressBatch:        q.settings.CompressBatch,
+			KeyProvider:          q.settings.KeyProvider,
+			NoBlockChecksum:      q.settings.NoBlockChecksum,
+			MaxBytes:             q.settings.MaxBytesPerSegment,
+			Footer:               q.settings.SegmentFormat == common.SegmentV2,
+		})
+
+	case common.SegmentV3:
+		if q.settings.Codec != nil || q.settings.CompressBatch {
+			err = common.ErrEntryUnsupportedFormat
+			break
+		}
+		mf, ok := f.(segmmap.File)
+		if !ok {
+			err = common.ErrSegmentNotMappable
+			break
 		}
+		seg, err = segmmap.NewSegmentWithSettings(mf, segmmap.Settings{
+			EntryFormat: q.settings.EntryFormat,
+			MaxEntries:  maxEntries,
+			Size:        q.settings.MaxBytesPerSegment,
+		})
 
-		if err != nil {
-			_ = f.Close()
-			_ = os.Remove(path)
+	default:
+		err = common.ErrSegmentUnsupportedFormat
+	}
+
+	if err == nil {
+		if err = q.manifest.add(path, base); err != nil {
+			_ = seg.Close()
 		}
+	} else {
+		_ = w.Close()
+	}
+	if err != nil {
+		_ = q.settings.FS.Remove(path)
+		return nil, err
 	}
-	return
-}
 
-func offsetFilePath(segmentFilePath string) string {
-	return segmentFilePath + segOffsetFileSuffix
+	return &segment{
+		path:    path,
+		seg:     seg,
+		base:    base,
+		created: info.created,
+	}, nil
 }
@@ -237,6 +237,69 @@ func BenchmarkBigQueueRW_64K(b *testing.B) {
 	}
 }
 
+func BenchmarkPQueueWritingCRC32C_16K(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes((16 << 10) * totalEntries)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		benchmarkPQueueWithFormat(b, totalEntries, 16<<10, false, common.EntryV5)
+	}
+}
+
+func BenchmarkPQueueWritingCRC32C_64K(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes((64 << 10) * totalEntries)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		benchmarkPQueueWithFormat(b, totalEntries, 64<<10, false, common.EntryV5)
+	}
+}
+
+func BenchmarkPQueueWritingCompact_16(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(16 * totalEntries)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		benchmarkPQueueWithFormat(b, totalEntries, 16, false, common.EntryV7)
+	}
+}
+
+func BenchmarkPQueueWritingDirectIO_2048(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(2048 * totalEntries)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		benchmarkPQueueDirectIO(b, totalEntries, 2048, false)
+	}
+}
+
+func BenchmarkPQueueWritingDirectIO_16K(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes((16 << 10) * totalEntries)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		benchmarkPQueueDirectIO(b, totalEntries, 16<<10, false)
+	}
+}
+
+func BenchmarkPQueueWritingDirectIO_64K(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes((64 << 10) * totalEntries)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		benchmarkPQueueDirectIO(b, totalEntries, 64<<10, false)
+	}
+}
+
+func BenchmarkPQueueRWDirectIO_16K(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes((16 << 10) * totalEntriesForRW)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		benchmarkPQueueDirectIO(b, totalEntriesForRW, 16<<10, true)
+	}
+}
+
 func prepareDataDir(dir string) string {
 	dataDir := filepath.Join(tmpDir, dir)
 	_ = os.RemoveAll(dataDir)
@@ -245,6 +308,25 @@ func prepareDataDir(dir string) string {
 }
 
 func benchmarkPQueue(b *testing.B, size int, entrySize int, alsoRead bool) {
+	benchmarkPQueueWithFormat(b, size, entrySize, alsoRead, common.EntryV1)
+}
+
+func benchmarkPQueueDirectIO(b *testing.B, size int, entrySize int, alsoRead bool) {
+	benchmarkPQueueWithSettings(b, size, entrySize, alsoRead, QueueSettings{
+		EntryFormat:          common.EntryV1,
+		MaxEntriesPerSegment: 2000,
+		DirectIO:             true,
+	})
+}
+
+func benchmarkPQueueWithFormat(b *testing.B, size int, entrySize int, alsoRead bool, format common.EntryFormat) {
+	benchmarkPQueueWithSettings(b, size, entrySize, alsoRead, QueueSettings{
+		EntryFormat:          format,
+		MaxEntriesPerSegment: 2000,
+	})
+}
+
+func benchmarkPQueueWithSettings(b *testing.B, size int, entrySize int, alsoRead bool, settings QueueSettings) {
 	b.StopTimer()
 
 	var path string
@@ -259,7 +341,8 @@ func benchmarkPQueue(b *testing.B, size int, entrySize int, alsoRead bool) {
 		_ = os.RemoveAll(dataDir)
 	}()
 
-	q, _ := New(dataDir, 2000)
+	settings.DataDir = dataDir
+	q, _ := NewWithSettings(settings)
 	defer func() {
 		_ = q.Close()
 	}()
@@ -298,13 +381,13 @@ func benchmarkPQueue(b *testing.B, size int, entrySize int, alsoRead bool) {
 
 		batch.Append(buf)
 		if batch.Len() == flushOps {
-			_ = q.EnqueueBatch(batch)
+			_, _ = q.EnqueueBatch(batch)
 			batch.Reset()
 		}
 	}
 
 	if batch.Len() > 0 {
-		_ = q.EnqueueBatch(batch)
+		_, _ = q.EnqueueBatch(batch)
 	}
 
 	wg.Wait()
@@ -2,11 +2,17 @@ package pqueue
 
 import (
 	"bytes"
+	"compress/flate"
 	"container/list"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -14,12 +20,18 @@ import (
 
 	"github.com/linxGnu/pqueue/common"
 	"github.com/linxGnu/pqueue/entry"
+	"github.com/linxGnu/pqueue/vfs"
 
 	"github.com/stretchr/testify/require"
 )
 
 var tmpDir = os.TempDir()
 
+func enqueue(q Queue, e entry.Entry) (err error) {
+	_, err = q.Enqueue(e)
+	return
+}
+
 type mockWriterErr struct {
 	buf             *bytes.Buffer
 	onWrite         bool
@@ -49,7 +61,7 @@ func (m *mockWriterErr) Close() error {
 	return nil
 }
 
-func (m *mockWriterErr) WriteHeader(io.WriteCloser, common.SegmentFormat) error {
+func (m *mockWriterErr) WriteHeader(io.WriteCloser, common.SegmentFormat, segmentInfo) error {
 	if m.onSegmentHeader {
 		return fmt.Errorf("fake error")
 	}
@@ -67,12 +79,14 @@ func TestNewSegment(t *testing.T) {
 
 		q.settings = QueueSettings{
 			DataDir: "/abc",
+			FS:      vfs.OS,
 		}
 		_, err := q.newSegment()
 		require.Error(t, err)
 
 		q.settings = QueueSettings{
 			DataDir:     tmpDir,
+			FS:          vfs.OS,
 			EntryFormat: 123,
 		}
 		_, err = q.newSegment()
@@ -80,6 +94,7 @@ func TestNewSegment(t *testing.T) {
 
 		q.settings = QueueSettings{
 			DataDir:       tmpDir,
+			FS:            vfs.OS,
 			SegmentFormat: 123,
 		}
 		_, err = q.newSegment()
@@ -87,6 +102,7 @@ func TestNewSegment(t *testing.T) {
 
 		q.settings = QueueSettings{
 			DataDir:       tmpDir,
+			FS:            vfs.OS,
 			SegmentFormat: common.SegmentV1,
 			EntryFormat:   common.EntryV1,
 		}
@@ -101,6 +117,7 @@ func TestNewSegment(t *testing.T) {
 
 		q.settings = QueueSettings{
 			DataDir:       tmpDir,
+			FS:            vfs.OS,
 			SegmentFormat: common.SegmentV1,
 			EntryFormat:   common.EntryV1,
 		}
@@ -112,8 +129,43 @@ func TestNewSegment(t *testing.T) {
 }
 
 func TestQueueRace(t *testing.T) {
-	size := 40000
+	t.Run("SegmentV1", func(t *testing.T) {
+		testQueueRace(t, QueueSettings{
+			SegmentFormat: common.SegmentV1,
+			EntryFormat:   common.EntryV1,
+		}, 40000)
+	})
+
+	// shorter run, queue logic is covered by SegmentV1 already
+	t.Run("SegmentV3", func(t *testing.T) {
+		testQueueRace(t, QueueSettings{
+			SegmentFormat:        common.SegmentV3,
+			EntryFormat:          common.EntryV1,
+			MaxEntriesPerSegment: DefaultMaxEntriesPerSegment,
+			MaxBytesPerSegment:   1 << 20,
+		}, 5000)
+	})
+
+	t.Run("Hybrid", func(t *testing.T) {
+		testQueueRace(t, QueueSettings{
+			SegmentFormat: common.SegmentV1,
+			EntryFormat:   common.EntryV1,
+			MemoryBuffer:  100,
+		}, 5000)
+	})
+
+	t.Run("Memory", func(t *testing.T) {
+		q, err := NewMemory(DefaultMaxEntriesPerSegment)
+		require.NoError(t, err)
+		defer func() {
+			_ = q.Close()
+		}()
+
+		testConcurrentQueue(t, q, 5000)
+	})
+}
 
+func testQueueRace(t *testing.T, settings QueueSettings, size int) {
 	dataDir := filepath.Join(tmpDir, "pqueue_race_test")
 	_ = os.RemoveAll(dataDir)
 
@@ -142,12 +194,19 @@ func TestQueueRace(t *testing.T) {
 		_ = f3.Close()
 	}
 
-	q, err := New(dataDir, 0)
+	settings.DataDir = dataDir
+	q, err := NewWithSettings(settings)
 	require.NoError(t, err)
 	defer func() {
 		_ = q.Close()
 	}()
 
+	testConcurrentQueue(t, q, size)
+}
+
+// testConcurrentQueue enqueues size entries by concurrent writers, checks that concurrent readers
+// dequeue each of them exactly once.
+func testConcurrentQueue(t *testing.T, q Queue, size int) {
 	// start readers
 	var wg sync.WaitGroup
 
@@ -207,7 +266,7 @@ func TestQueueRace(t *testing.T) {
 				time.Sleep(time.Millisecond)
 
 				common.Endianese.PutUint32(buf, data)
-				err := q.Enqueue(buf)
+				_, err := q.Enqueue(buf)
 				require.NoError(t, err)
 			}
 		}()
@@ -227,7 +286,7 @@ func TestQueueRace(t *testing.T) {
 				b.Reset()
 				b.Append(buf)
 
-				err := q.EnqueueBatch(b)
+				_, err := q.EnqueueBatch(b)
 				require.NoError(t, err)
 			}
 		}()
@@ -248,7 +307,8 @@ func TestQueueRace(t *testing.T) {
 func TestEnqueue(t *testing.T) {
 	t.Run("NoSegment", func(t *testing.T) {
 		q := &queue{segments: list.New()}
-		require.Error(t, q.Enqueue([]byte{}))
+		_, err := q.Enqueue([]byte{})
+		require.Error(t, err)
 	})
 }
 
@@ -259,7 +319,7 @@ func TestDequeue(t *testing.T) {
 		var e entry.Entry
 		require.False(t, q.Dequeue(&e))
 
-		require.True(t, q.removeSegment(q.segments.PushBack(1)))
+		require.True(t, q.removeSegment(q.segments.PushBack(1), false))
 	})
 }
 
@@ -282,7 +342,7 @@ func TestQueueWriteLoad(t *testing.T) {
 		buf := make([]byte, 2<<10)
 		for data := 0; data < size; data++ {
 			common.Endianese.PutUint32(buf, uint32(data))
-			err := q.Enqueue(buf)
+			_, err := q.Enqueue(buf)
 			require.NoError(t, err)
 		}
 		_ = q.Close()
@@ -341,10 +401,10 @@ func TestQueueExample(t *testing.T) {
 	q, err := New(dataDir, 3)
 	require.NoError(t, err)
 
-	require.NoError(t, q.Enqueue([]byte{1, 2, 3}))
-	require.NoError(t, q.Enqueue([]byte{4, 5, 6}))
-	require.NoError(t, q.Enqueue([]byte{7, 8, 9, 10}))
-	require.NoError(t, q.Enqueue([]byte{11}))
+	require.NoError(t, enqueue(q, []byte{1, 2, 3}))
+	require.NoError(t, enqueue(q, []byte{4, 5, 6}))
+	require.NoError(t, enqueue(q, []byte{7, 8, 9, 10}))
+	require.NoError(t, enqueue(q, []byte{11}))
 
 	// peek then dequeue
 	var peek entry.Entry
@@ -352,7 +412,7 @@ func TestQueueExample(t *testing.T) {
 	require.EqualValues(t, []byte{1, 2, 3}, peek)
 	require.True(t, q.Dequeue(&peek))
 	require.EqualValues(t, []byte{1, 2, 3}, peek)
-	require.True(t, q.(*queue).peek == nil)
+	require.True(t, q.(*queue).peek.Entry == nil)
 
 	// dequeue then peek
 	require.True(t, q.Dequeue(&peek))
@@ -372,7 +432,7 @@ func TestQueueExample(t *testing.T) {
 }
 
 func TestLoadOffsetFile(t *testing.T) {
-	_, _, err := loadOffsetTracker("/")
+	_, _, err := loadOffsetTracker(vfs.OS, "/")
 	require.Error(t, err)
 }
 
@@ -388,7 +448,7 @@ func TestQueueCorruptedWritingFile(t *testing.T) {
 	q, err := New(dataDir, 3)
 	require.NoError(t, err)
 
-	require.NoError(t, q.Enqueue([]byte{1, 2, 3}))
+	require.NoError(t, enqueue(q, []byte{1, 2, 3}))
 
 	front := q.(*queue).segments.Front().Value.(*segment)
 	f, err := os.OpenFile(front.path, os.O_RDWR, 0o644)
@@ -413,7 +473,7 @@ func TestQueueReopen(t *testing.T) {
 	q, err := New(dataDir, 3)
 	require.NoError(t, err)
 
-	require.NoError(t, q.Enqueue([]byte{1, 2, 3}))
+	require.NoError(t, enqueue(q, []byte{1, 2, 3}))
 
 	var e entry.Entry
 	require.True(t, q.Dequeue(&e))
@@ -429,3 +489,2028 @@ func TestQueueReopen(t *testing.T) {
 	require.False(t, q.Dequeue(&e))
 	q.Close()
 }
+
+func TestQueuePurge(t *testing.T) {
+	dataDir := filepath.Join(tmpDir, "pqueue_purge")
+	_ = os.RemoveAll(dataDir)
+	err := os.MkdirAll(dataDir, 0o777)
+	require.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(dataDir)
+	}()
+
+	q, err := New(dataDir, 3)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, enqueue(q, []byte{byte(i)}))
+	}
+
+	var e entry.Entry
+	require.True(t, q.Dequeue(&e))
+	require.True(t, q.Peek(&e))
+	require.EqualValues(t, []byte{1}, e)
+
+	require.NoError(t, q.Purge())
+	require.Equal(t, 1, q.(*queue).segments.Len())
+
+	files, err := loadFileInfos(vfs.OS, dataDir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	require.Len(t, q.(*queue).manifest.records, 1)
+
+	require.False(t, q.Peek(&e))
+	require.False(t, q.Dequeue(&e))
+
+	// still writable
+	require.NoError(t, enqueue(q, []byte{11}))
+	require.True(t, q.Dequeue(&e))
+	require.EqualValues(t, []byte{11}, e)
+	_ = q.Close()
+
+	// nothing left after reopen
+	q, err = New(dataDir, 3)
+	require.NoError(t, err)
+	require.False(t, q.Dequeue(&e))
+	_ = q.Close()
+
+	t.Run("RemoveFailure", func(t *testing.T) {
+		fs := &failRemoveFS{FS: vfs.NewMem()}
+		require.NoError(t, fs.MkdirAll("/data", 0o700))
+		settings := QueueSettings{DataDir: "/data", MaxEntriesPerSegment: 3, FS: fs}
+
+		q, err := NewWithSettings(settings)
+		require.NoError(t, err)
+		for i := 0; i < 10; i++ {
+			require.NoError(t, enqueue(q, []byte{byte(i)}))
+		}
+
+		fs.fail = true
+		require.Error(t, q.Purge())
+		fs.fail = false
+
+		pos, err := q.Enqueue([]byte{10})
+		require.NoError(t, err)
+		require.EqualValues(t, 10, pos)
+		_ = q.Close()
+
+		// purged segments left behind are not loaded again
+		q, err = NewWithSettings(settings)
+		require.NoError(t, err)
+
+		var r entry.Record
+		require.True(t, q.DequeueRecord(&r))
+		require.EqualValues(t, 10, r.Position)
+		require.False(t, q.DequeueRecord(&r))
+		_ = q.Close()
+
+		files, err := loadFileInfos(fs, "/data")
+		require.NoError(t, err)
+		require.Len(t, files, 1) // left behind ones are removed, only tail of reopening is kept
+	})
+}
+
+// failRemoveFS fails removing segment files if fail is set.
+type failRemoveFS struct {
+	vfs.FS
+	fail bool
+}
+
+func (fs *failRemoveFS) Remove(name string) error {
+	if fs.fail && strings.HasPrefix(filepath.Base(name), segPrefix) {
+		return os.ErrPermission
+	}
+	return fs.FS.Remove(name)
+}
+
+func TestQueueDropHead(t *testing.T) {
+	dataDir := filepath.Join(tmpDir, "pqueue_drop_head")
+	_ = os.RemoveAll(dataDir)
+	err := os.MkdirAll(dataDir, 0o777)
+	require.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(dataDir)
+	}()
+
+	q, err := New(dataDir, 3)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, enqueue(q, []byte{byte(i)}))
+	}
+
+	var e entry.Entry
+	require.True(t, q.Peek(&e))
+	require.Equal(t, 0, q.DropHead(0))
+	require.Equal(t, 5, q.DropHead(5))
+
+	require.True(t, q.Dequeue(&e))
+	require.EqualValues(t, []byte{5}, e)
+	_ = q.Close()
+
+	// dropped entries are committed
+	q, err = New(dataDir, 3)
+	require.NoError(t, err)
+	require.True(t, q.Peek(&e))
+	require.EqualValues(t, []byte{6}, e)
+	require.Equal(t, 4, q.DropHead(100))
+	require.False(t, q.Dequeue(&e))
+	_ = q.Close()
+}
+
+func TestQueueSeekToPosition(t *testing.T) {
+	dataDir := filepath.Join(tmpDir, "pqueue_seek_position")
+	_ = os.RemoveAll(dataDir)
+	err := os.MkdirAll(dataDir, 0o777)
+	require.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(dataDir)
+	}()
+
+	settings := QueueSettings{
+		DataDir:              dataDir,
+		MaxEntriesPerSegment: 3,
+		RetainConsumed:       true,
+	}
+
+	q, err := NewWithSettings(settings)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, enqueue(q, []byte{byte(i)}))
+	}
+
+	var e entry.Entry
+	for i := 0; i < 10; i++ {
+		require.True(t, q.Dequeue(&e))
+		require.EqualValues(t, []byte{byte(i)}, e)
+	}
+	require.False(t, q.Dequeue(&e))
+	require.Equal(t, 3, q.(*queue).retained.Len())
+
+	// rewind
+	require.NoError(t, q.SeekToPosition(4))
+	for i := 4; i < 7; i++ {
+		require.True(t, q.Dequeue(&e))
+		require.EqualValues(t, []byte{byte(i)}, e)
+	}
+
+	// forward
+	require.True(t, q.Peek(&e))
+	require.NoError(t, q.SeekToPosition(8))
+	require.True(t, q.Dequeue(&e))
+	require.EqualValues(t, []byte{8}, e)
+	_ = q.Close()
+
+	// retained segments survive reopening
+	q, err = NewWithSettings(settings)
+	require.NoError(t, err)
+
+	require.True(t, q.Dequeue(&e))
+	require.EqualValues(t, []byte{9}, e)
+	require.False(t, q.Dequeue(&e))
+
+	require.NoError(t, q.SeekToPosition(0))
+	for i := 0; i < 10; i++ {
+		require.True(t, q.Dequeue(&e))
+		require.EqualValues(t, []byte{byte(i)}, e)
+	}
+	require.False(t, q.Dequeue(&e))
+
+	require.Equal(t, common.ErrSeekOutOfRange, q.SeekToPosition(11))
+	require.False(t, q.Dequeue(&e))
+
+	// purge drops retained segments as well
+	require.NoError(t, q.Purge())
+	require.Equal(t, 0, q.(*queue).retained.Len())
+	require.Equal(t, common.ErrSeekOutOfRange, q.SeekToPosition(1))
+	_ = q.Close()
+}
+
+func TestQueueSeekWithoutRetention(t *testing.T) {
+	dataDir := filepath.Join(tmpDir, "pqueue_seek_no_retention")
+	_ = os.RemoveAll(dataDir)
+	err := os.MkdirAll(dataDir, 0o777)
+	require.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(dataDir)
+	}()
+
+	q, err := New(dataDir, 3)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, enqueue(q, []byte{byte(i)}))
+	}
+
+	var e entry.Entry
+	for i := 0; i < 4; i++ {
+		require.True(t, q.Dequeue(&e))
+	}
+
+	// consumed segment is gone, rewinding only reaches the beginning of pending segments
+	require.Equal(t, common.ErrSeekOutOfRange, q.SeekToPosition(0))
+	require.True(t, q.Dequeue(&e))
+	require.EqualValues(t, []byte{3}, e)
+
+	require.NoError(t, q.SeekToPosition(3))
+	require.True(t, q.Dequeue(&e))
+	require.EqualValues(t, []byte{3}, e)
+	require.Equal(t, 0, q.(*queue).retained.Len())
+	_ = q.Close()
+}
+
+func TestQueueSeekToTime(t *testing.T) {
+	dataDir := filepath.Join(tmpDir, "pqueue_seek_time")
+	_ = os.RemoveAll(dataDir)
+	err := os.MkdirAll(dataDir, 0o777)
+	require.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(dataDir)
+	}()
+
+	q, err := NewWithSettings(QueueSettings{
+		DataDir:              dataDir,
+		MaxEntriesPerSegment: 3,
+		RetainConsumed:       true,
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 6; i++ {
+		require.NoError(t, enqueue(q, []byte{byte(i)}))
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	checkpoint := time.Now()
+	time.Sleep(20 * time.Millisecond)
+
+	for i := 6; i < 9; i++ {
+		require.NoError(t, enqueue(q, []byte{byte(i)}))
+	}
+
+	var e entry.Entry
+	for i := 0; i < 9; i++ {
+		require.True(t, q.Dequeue(&e))
+	}
+	require.False(t, q.Dequeue(&e))
+
+	require.NoError(t, q.SeekToTime(checkpoint))
+	for i := 6; i < 9; i++ {
+		require.True(t, q.Dequeue(&e))
+		require.EqualValues(t, []byte{byte(i)}, e)
+	}
+	require.False(t, q.Dequeue(&e))
+
+	require.NoError(t, q.SeekToTime(time.Time{}))
+	require.True(t, q.Dequeue(&e))
+	require.EqualValues(t, []byte{0}, e)
+
+	// tail segment might always contain upcoming entries
+	require.NoError(t, q.SeekToTime(time.Now().Add(time.Hour)))
+	require.True(t, q.Dequeue(&e))
+	require.EqualValues(t, []byte{6}, e)
+	_ = q.Close()
+}
+
+func TestQueueRetention(t *testing.T) {
+	dataDir := filepath.Join(tmpDir, "pqueue_retention")
+	defer func() {
+		_ = os.RemoveAll(dataDir)
+	}()
+
+	prepare := func(settings QueueSettings) Queue {
+		_ = os.RemoveAll(dataDir)
+		require.NoError(t, os.MkdirAll(dataDir, 0o777))
+
+		q, err := NewWithSettings(settings)
+		require.NoError(t, err)
+
+		for i := 0; i < 10; i++ {
+			require.NoError(t, enqueue(q, []byte{byte(i)}))
+		}
+
+		var e entry.Entry
+		for i := 0; i < 10; i++ {
+			require.True(t, q.Dequeue(&e))
+		}
+		if settings.RetentionCheckInterval == 0 { // not cleaned up in background meanwhile
+			require.Equal(t, 3, q.(*queue).retained.Len())
+		}
+
+		return q
+	}
+
+	t.Run("MaxAge", func(t *testing.T) {
+		q := prepare(QueueSettings{
+			DataDir:              dataDir,
+			MaxEntriesPerSegment: 3,
+			RetainConsumed:       true,
+			RetentionMaxAge:      time.Hour,
+		})
+		defer func() {
+			_ = q.Close()
+		}()
+
+		q.(*queue).applyRetention(time.Now())
+		require.Equal(t, 3, q.(*queue).retained.Len())
+
+		oldest := q.(*queue).retained.Front().Value.(*segment).path
+		q.(*queue).applyRetention(time.Now().Add(2 * time.Hour))
+		require.Equal(t, 0, q.(*queue).retained.Len())
+
+		_, err := os.Stat(oldest)
+		require.True(t, os.IsNotExist(err))
+		_, err = os.Stat(offsetFilePath(oldest))
+		require.True(t, os.IsNotExist(err))
+
+		// tail is still readable after seeking
+		require.Equal(t, common.ErrSeekOutOfRange, q.SeekToPosition(0))
+		var e entry.Entry
+		require.True(t, q.Dequeue(&e))
+		require.EqualValues(t, []byte{9}, e)
+	})
+
+	t.Run("MaxBytes", func(t *testing.T) {
+		q := prepare(QueueSettings{
+			DataDir:              dataDir,
+			MaxEntriesPerSegment: 3,
+			RetainConsumed:       true,
+			RetentionMaxBytes:    1,
+		})
+		defer func() {
+			_ = q.Close()
+		}()
+
+		segSize := q.(*queue).retained.Back().Value.(*segment).size
+		require.Greater(t, segSize, int64(0))
+
+		q.(*queue).settings.RetentionMaxBytes = 2 * segSize
+		q.(*queue).applyRetention(time.Now())
+		require.Equal(t, 2, q.(*queue).retained.Len())
+
+		require.NoError(t, q.SeekToPosition(3))
+		var e entry.Entry
+		require.True(t, q.Dequeue(&e))
+		require.EqualValues(t, []byte{3}, e)
+	})
+
+	t.Run("Background", func(t *testing.T) {
+		q := prepare(QueueSettings{
+			DataDir:                dataDir,
+			MaxEntriesPerSegment:   3,
+			RetainConsumed:         true,
+			RetentionMaxAge:        time.Nanosecond,
+			RetentionCheckInterval: 5 * time.Millisecond,
+		})
+
+		require.Eventually(t, func() bool {
+			q.(*queue).rLock.Lock()
+			defer q.(*queue).rLock.Unlock()
+			return q.(*queue).retained.Len() == 0
+		}, time.Second, 5*time.Millisecond)
+
+		_ = q.Close()
+	})
+}
+
+func TestQueuePosition(t *testing.T) {
+	dataDir := filepath.Join(tmpDir, "pqueue_position")
+	_ = os.RemoveAll(dataDir)
+	err := os.MkdirAll(dataDir, 0o777)
+	require.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(dataDir)
+	}()
+
+	q, err := New(dataDir, 3)
+	require.NoError(t, err)
+
+	for i := 0; i < 4; i++ {
+		pos, err := q.Enqueue([]byte{byte(i)})
+		require.NoError(t, err)
+		require.EqualValues(t, i, pos)
+	}
+
+	b := entry.NewBatch(3)
+	b.Append([]byte{4})
+	b.Append([]byte{5})
+	b.Append([]byte{6})
+	pos, err := q.EnqueueBatch(b)
+	require.NoError(t, err)
+	require.EqualValues(t, 4, pos)
+
+	var r entry.Record
+	require.True(t, q.PeekRecord(&r))
+	require.EqualValues(t, 0, r.Position)
+	require.EqualValues(t, []byte{0}, r.Entry)
+
+	for i := 0; i < 5; i++ {
+		require.True(t, q.DequeueRecord(&r))
+		require.EqualValues(t, i, r.Position)
+		require.EqualValues(t, []byte{byte(i)}, r.Entry)
+	}
+	_ = q.Close()
+
+	// positions are stable after reopening
+	q, err = New(dataDir, 3)
+	require.NoError(t, err)
+
+	pos, err = q.Enqueue([]byte{7})
+	require.NoError(t, err)
+	require.EqualValues(t, 7, pos)
+
+	for i := 5; i < 8; i++ {
+		require.True(t, q.DequeueRecord(&r))
+		require.EqualValues(t, i, r.Position)
+		require.EqualValues(t, []byte{byte(i)}, r.Entry)
+	}
+	require.False(t, q.DequeueRecord(&r))
+
+	// positions are never reused, even after purging
+	require.NoError(t, q.Purge())
+	pos, err = q.Enqueue([]byte{8})
+	require.NoError(t, err)
+	require.EqualValues(t, 8, pos)
+	_ = q.Close()
+}
+
+func TestQueueLegacyFiles(t *testing.T) {
+	dataDir := filepath.Join(tmpDir, "pqueue_legacy")
+	_ = os.RemoveAll(dataDir)
+	err := os.MkdirAll(dataDir, 0o777)
+	require.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(dataDir)
+	}()
+
+	q, err := New(dataDir, 3)
+	require.NoError(t, err)
+	for i := 0; i < 7; i++ {
+		require.NoError(t, enqueue(q, []byte{byte(i)}))
+	}
+	_ = q.Close()
+
+	// rename segments to legacy names
+	files, err := loadFileInfos(vfs.OS, dataDir)
+	require.NoError(t, err)
+	require.Len(t, files, 3)
+	for i := range files {
+		legacy := files[i].path[:strings.LastIndex(files[i].path, segBaseSeparator)]
+		require.NoError(t, os.Rename(files[i].path, legacy))
+		files[i].path = legacy
+	}
+
+	// legacy offset tracker of the first segment: 2 entries consumed
+	f, err := os.Create(offsetFilePath(files[0].path))
+	require.NoError(t, err)
+	var buf [16]byte
+	common.Endianese.PutUint64(buf[:], 17)
+	common.Endianese.PutUint64(buf[8:], 26)
+	_, err = f.Write(buf[:])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	q, err = New(dataDir, 3)
+	require.NoError(t, err)
+	defer func() {
+		_ = q.Close()
+	}()
+
+	var r entry.Record
+	for i := 2; i < 7; i++ {
+		require.True(t, q.DequeueRecord(&r))
+		require.EqualValues(t, i, r.Position)
+		require.EqualValues(t, []byte{byte(i)}, r.Entry)
+	}
+	require.False(t, q.DequeueRecord(&r))
+
+	pos, err := q.Enqueue([]byte{7})
+	require.NoError(t, err)
+	require.EqualValues(t, 7, pos)
+}
+
+func TestQueueCompression(t *testing.T) {
+	dataDir := filepath.Join(tmpDir, "pqueue_compression")
+	_ = os.RemoveAll(dataDir)
+	err := os.MkdirAll(dataDir, 0o777)
+	require.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(dataDir)
+	}()
+
+	codec, err := entry.NewFlateCodec(flate.BestSpeed)
+	require.NoError(t, err)
+
+	_, err = NewWithSettings(QueueSettings{
+		DataDir:     dataDir,
+		EntryFormat: common.EntryV1,
+		Codec:       codec,
+	})
+	require.Equal(t, common.ErrEntryUnsupportedFormat, err)
+
+	// segments written with EntryV1 remain readable
+	q, err := New(dataDir, 3)
+	require.NoError(t, err)
+	_, err = q.Enqueue([]byte{1})
+	require.NoError(t, err)
+	_ = q.Close()
+
+	q, err = NewWithSettings(QueueSettings{
+		DataDir:              dataDir,
+		EntryFormat:          common.EntryV2,
+		MaxEntriesPerSegment: 3,
+		Codec:                codec,
+		CompressionThreshold: 16,
+	})
+	require.NoError(t, err)
+
+	payload := bytes.Repeat([]byte(`{"key":"value"}`), 1000)
+	_, err = q.Enqueue(payload)
+	require.NoError(t, err)
+	_, err = q.Enqueue([]byte{2})
+	require.NoError(t, err)
+
+	b := entry.NewBatch(2)
+	b.Append(payload[:100])
+	b.Append([]byte{3})
+	_, err = q.EnqueueBatch(b)
+	require.NoError(t, err)
+
+	// compressed on disk
+	files, err := os.ReadDir(dataDir)
+	require.NoError(t, err)
+	var size int64
+	for _, f := range files {
+		info, err := f.Info()
+		require.NoError(t, err)
+		size += info.Size()
+	}
+	require.Less(t, size, int64(len(payload)))
+
+	var e entry.Entry
+	require.True(t, q.Dequeue(&e))
+	require.EqualValues(t, []byte{1}, e)
+	require.True(t, q.Peek(&e))
+	require.EqualValues(t, payload, e)
+
+	for _, expected := range []entry.Entry{payload, {2}, payload[:100], {3}} {
+		require.True(t, q.Dequeue(&e))
+		require.EqualValues(t, expected, e)
+	}
+	require.False(t, q.Dequeue(&e))
+	_ = q.Close()
+}
+
+func TestQueueCompressBatch(t *testing.T) {
+	dataDir := filepath.Join(tmpDir, "pqueue_compress_batch")
+	_ = os.RemoveAll(dataDir)
+	err := os.MkdirAll(dataDir, 0o777)
+	require.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(dataDir)
+	}()
+
+	settings := QueueSettings{
+		DataDir:              dataDir,
+		EntryFormat:          common.EntryV2,
+		MaxEntriesPerSegment: 10,
+		CompressBatch:        true,
+	}
+
+	_, err = NewWithSettings(settings)
+	require.Equal(t, common.ErrCodecRequired, err)
+
+	settings.Codec, err = entry.NewFlateCodec(flate.BestSpeed)
+	require.NoError(t, err)
+
+	q, err := NewWithSettings(settings)
+	require.NoError(t, err)
+
+	b := entry.NewBatch(100)
+	for i := 0; i < 100; i++ {
+		b.Append([]byte(fmt.Sprintf(`{"event":"click","id":%d}`, i%5)))
+	}
+	_, err = q.Enqueue([]byte{1})
+	require.NoError(t, err)
+	pos, err := q.EnqueueBatch(b)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, pos)
+	_, err = q.Enqueue([]byte{2})
+	require.NoError(t, err)
+
+	// compressed as a whole
+	files, err := os.ReadDir(dataDir)
+	require.NoError(t, err)
+	var size int64
+	for _, f := range files {
+		info, err := f.Info()
+		require.NoError(t, err)
+		size += info.Size()
+	}
+	require.Less(t, size, int64(500))
+
+	var r entry.Record
+	for i := 0; i < 4; i++ {
+		require.True(t, q.DequeueRecord(&r))
+		require.EqualValues(t, i, r.Position)
+	}
+	_ = q.Close()
+
+	// continue in the middle of frame
+	q, err = NewWithSettings(settings)
+	require.NoError(t, err)
+
+	for i := 3; i < 100; i++ {
+		require.True(t, q.DequeueRecord(&r))
+		require.EqualValues(t, i+1, r.Position)
+		require.EqualValues(t, fmt.Sprintf(`{"event":"click","id":%d}`, i%5), string(r.Entry))
+	}
+	require.True(t, q.DequeueRecord(&r))
+	require.EqualValues(t, []byte{2}, r.Entry)
+	require.False(t, q.DequeueRecord(&r))
+	_ = q.Close()
+}
+
+type mockKeyProvider struct {
+	current string
+	keys    map[string][]byte
+}
+
+func (p *mockKeyProvider) CurrentKey() (string, []byte, error) {
+	return p.current, p.keys[p.current], nil
+}
+
+func (p *mockKeyProvider) Key(id string) ([]byte, error) {
+	return p.keys[id], nil
+}
+
+func TestQueueEncryption(t *testing.T) {
+	dataDir := filepath.Join(tmpDir, "pqueue_encryption")
+	_ = os.RemoveAll(dataDir)
+	err := os.MkdirAll(dataDir, 0o777)
+	require.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(dataDir)
+	}()
+
+	settings := QueueSettings{
+		DataDir:              dataDir,
+		EntryFormat:          common.EntryV3,
+		MaxEntriesPerSegment: 2,
+	}
+
+	_, err = NewWithSettings(settings)
+	require.Equal(t, common.ErrEntryKeyRequired, err)
+
+	keys := &mockKeyProvider{
+		current: "k1",
+		keys:    map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)},
+	}
+	settings.KeyProvider = keys
+
+	q, err := NewWithSettings(settings)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = q.Enqueue([]byte(fmt.Sprintf("secret-%d", i)))
+		require.NoError(t, err)
+	}
+	_ = q.Close()
+
+	// encrypted on disk
+	files, err := os.ReadDir(dataDir)
+	require.NoError(t, err)
+	for _, f := range files {
+		data, err := os.ReadFile(filepath.Join(dataDir, f.Name()))
+		require.NoError(t, err)
+		require.False(t, bytes.Contains(data, []byte("secret")))
+	}
+
+	// rotate key
+	keys.current, keys.keys["k2"] = "k2", bytes.Repeat([]byte{2}, 32)
+	q, err = NewWithSettings(settings)
+	require.NoError(t, err)
+	_, err = q.Enqueue([]byte("secret-3"))
+	require.NoError(t, err)
+	_ = q.Close()
+
+	// old key is wrong: segments are kept, dequeuing is stopped
+	keys.keys["k1"] = bytes.Repeat([]byte{3}, 32)
+	segs, err := loadFileInfos(vfs.OS, dataDir)
+	require.NoError(t, err)
+	q, err = NewWithSettings(settings)
+	require.NoError(t, err)
+
+	var e entry.Entry
+	for i := 0; i < 2; i++ {
+		require.False(t, q.Dequeue(&e))
+		require.Equal(t, common.ErrEntryDecryption, q.Err())
+	}
+	_ = q.Close()
+
+	for _, f := range segs {
+		_, err = os.Stat(f.path)
+		require.NoError(t, err)
+	}
+	keys.keys["k1"] = bytes.Repeat([]byte{1}, 32)
+
+	// old key is missing: segments are kept, dequeuing is stopped
+	delete(keys.keys, "k1")
+	q, err = NewWithSettings(settings)
+	require.NoError(t, err)
+
+	var keyErr *common.KeyNotFoundError
+	require.False(t, q.Dequeue(&e))
+	require.True(t, errors.As(q.Err(), &keyErr))
+	require.Equal(t, "k1", keyErr.KeyID)
+
+	keys.keys["k1"] = bytes.Repeat([]byte{1}, 32)
+	for i := 0; i < 4; i++ {
+		require.True(t, q.Dequeue(&e))
+		require.Equal(t, fmt.Sprintf("secret-%d", i), string(e))
+	}
+	require.NoError(t, q.Err())
+	require.False(t, q.Dequeue(&e))
+
+	_, err = q.Enqueue([]byte("secret-4"))
+	require.NoError(t, err)
+	_ = q.Close()
+
+	// key of the last segment is rotated out: positions are resumed without it, producers go on
+	keys.current, keys.keys["k3"] = "k3", bytes.Repeat([]byte{3}, 32)
+	delete(keys.keys, "k2")
+	q, err = NewWithSettings(settings)
+	require.NoError(t, err)
+
+	pos, err := q.Enqueue([]byte("secret-5"))
+	require.NoError(t, err)
+	require.EqualValues(t, 5, pos)
+
+	var r entry.Record
+	require.False(t, q.DequeueRecord(&r))
+	require.True(t, errors.As(q.Err(), &keyErr))
+	require.Equal(t, "k2", keyErr.KeyID)
+
+	keys.keys["k2"] = bytes.Repeat([]byte{2}, 32)
+	for i := 4; i <= 5; i++ {
+		require.True(t, q.DequeueRecord(&r))
+		require.Equal(t, fmt.Sprintf("secret-%d", i), string(r.Entry))
+		require.EqualValues(t, i, r.Position)
+	}
+	require.NoError(t, q.Err())
+	require.False(t, q.DequeueRecord(&r))
+	_ = q.Close()
+}
+
+func TestQueueAuthentication(t *testing.T) {
+	dataDir := filepath.Join(tmpDir, "pqueue_authentication")
+	defer func() {
+		_ = os.RemoveAll(dataDir)
+	}()
+
+	settings := QueueSettings{
+		DataDir:              dataDir,
+		EntryFormat:          common.EntryV4,
+		MaxEntriesPerSegment: 2,
+		KeyProvider: &mockKeyProvider{
+			current: "k1",
+			keys:    map[string][]byte{"k1": []byte("hmac key")},
+		},
+	}
+
+	// msg-1 is forged inside the first segment
+	prepare := func(t *testing.T) {
+		_ = os.RemoveAll(dataDir)
+		require.NoError(t, os.MkdirAll(dataDir, 0o777))
+
+		q, err := NewWithSettings(settings)
+		require.NoError(t, err)
+		for i := 0; i < 4; i++ {
+			_, err = q.Enqueue([]byte(fmt.Sprintf("msg-%d", i)))
+			require.NoError(t, err)
+		}
+		_ = q.Close()
+
+		files, err := loadFileInfos(vfs.OS, dataDir)
+		require.NoError(t, err)
+
+		data, err := os.ReadFile(files[0].path)
+		require.NoError(t, err)
+
+		idx := bytes.Index(data, []byte("msg-1"))
+		data[idx+4] = 'X'
+
+		start := idx - 9 // [Length][Checksum][Flags]
+		size := common.Endianese.Uint32(data[start:])
+		common.Endianese.PutUint32(data[start+4:], crc32.ChecksumIEEE(data[start+8:start+8+int(size)]))
+		require.NoError(t, os.WriteFile(files[0].path, data, 0o644))
+	}
+
+	t.Run("Error", func(t *testing.T) {
+		prepare(t)
+
+		q, err := NewWithSettings(settings)
+		require.NoError(t, err)
+
+		var r entry.Record
+		require.True(t, q.DequeueRecord(&r))
+		require.EqualValues(t, "msg-0", r.Entry)
+		for i := 0; i < 2; i++ {
+			require.False(t, q.DequeueRecord(&r))
+			require.Equal(t, common.ErrEntryAuthentication, q.Err())
+		}
+		_ = q.Close()
+
+		// stopped again after reopening
+		q, err = NewWithSettings(settings)
+		require.NoError(t, err)
+		require.False(t, q.DequeueRecord(&r))
+		require.Equal(t, common.ErrEntryAuthentication, q.Err())
+		_ = q.Close()
+	})
+
+	t.Run("Skip", func(t *testing.T) {
+		prepare(t)
+
+		settings := settings
+		settings.AuthFailurePolicy = AuthFailureSkip
+
+		q, err := NewWithSettings(settings)
+		require.NoError(t, err)
+
+		var r entry.Record
+		for _, i := range []int{0, 2, 3} {
+			require.True(t, q.DequeueRecord(&r))
+			require.EqualValues(t, fmt.Sprintf("msg-%d", i), r.Entry)
+			require.EqualValues(t, i, r.Position)
+		}
+		require.False(t, q.DequeueRecord(&r))
+		require.NoError(t, q.Err())
+
+		pos, err := q.Enqueue([]byte("msg-4"))
+		require.NoError(t, err)
+		require.EqualValues(t, 4, pos)
+		_ = q.Close()
+	})
+
+	t.Run("Quarantine", func(t *testing.T) {
+		prepare(t)
+
+		settings := settings
+		settings.AuthFailurePolicy = AuthFailureQuarantine
+
+		q, err := NewWithSettings(settings)
+		require.NoError(t, err)
+
+		var r entry.Record
+		for _, i := range []int{0, 2, 3} {
+			require.True(t, q.DequeueRecord(&r))
+			require.EqualValues(t, fmt.Sprintf("msg-%d", i), r.Entry)
+			require.EqualValues(t, i, r.Position)
+		}
+		require.False(t, q.DequeueRecord(&r))
+		require.NoError(t, q.Err())
+		_ = q.Close()
+
+		quarantined, err := os.ReadDir(filepath.Join(dataDir, quarantineDirName))
+		require.NoError(t, err)
+		require.Len(t, quarantined, 2) // segment and its offset tracker
+	})
+
+	// segment file of plain EntryV1 is dropped into data directory
+	forge := func(t *testing.T) {
+		_ = os.RemoveAll(dataDir)
+		require.NoError(t, os.MkdirAll(dataDir, 0o777))
+
+		q, err := NewWithSettings(settings)
+		require.NoError(t, err)
+		for i := 0; i < 4; i++ {
+			_, err = q.Enqueue([]byte(fmt.Sprintf("msg-%d", i)))
+			require.NoError(t, err)
+		}
+		_ = q.Close()
+
+		payload := []byte("forged")
+		data := make([]byte, 16, 16+len(payload)) // [Segment Format][Entry Format][Length][Checksum]
+		common.Endianese.PutUint32(data[0:], common.SegmentV1)
+		common.Endianese.PutUint32(data[4:], common.EntryV1)
+		common.Endianese.PutUint32(data[8:], uint32(len(payload)))
+		common.Endianese.PutUint32(data[12:], crc32.ChecksumIEEE(payload))
+		data = append(data, payload...)
+		require.NoError(t, os.WriteFile(filepath.Join(dataDir, "seg_00000000000000000099_4"), data, 0o644))
+	}
+
+	policies := map[string]AuthFailurePolicy{
+		"Error":      AuthFailureError,
+		"Skip":       AuthFailureSkip,
+		"Quarantine": AuthFailureQuarantine,
+	}
+	for name, policy := range policies {
+		policy := policy
+		t.Run("ForgedSegment"+name, func(t *testing.T) {
+			forge(t)
+
+			settings := settings
+			settings.AuthFailurePolicy = policy
+
+			q, err := NewWithSettings(settings)
+			require.NoError(t, err)
+
+			pos, err := q.Enqueue([]byte("msg-4"))
+			require.NoError(t, err)
+			require.EqualValues(t, 4, pos)
+
+			var r entry.Record
+			for i := 0; i < 4; i++ {
+				require.True(t, q.DequeueRecord(&r))
+				require.EqualValues(t, fmt.Sprintf("msg-%d", i), r.Entry)
+			}
+
+			if policy == AuthFailureError {
+				for i := 0; i < 2; i++ {
+					require.False(t, q.DequeueRecord(&r))
+					require.Equal(t, common.ErrEntryAuthentication, q.Err())
+				}
+				_ = q.Close()
+
+				_, err = os.Stat(filepath.Join(dataDir, "seg_00000000000000000099_4"))
+				require.NoError(t, err)
+				return
+			}
+
+			require.True(t, q.DequeueRecord(&r))
+			require.EqualValues(t, "msg-4", r.Entry)
+			require.EqualValues(t, 4, r.Position)
+			require.False(t, q.DequeueRecord(&r))
+			require.NoError(t, q.Err())
+			_ = q.Close()
+
+			_, err = os.Stat(filepath.Join(dataDir, "seg_00000000000000000099_4"))
+			require.True(t, os.IsNotExist(err))
+
+			quarantined, err := os.ReadDir(filepath.Join(dataDir, quarantineDirName))
+			if policy == AuthFailureQuarantine {
+				require.NoError(t, err)
+				require.Len(t, quarantined, 1)
+			} else {
+				require.True(t, os.IsNotExist(err))
+			}
+		})
+	}
+}
+
+func TestQueueChecksumFormats(t *testing.T) {
+	dataDir := filepath.Join(tmpDir, "pqueue_checksum")
+	_ = os.RemoveAll(dataDir)
+	err := os.MkdirAll(dataDir, 0o777)
+	require.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(dataDir)
+	}()
+
+	// every segment keeps its own format
+	formats := []common.EntryFormat{common.EntryV1, common.EntryV5, common.EntryV6, common.EntryV2}
+	for i, format := range formats {
+		q, err := NewWithSettings(QueueSettings{
+			DataDir:              dataDir,
+			EntryFormat:          format,
+			MaxEntriesPerSegment: 2,
+		})
+		require.NoError(t, err)
+
+		_, err = q.Enqueue([]byte{byte(i)})
+		require.NoError(t, err)
+		_ = q.Close()
+	}
+
+	q, err := NewWithSettings(QueueSettings{
+		DataDir:              dataDir,
+		EntryFormat:          common.EntryV5,
+		MaxEntriesPerSegment: 2,
+	})
+	require.NoError(t, err)
+
+	var r entry.Record
+	for i := range formats {
+		require.True(t, q.DequeueRecord(&r))
+		require.EqualValues(t, []byte{byte(i)}, r.Entry)
+		require.EqualValues(t, i, r.Position)
+	}
+	require.False(t, q.DequeueRecord(&r))
+	_ = q.Close()
+}
+
+func TestQueueCompactFormat(t *testing.T) {
+	dataDir := filepath.Join(tmpDir, "pqueue_compact")
+	defer func() {
+		_ = os.RemoveAll(dataDir)
+	}()
+
+	settings := QueueSettings{
+		DataDir:              dataDir,
+		EntryFormat:          common.EntryV7,
+		MaxEntriesPerSegment: 20,
+	}
+
+	for _, noChecksum := range []bool{false, true} {
+		settings.NoBlockChecksum = noChecksum
+		_ = os.RemoveAll(dataDir)
+		require.NoError(t, os.MkdirAll(dataDir, 0o777))
+
+		q, err := NewWithSettings(settings)
+		require.NoError(t, err)
+
+		_, err = q.EnqueueReader(bytes.NewReader([]byte{1}), 1)
+		require.Equal(t, common.ErrEntryUnsupportedFormat, err)
+
+		b := entry.NewBatch(10)
+		for i := 0; i < 10; i++ {
+			b.Append(bytes.Repeat([]byte{byte(i)}, 16))
+		}
+		_, err = q.Enqueue(bytes.Repeat([]byte{0xff}, 16))
+		require.NoError(t, err)
+		pos, err := q.EnqueueBatch(b)
+		require.NoError(t, err)
+		require.EqualValues(t, 1, pos)
+
+		// framing of batch is shared
+		files, err := loadFileInfos(vfs.OS, dataDir)
+		require.NoError(t, err)
+		info, err := os.Stat(files[len(files)-1].path)
+		require.NoError(t, err)
+		if noChecksum {
+			require.EqualValues(t, 8+(2+16)+(1+10*17), info.Size())
+		} else {
+			require.EqualValues(t, 8+(2+16+4)+(1+10*17+4), info.Size())
+		}
+
+		var r entry.Record
+		for i := 0; i < 4; i++ {
+			require.True(t, q.DequeueRecord(&r))
+			require.EqualValues(t, i, r.Position)
+		}
+		_ = q.Close()
+
+		// continue in the middle of block
+		q, err = NewWithSettings(settings)
+		require.NoError(t, err)
+
+		for i := 3; i < 10; i++ {
+			require.True(t, q.DequeueRecord(&r))
+			require.EqualValues(t, i+1, r.Position)
+			require.EqualValues(t, bytes.Repeat([]byte{byte(i)}, 16), r.Entry)
+		}
+		require.False(t, q.DequeueRecord(&r))
+		_ = q.Close()
+	}
+}
+
+func TestQueueMaxBytesPerSegment(t *testing.T) {
+	dataDir := filepath.Join(tmpDir, "pqueue_max_bytes")
+	_ = os.RemoveAll(dataDir)
+	err := os.MkdirAll(dataDir, 0o777)
+	require.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(dataDir)
+	}()
+
+	q, err := NewWithSettings(QueueSettings{
+		DataDir:            dataDir,
+		MaxBytesPerSegment: 1000,
+	})
+	require.NoError(t, err)
+
+	// [Segment Format][Entry Format] + 8 * [Length][Checksum][Entry]
+	for i := 0; i < 8; i++ {
+		_, err = q.Enqueue(bytes.Repeat([]byte{byte(i)}, 100))
+		require.NoError(t, err)
+	}
+
+	// batch rolls over as a whole
+	b := entry.NewBatch(5)
+	for i := 8; i < 13; i++ {
+		b.Append(bytes.Repeat([]byte{byte(i)}, 100))
+	}
+	pos, err := q.EnqueueBatch(b)
+	require.NoError(t, err)
+	require.EqualValues(t, 8, pos)
+
+	// bigger than limitation
+	_, err = q.Enqueue(bytes.Repeat([]byte{13}, 2000))
+	require.NoError(t, err)
+
+	files, err := loadFileInfos(vfs.OS, dataDir)
+	require.NoError(t, err)
+	require.Len(t, files, 3)
+
+	var sizes []int64
+	for _, f := range files[:2] {
+		info, err := os.Stat(f.path)
+		require.NoError(t, err)
+		sizes = append(sizes, info.Size())
+	}
+	require.Equal(t, []int64{8 + 8*108 + 8, 8 + 5*108 + 8}, sizes) // sealed with ending
+
+	var e entry.Entry
+	for i := 0; i < 13; i++ {
+		require.True(t, q.Dequeue(&e))
+		require.EqualValues(t, bytes.Repeat([]byte{byte(i)}, 100), e)
+	}
+	require.True(t, q.Dequeue(&e))
+	require.Len(t, e, 2000)
+	require.False(t, q.Dequeue(&e))
+	_ = q.Close()
+}
+
+func TestQueuePreallocate(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("preallocation is supported on Linux only")
+	}
+
+	dataDir := filepath.Join(tmpDir, "pqueue_preallocate")
+	crashDir := filepath.Join(tmpDir, "pqueue_preallocate_crash")
+	for _, dir := range []string{dataDir, crashDir} {
+		_ = os.RemoveAll(dir)
+		require.NoError(t, os.MkdirAll(dir, 0o777))
+		defer func(dir string) {
+			_ = os.RemoveAll(dir)
+		}(dir)
+	}
+
+	settings := QueueSettings{
+		DataDir:            dataDir,
+		MaxBytesPerSegment: 1000,
+		Preallocate:        true,
+	}
+	q, err := NewWithSettings(settings)
+	require.NoError(t, err)
+
+	// zeros behind entries are not taken as ending of writable segment
+	var e entry.Entry
+	for i := 0; i < 10; i++ {
+		_, err = q.Enqueue(bytes.Repeat([]byte{byte(i)}, 100))
+		require.NoError(t, err)
+		require.True(t, q.Dequeue(&e))
+		require.EqualValues(t, bytes.Repeat([]byte{byte(i)}, 100), e)
+	}
+	for i := 10; i < 13; i++ {
+		_, err = q.Enqueue(bytes.Repeat([]byte{byte(i)}, 100))
+		require.NoError(t, err)
+	}
+
+	files, err := loadFileInfos(vfs.OS, dataDir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	info, err := os.Stat(files[0].path)
+	require.NoError(t, err)
+	require.EqualValues(t, 4+1000, info.Size())
+
+	// crashed while segment is preallocated
+	data, err := os.ReadFile(files[0].path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(crashDir, filepath.Base(files[0].path)), data, 0o644))
+
+	// unused space is truncated once sealed
+	_ = q.Close()
+	info, err = os.Stat(files[0].path)
+	require.NoError(t, err)
+	require.EqualValues(t, 8+4*108+8, info.Size())
+
+	// zeros look like ending, not corruption
+	settings.DataDir = crashDir
+	q, err = NewWithSettings(settings)
+	require.NoError(t, err)
+	for i := 9; i < 13; i++ {
+		require.True(t, q.Dequeue(&e))
+		require.EqualValues(t, bytes.Repeat([]byte{byte(i)}, 100), e)
+	}
+	require.False(t, q.Dequeue(&e))
+	_, err = os.Stat(filepath.Join(crashDir, quarantineDirName))
+	require.True(t, os.IsNotExist(err))
+	_ = q.Close()
+}
+
+func TestQueueDirectIO(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("direct I/O is supported on Linux only")
+	}
+
+	dataDir := filepath.Join(tmpDir, "pqueue_direct_io")
+	crashDir := filepath.Join(tmpDir, "pqueue_direct_io_crash")
+	for _, dir := range []string{dataDir, crashDir} {
+		_ = os.RemoveAll(dir)
+		require.NoError(t, os.MkdirAll(dir, 0o777))
+		defer func(dir string) {
+			_ = os.RemoveAll(dir)
+		}(dir)
+	}
+
+	settings := QueueSettings{
+		DataDir:              dataDir,
+		MaxEntriesPerSegment: 100,
+		DirectIO:             true,
+	}
+	q, err := NewWithSettings(settings)
+	require.NoError(t, err)
+
+	// the last block is rewritten along with following entries
+	var e entry.Entry
+	for i := 0; i < 10; i++ {
+		require.NoError(t, enqueue(q, bytes.Repeat([]byte{byte(i)}, 100)))
+		require.True(t, q.Dequeue(&e))
+		require.EqualValues(t, bytes.Repeat([]byte{byte(i)}, 100), e)
+	}
+
+	// larger than buffer of writer
+	large := bytes.Repeat([]byte{0xab}, directBufferSize+100)
+	require.NoError(t, enqueue(q, large))
+	require.True(t, q.Dequeue(&e))
+	require.Equal(t, large, []byte(e))
+
+	files, err := loadFileInfos(vfs.OS, dataDir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	info, err := os.Stat(files[0].path)
+	require.NoError(t, err)
+	require.Zero(t, info.Size()%directBlockSize) // padded
+
+	// crashed while the last block is padded
+	data, err := os.ReadFile(files[0].path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(crashDir, filepath.Base(files[0].path)), data, 0o644))
+
+	// padding is truncated once sealed
+	_ = q.Close()
+	info, err = os.Stat(files[0].path)
+	require.NoError(t, err)
+	require.EqualValues(t, 8+10*108+8+len(large)+8, info.Size())
+
+	// padding looks like ending, not corruption
+	settings.DataDir = crashDir
+	q, err = NewWithSettings(settings)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		require.True(t, q.Dequeue(&e))
+		require.EqualValues(t, bytes.Repeat([]byte{byte(i)}, 100), e)
+	}
+	require.True(t, q.Dequeue(&e))
+	require.Equal(t, large, []byte(e))
+	require.False(t, q.Dequeue(&e))
+	_, err = os.Stat(filepath.Join(crashDir, quarantineDirName))
+	require.True(t, os.IsNotExist(err))
+	_ = q.Close()
+}
+
+func TestQueueMaxSegmentAge(t *testing.T) {
+	dataDir := filepath.Join(tmpDir, "pqueue_max_age")
+	_ = os.RemoveAll(dataDir)
+	err := os.MkdirAll(dataDir, 0o777)
+	require.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(dataDir)
+	}()
+
+	t.Run("Rotate", func(t *testing.T) {
+		q, err := NewWithSettings(QueueSettings{
+			DataDir:       dataDir,
+			MaxSegmentAge: time.Hour,
+		})
+		require.NoError(t, err)
+		defer func() {
+			_ = q.Close()
+		}()
+		qu := q.(*queue)
+
+		// empty tail is not sealed
+		now := time.Now()
+		require.Equal(t, time.Hour, qu.rotate(now.Add(2*time.Hour), time.Hour))
+
+		require.NoError(t, enqueue(q, []byte{1}))
+		next := qu.rotate(now.Add(30*time.Minute), time.Hour)
+		require.True(t, next > 0 && next <= 30*time.Minute)
+
+		require.Equal(t, time.Hour, qu.rotate(now.Add(2*time.Hour), time.Hour))
+		require.Equal(t, 1, qu.segments.Len())
+
+		// new segment is created by the next write
+		require.NoError(t, enqueue(q, []byte{2}))
+		require.Equal(t, 2, qu.segments.Len())
+
+		var e entry.Entry
+		for i := 1; i <= 2; i++ {
+			require.True(t, q.Dequeue(&e))
+			require.EqualValues(t, []byte{byte(i)}, e)
+		}
+		require.False(t, q.Dequeue(&e))
+	})
+
+	t.Run("Background", func(t *testing.T) {
+		_ = os.RemoveAll(dataDir)
+		require.NoError(t, os.MkdirAll(dataDir, 0o777))
+
+		q, err := NewWithSettings(QueueSettings{
+			DataDir:       dataDir,
+			MaxSegmentAge: 5 * time.Millisecond,
+		})
+		require.NoError(t, err)
+		defer func() {
+			_ = q.Close()
+		}()
+
+		require.NoError(t, enqueue(q, []byte{1}))
+
+		// sealed without further enqueuing
+		tail := q.(*queue).segments.Back().Value.(*segment)
+		require.Eventually(t, func() bool {
+			info, err := os.Stat(tail.path)
+			return err == nil && info.Size() == 4+4+8+1+8
+		}, time.Second, 5*time.Millisecond)
+
+		require.NoError(t, enqueue(q, []byte{2}))
+
+		var e entry.Entry
+		for i := 1; i <= 2; i++ {
+			require.True(t, q.Dequeue(&e))
+			require.EqualValues(t, []byte{byte(i)}, e)
+		}
+	})
+}
+
+func TestQueueSegmentV2(t *testing.T) {
+	dataDir := filepath.Join(tmpDir, "pqueue_segment_v2")
+	_ = os.RemoveAll(dataDir)
+	err := os.MkdirAll(dataDir, 0o777)
+	require.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(dataDir)
+	}()
+
+	settings := QueueSettings{
+		DataDir:              dataDir,
+		SegmentFormat:        common.SegmentV2,
+		EntryFormat:          common.EntryV2,
+		MaxEntriesPerSegment: 500,
+	}
+
+	// foreign file
+	foreign := append([]byte{0, 0, 0, byte(common.SegmentV2)}, "not a segment at all, whose header is long enough"...)
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "seg_0_0"), foreign, 0o644))
+
+	q, err := NewWithSettings(settings)
+	require.NoError(t, err)
+	for i := 0; i < 1200; i++ {
+		require.NoError(t, enqueue(q, []byte(strconv.Itoa(i))))
+	}
+	_ = q.Close()
+
+	files, err := loadFileInfos(vfs.OS, dataDir)
+	require.NoError(t, err)
+	require.Len(t, files, 4)
+	files = files[1:]
+
+	// entries are counted by footer
+	q, err = NewWithSettings(settings)
+	require.NoError(t, err)
+	qu := q.(*queue)
+	count, err := qu.scanEntries(&segment{path: files[2].path}, nil)
+	require.NoError(t, err)
+	require.EqualValues(t, 200, count)
+	require.EqualValues(t, 1200, qu.nextPos)
+
+	footer, err := qu.readFooter(files[0].path)
+	require.NoError(t, err)
+	require.EqualValues(t, 500, footer.Entries)
+	require.Len(t, footer.Index, 7)
+
+	// foreign file is dropped
+	var r entry.Record
+	require.True(t, q.DequeueRecord(&r))
+	require.EqualValues(t, 0, r.Position)
+
+	// seeking by index
+	for _, pos := range []uint64{3, 128, 700, 1199} {
+		require.NoError(t, q.SeekToPosition(pos))
+		require.True(t, q.DequeueRecord(&r))
+		require.Equal(t, pos, r.Position)
+		require.EqualValues(t, strconv.Itoa(int(pos)), r.Entry)
+	}
+	require.False(t, q.DequeueRecord(&r))
+	_ = q.Close()
+}
+
+func TestQueueSegmentV3(t *testing.T) {
+	dataDir := filepath.Join(tmpDir, "pqueue_segment_v3")
+	_ = os.RemoveAll(dataDir)
+	err := os.MkdirAll(dataDir, 0o777)
+	require.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(dataDir)
+	}()
+
+	settings := QueueSettings{
+		DataDir:            dataDir,
+		SegmentFormat:      common.SegmentV3,
+		EntryFormat:        common.EntryV1,
+		MaxBytesPerSegment: 4096,
+	}
+
+	// compression is not supported
+	codec, err := entry.NewFlateCodec(flate.BestSpeed)
+	require.NoError(t, err)
+	_, err = NewWithSettings(QueueSettings{
+		DataDir:       dataDir,
+		SegmentFormat: common.SegmentV3,
+		EntryFormat:   common.EntryV1,
+		Codec:         codec,
+	})
+	require.ErrorIs(t, err, common.ErrEntryUnsupportedFormat)
+
+	q, err := NewWithSettings(settings)
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, enqueue(q, []byte(strconv.Itoa(i))))
+	}
+	_, err = q.Enqueue(make([]byte, 4096))
+	require.ErrorIs(t, err, common.ErrEntryTooBig)
+	_ = q.Close()
+
+	// files are preallocated
+	files, err := loadFileInfos(vfs.OS, dataDir)
+	require.NoError(t, err)
+	require.Greater(t, len(files), 2)
+	for i := range files {
+		info, err := os.Stat(files[i].path)
+		require.NoError(t, err)
+		require.EqualValues(t, 4096, info.Size())
+	}
+
+	q, err = NewWithSettings(settings)
+	require.NoError(t, err)
+	require.EqualValues(t, 1000, q.(*queue).nextPos)
+
+	var e entry.Entry
+	for i := 0; i < 500; i++ {
+		require.True(t, q.Dequeue(&e))
+		require.EqualValues(t, strconv.Itoa(i), e)
+	}
+
+	var r entry.Record
+	require.NoError(t, q.SeekToPosition(900))
+	require.True(t, q.DequeueRecord(&r))
+	require.EqualValues(t, 900, r.Position)
+
+	// dequeued entries are copied out of mapped files
+	_ = q.Close()
+	require.EqualValues(t, "499", e)
+	require.EqualValues(t, "900", r.Entry)
+}
+
+func TestQueueTimeIndex(t *testing.T) {
+	dataDir := filepath.Join(tmpDir, "pqueue_time_index")
+	_ = os.RemoveAll(dataDir)
+	err := os.MkdirAll(dataDir, 0o777)
+	require.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(dataDir)
+	}()
+
+	q, err := NewWithSettings(QueueSettings{
+		DataDir:              dataDir,
+		EntryFormat:          common.EntryV2,
+		MaxEntriesPerSegment: 25,
+		TimeIndexInterval:    time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer func() {
+		_ = q.Close()
+	}()
+
+	var marks []time.Time
+	for i := 0; i < 40; i += 10 {
+		time.Sleep(10 * time.Millisecond)
+		marks = append(marks, time.Now())
+
+		if i == 20 {
+			b := entry.NewBatch(10)
+			for j := i; j < i+10; j++ {
+				b.Append([]byte{byte(j)})
+			}
+			_, err = q.EnqueueBatch(b)
+			require.NoError(t, err)
+			continue
+		}
+
+		for j := i; j < i+10; j++ {
+			require.NoError(t, enqueue(q, []byte{byte(j)}))
+		}
+	}
+
+	// sparse index
+	head := q.(*queue).segments.Front().Value.(*segment)
+	points, err := loadTimeIndex(vfs.OS, timeIndexFilePath(head.path))
+	require.NoError(t, err)
+	require.Less(t, len(points), 25)
+	indexed := make(map[uint64]bool)
+	for _, p := range points {
+		indexed[p.entry] = true
+	}
+	require.True(t, indexed[0] && indexed[10] && indexed[20])
+
+	var r entry.Record
+	for i, mark := range marks {
+		require.NoError(t, q.SeekToTime(mark))
+		require.True(t, q.DequeueRecord(&r))
+		require.EqualValues(t, i*10, r.Position)
+		require.EqualValues(t, []byte{byte(i * 10)}, r.Entry)
+	}
+
+	// torn record is ignored
+	head = q.(*queue).segments.Front().Value.(*segment)
+	points, err = loadTimeIndex(vfs.OS, timeIndexFilePath(head.path))
+	require.NoError(t, err)
+	require.Len(t, points, 1)
+
+	f, err := os.OpenFile(timeIndexFilePath(head.path), os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{1, 2, 3})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	loaded, err := loadTimeIndex(vfs.OS, timeIndexFilePath(head.path))
+	require.NoError(t, err)
+	require.Equal(t, points, loaded)
+}
+
+func TestQueueMemory(t *testing.T) {
+	t.Run("Rollover", func(t *testing.T) {
+		q, err := NewMemory(3)
+		require.NoError(t, err)
+		defer func() {
+			_ = q.Close()
+		}()
+
+		for i := 0; i < 6; i++ {
+			require.NoError(t, enqueue(q, []byte{byte(i)}))
+		}
+
+		b := entry.NewBatch(2)
+		b.Append([]byte{6})
+		b.Append([]byte{7})
+		pos, err := q.EnqueueBatch(b)
+		require.NoError(t, err)
+		require.EqualValues(t, 6, pos)
+
+		var lens []int
+		for node := q.(*queue).segments.Front(); node != nil; node = node.Next() {
+			seg := node.Value.(*segment)
+			require.Empty(t, seg.path)
+			lens = append(lens, int(seg.seg.Size()-4)/9)
+		}
+		require.Equal(t, []int{3, 3, 2}, lens)
+
+		var r entry.Record
+		for i := 0; i < 8; i++ {
+			require.True(t, q.DequeueRecord(&r))
+			require.EqualValues(t, i, r.Position)
+			require.EqualValues(t, []byte{byte(i)}, r.Entry)
+		}
+		require.False(t, q.DequeueRecord(&r))
+		require.Equal(t, 1, q.(*queue).segments.Len())
+	})
+
+	t.Run("MaxBytesPerSegment", func(t *testing.T) {
+		q, err := NewMemoryWithSettings(QueueSettings{
+			DataDir:            "ignored",
+			MaxBytesPerSegment: 100,
+		})
+		require.NoError(t, err)
+		defer func() {
+			_ = q.Close()
+		}()
+
+		// [Entry Format] + 4 * [Length][Checksum][Entry]
+		for i := 0; i < 10; i++ {
+			require.NoError(t, enqueue(q, make([]byte, 14)))
+		}
+		require.Equal(t, 3, q.(*queue).segments.Len())
+
+		_, err = os.Stat("ignored")
+		require.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("Stream", func(t *testing.T) {
+		q, err := NewMemoryWithSettings(QueueSettings{
+			MaxEntriesPerSegment: 2,
+			StreamChunkSize:      10,
+			DedupMaxIDs:          10,
+		})
+		require.NoError(t, err)
+		defer func() {
+			_ = q.Close()
+		}()
+
+		payload := bytes.Repeat([]byte("large"), 7)
+		_, err = q.EnqueueReader(bytes.NewReader(payload), int64(len(payload)))
+		require.NoError(t, err)
+
+		// broken reader
+		_, err = q.EnqueueReader(bytes.NewReader(payload), 100)
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+		pos, err := q.EnqueueWithID("id", []byte("small"))
+		require.NoError(t, err)
+		require.EqualValues(t, 1, pos)
+
+		pos, err = q.EnqueueWithID("id", []byte("again"))
+		require.NoError(t, err)
+		require.EqualValues(t, 1, pos)
+
+		s, ok := q.DequeueReader()
+		require.True(t, ok)
+		require.EqualValues(t, len(payload), s.Size)
+		data, err := io.ReadAll(s)
+		require.NoError(t, err)
+		require.Equal(t, payload, data)
+		require.NoError(t, s.Close())
+
+		var r entry.Record
+		require.True(t, q.DequeueRecord(&r))
+		require.EqualValues(t, "small", r.Entry)
+		require.EqualValues(t, "id", r.ID)
+		require.False(t, q.DequeueRecord(&r))
+	})
+
+	t.Run("Seek", func(t *testing.T) {
+		q, err := NewMemoryWithSettings(QueueSettings{
+			MaxEntriesPerSegment: 10,
+			TimeIndexInterval:    time.Millisecond,
+		})
+		require.NoError(t, err)
+		defer func() {
+			_ = q.Close()
+		}()
+
+		var marks []time.Time
+		for i := 0; i < 40; i++ {
+			if i%5 == 0 {
+				time.Sleep(5 * time.Millisecond)
+				marks = append(marks, time.Now())
+			}
+			require.NoError(t, enqueue(q, []byte{byte(i)}))
+		}
+
+		var r entry.Record
+		for i := 0; i < 12; i++ {
+			require.True(t, q.DequeueRecord(&r))
+		}
+		require.Equal(t, 3, q.DropHead(3))
+
+		// pending entries are replayed, consumed ones are released
+		require.NoError(t, q.SeekToPosition(10))
+		require.True(t, q.DequeueRecord(&r))
+		require.EqualValues(t, 10, r.Position)
+		require.ErrorIs(t, q.SeekToPosition(5), common.ErrSeekOutOfRange)
+
+		for i := range marks {
+			require.NoError(t, q.SeekToTime(marks[i]))
+			require.True(t, q.DequeueRecord(&r))
+			if i < 2 { // consumed segment is released
+				require.EqualValues(t, 10, r.Position)
+			} else {
+				require.EqualValues(t, i*5, r.Position)
+			}
+		}
+
+		require.NoError(t, q.Purge())
+		require.False(t, q.DequeueRecord(&r))
+		require.NoError(t, enqueue(q, []byte{40}))
+		require.True(t, q.DequeueRecord(&r))
+		require.EqualValues(t, 40, r.Position)
+	})
+}
+
+func TestQueueFS(t *testing.T) {
+	t.Run("Mem", func(t *testing.T) {
+		fs := vfs.NewMem()
+		require.NoError(t, fs.MkdirAll("/data", 0o700))
+
+		settings := QueueSettings{
+			DataDir:              "/data",
+			MaxEntriesPerSegment: 3,
+			DedupMaxIDs:          10,
+			TimeIndexInterval:    time.Millisecond,
+			FS:                   fs,
+		}
+		q, err := NewWithSettings(settings)
+		require.NoError(t, err)
+
+		for i := 0; i < 8; i++ {
+			_, err = q.EnqueueWithID(fmt.Sprint("id", i), []byte{byte(i)})
+			require.NoError(t, err)
+		}
+
+		var e entry.Entry
+		for i := 0; i < 4; i++ {
+			require.True(t, q.Dequeue(&e))
+			require.EqualValues(t, []byte{byte(i)}, e)
+		}
+
+		// data directory is used by single queue
+		_, err = NewWithSettings(settings)
+		require.ErrorIs(t, err, common.ErrFileLocked)
+		_ = q.Close()
+
+		// nothing is written to disk
+		_, err = os.Stat("/data")
+		require.True(t, os.IsNotExist(err))
+
+		names, err := fs.ReadDir("/data")
+		require.NoError(t, err)
+		require.Contains(t, names, manifestFileName)
+		require.Contains(t, names, dedupFileName)
+
+		// reopened on the same file system
+		q, err = NewWithSettings(settings)
+		require.NoError(t, err)
+		defer func() {
+			_ = q.Close()
+		}()
+
+		pos, err := q.EnqueueWithID("id7", []byte{100})
+		require.NoError(t, err)
+		require.EqualValues(t, 7, pos) // remembered
+
+		var r entry.Record
+		for i := 4; i < 8; i++ {
+			require.True(t, q.DequeueRecord(&r))
+			require.EqualValues(t, i, r.Position)
+			require.EqualValues(t, []byte{byte(i)}, r.Entry)
+		}
+		require.False(t, q.DequeueRecord(&r))
+
+		// consumed segments are removed
+		files, err := loadFileInfos(fs, "/data")
+		require.NoError(t, err)
+		require.Len(t, files, 1)
+	})
+
+	t.Run("Unsupported", func(t *testing.T) {
+		fs := vfs.NewMem()
+
+		_, err := NewWithSettings(QueueSettings{DataDir: "/", SegmentFormat: common.SegmentV3, FS: fs})
+		require.ErrorIs(t, err, common.ErrSegmentNotMappable)
+
+		_, err = NewWithSettings(QueueSettings{DataDir: "/", DirectIO: true, FS: fs})
+		require.ErrorIs(t, err, common.ErrDirectIOUnsupported)
+
+		// lock is released on failures
+		q, err := NewWithSettings(QueueSettings{DataDir: "/", FS: fs})
+		require.NoError(t, err)
+		require.NoError(t, q.Close())
+	})
+
+	t.Run("Locked", func(t *testing.T) {
+		dataDir := t.TempDir()
+
+		q, err := New(dataDir, 10)
+		require.NoError(t, err)
+
+		_, err = New(dataDir, 10)
+		require.ErrorIs(t, err, common.ErrFileLocked)
+
+		require.NoError(t, q.Close())
+		q, err = New(dataDir, 10)
+		require.NoError(t, err)
+		require.NoError(t, q.Close())
+	})
+}
+
+func TestQueueHybrid(t *testing.T) {
+	fs := vfs.NewMem()
+	require.NoError(t, fs.MkdirAll("/data", 0o700))
+
+	settings := QueueSettings{
+		DataDir:              "/data",
+		SegmentFormat:        common.SegmentV2,
+		EntryFormat:          common.EntryV2,
+		MaxEntriesPerSegment: 2, // spilled files take a whole buffer
+		MemoryBuffer:         3,
+		StreamChunkSize:      10,
+		DedupMaxIDs:          100,
+		FS:                   fs,
+	}
+
+	// crash drops queue without closing it
+	crash := func(q Queue) {
+		require.NoError(t, q.(*queue).lock.Close())
+	}
+
+	segmentFiles := func() (bases []uint64) {
+		files, err := loadFileInfos(fs, "/data")
+		require.NoError(t, err)
+		for _, f := range files {
+			bases = append(bases, f.base)
+		}
+		return
+	}
+
+	payload := bytes.Repeat([]byte("large"), 7)
+	expect := func(q Queue, from, to int) {
+		var r entry.Record
+		for i := from; i < to; i++ {
+			require.True(t, q.DequeueRecord(&r))
+			require.EqualValues(t, i, r.Position)
+			if i == 4 {
+				require.Equal(t, payload, []byte(r.Entry))
+			} else {
+				require.EqualValues(t, []byte{byte(i)}, r.Entry)
+				require.EqualValues(t, fmt.Sprint("id", i), r.ID)
+			}
+		}
+	}
+
+	q, err := NewWithSettings(settings)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		if i == 4 {
+			_, err = q.EnqueueReader(bytes.NewReader(payload), int64(len(payload)))
+		} else {
+			_, err = q.EnqueueWithID(fmt.Sprint("id", i), []byte{byte(i)})
+		}
+		require.NoError(t, err)
+	}
+
+	// full buffers are spilled, except head one which might be read
+	require.Equal(t, []uint64{3, 6}, segmentFiles())
+	require.Equal(t, 4, q.(*queue).segments.Len())
+
+	expect(q, 0, 2)
+	var e entry.Entry
+	require.True(t, q.Peek(&e))
+	require.EqualValues(t, []byte{2}, e)
+
+	// consumed entries are not spilled, files are in order of entries
+	require.NoError(t, q.Flush())
+	require.Equal(t, []uint64{2, 3, 6, 9}, segmentFiles())
+
+	_, err = q.EnqueueWithID("id10", []byte{10})
+	require.NoError(t, err)
+	crash(q)
+
+	// flushed entries survive crash, buffered one is lost along with its ID
+	q, err = NewWithSettings(settings)
+	require.NoError(t, err)
+	expect(q, 2, 5)
+
+	pos, err := q.EnqueueWithID("id10", []byte{10})
+	require.NoError(t, err)
+	require.EqualValues(t, 10, pos)
+	pos, err = q.EnqueueWithID("id9", []byte{9})
+	require.NoError(t, err)
+	require.EqualValues(t, 9, pos)
+	require.NoError(t, q.Close())
+
+	// buffered entries are spilled on closing
+	q, err = NewWithSettings(settings)
+	require.NoError(t, err)
+	defer func() {
+		_ = q.Close()
+	}()
+	expect(q, 5, 11)
+	require.False(t, q.Dequeue(&e))
+
+	// large entries could not be spilled into segments of EntryV1
+	q2, err := NewWithSettings(QueueSettings{DataDir: "/", EntryFormat: common.EntryV1, MemoryBuffer: 3, FS: fs})
+	require.NoError(t, err)
+	_, err = q2.EnqueueReader(bytes.NewReader(payload), int64(len(payload)))
+	require.ErrorIs(t, err, common.ErrEntryUnsupportedFormat)
+	require.NoError(t, q2.Close())
+}
+
+func TestQueueArchive(t *testing.T) {
+	run := func(t *testing.T, codec entry.Codec) {
+		fs := vfs.NewMem()
+		require.NoError(t, fs.MkdirAll("/data", 0o700))
+
+		settings := QueueSettings{
+			DataDir:              "/data",
+			SegmentFormat:        common.SegmentV2,
+			EntryFormat:          common.EntryV2,
+			MaxEntriesPerSegment: 2,
+			TimeIndexInterval:    time.Nanosecond,
+			ArchiveDir:           "/archive",
+			ArchiveHotSegments:   2,
+			ArchiveCodec:         codec,
+			FS:                   fs,
+		}
+
+		segmentFiles := func(dir string) (bases []uint64) {
+			files, err := loadFileInfos(fs, dir)
+			require.NoError(t, err)
+			for _, f := range files {
+				bases = append(bases, f.base)
+			}
+			return
+		}
+
+		q, err := NewWithSettings(settings)
+		require.NoError(t, err)
+		for i := 0; i < 10; i++ {
+			_, err = q.Enqueue([]byte{byte(i)})
+			require.NoError(t, err)
+		}
+
+		// hot window and the last segment file are kept
+		q.(*queue).archiveSegments()
+		require.Equal(t, []uint64{4, 6}, segmentFiles("/archive"))
+		require.Equal(t, []uint64{0, 2, 8}, segmentFiles("/data"))
+
+		files, err := loadFileInfos(fs, "/archive")
+		require.NoError(t, err)
+		data, err := vfs.ReadFile(fs, files[0].path)
+		require.NoError(t, err)
+		require.Equal(t, codec != nil, bytes.HasPrefix(data, []byte(archiveMagic)))
+		_, err = fs.Stat(timeIndexFilePath(files[0].path))
+		require.NoError(t, err)
+		_ = q.Close()
+
+		// archived segments are recorded by manifest
+		m := newManifest(fs, filepath.Join("/data", manifestFileName))
+		require.NoError(t, m.load())
+		var archived []uint64
+		for _, rec := range m.records {
+			if rec.archived {
+				archived = append(archived, rec.base)
+			}
+		}
+		require.Equal(t, []uint64{4, 6}, archived)
+
+		noArchive := settings
+		noArchive.ArchiveDir = ""
+		_, err = NewWithSettings(noArchive)
+		require.ErrorIs(t, err, common.ErrArchiveDirRequired)
+
+		// archived segments are restored once consumer reaches them
+		q, err = NewWithSettings(settings)
+		require.NoError(t, err)
+		defer func() {
+			_ = q.Close()
+		}()
+
+		var r entry.Record
+		for i := 0; i < 10; i++ {
+			require.True(t, q.DequeueRecord(&r))
+			require.EqualValues(t, i, r.Position)
+			require.EqualValues(t, []byte{byte(i)}, r.Entry)
+		}
+		require.False(t, q.DequeueRecord(&r))
+		require.NoError(t, q.Err())
+		require.Empty(t, segmentFiles("/archive"))
+	}
+
+	t.Run("Plain", func(t *testing.T) {
+		run(t, nil)
+	})
+
+	codec, err := entry.NewFlateCodec(flate.BestSpeed)
+	require.NoError(t, err)
+
+	t.Run("Compressed", func(t *testing.T) {
+		run(t, codec)
+	})
+
+	t.Run("Corrupted", func(t *testing.T) {
+		fs := vfs.NewMem()
+		f, err := fs.OpenFile("/seg", os.O_CREATE|os.O_WRONLY, 0o600)
+		require.NoError(t, err)
+		_, err = f.Write(bytes.Repeat([]byte("segment"), 100))
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		require.NoError(t, writeArchive(fs, "/seg", "/archive", codec))
+
+		require.NoError(t, readArchive(fs, "/archive", "/restored"))
+		restored, err := vfs.ReadFile(fs, "/restored")
+		require.NoError(t, err)
+		require.Equal(t, bytes.Repeat([]byte("segment"), 100), restored)
+
+		data, err := vfs.ReadFile(fs, "/archive")
+		require.NoError(t, err)
+
+		corrupt := func(data []byte) {
+			f, err := fs.OpenFile("/archive", os.O_WRONLY|os.O_TRUNC, 0o600)
+			require.NoError(t, err)
+			_, err = f.Write(data)
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+			require.ErrorIs(t, readArchive(fs, "/archive", "/restored"), common.ErrArchiveCorrupted)
+		}
+
+		// truncated payload
+		corrupt(data[:len(data)-2])
+
+		data[archiveHeaderSize-1]++ // checksum
+		corrupt(data)
+	})
+}
@@ -0,0 +1,141 @@
+// Package segmenttest implements tests shared by segment implementations.
+package segmenttest
+
+import (
+	"io"
+	"testing"
+
+	"github.com/linxGnu/pqueue/common"
+	"github.com/linxGnu/pqueue/entry"
+	"github.com/linxGnu/pqueue/segment"
+
+	"github.com/stretchr/testify/require"
+)
+
+// NewSegment creates writable segment of common.EntryV1 format, taking up to maxEntries, along
+// with source for reading it from the beginning of its file.
+type NewSegment func(t *testing.T, maxEntries uint32) (segment.Segment, io.ReadSeekCloser)
+
+// Run runs shared tests against segments created by newSegment.
+func Run(t *testing.T, newSegment NewSegment) {
+	t.Run("Happy", func(t *testing.T) {
+		s, source := newSegment(t, 2)
+		defer func() { _ = s.Close() }()
+
+		// reading
+		n, err := s.Reading(source)
+		require.NoError(t, err)
+		require.Equal(t, 4, n)
+
+		code, err := s.WriteEntry([]byte{})
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+
+		code, err = s.WriteEntry([]byte("alpha"))
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+
+		var e entry.Entry
+		code, n, err = s.ReadEntry(&e)
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+		require.Equal(t, "alpha", string(e))
+		require.Equal(t, 13, n)
+
+		code, n, err = s.ReadEntry(&e)
+		require.NoError(t, err)
+		require.Equal(t, common.SegmentNoMoreReadWeak, code)
+		require.Equal(t, 0, n)
+
+		code, err = s.WriteEntry([]byte("beta"))
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+
+		code, n, err = s.ReadEntry(&e)
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+		require.Equal(t, "beta", string(e))
+		require.Equal(t, 12, n)
+
+		code, err = s.WriteEntry([]byte("gamma"))
+		require.NoError(t, err)
+		require.Equal(t, common.SegmentNoMoreWrite, code)
+
+		code, n, err = s.ReadEntry(&e)
+		require.NoError(t, err)
+		require.Equal(t, common.SegmentNoMoreReadStrong, code)
+		require.Equal(t, 0, n)
+	})
+
+	t.Run("HappyBatch", func(t *testing.T) {
+		s, source := newSegment(t, 2)
+		defer func() { _ = s.Close() }()
+
+		// reading
+		n, err := s.Reading(source)
+		require.NoError(t, err)
+		require.Equal(t, 4, n)
+
+		b := entry.NewBatch(3)
+		b.Append([]byte("alpha"))
+		b.Append([]byte("beta"))
+		b.Append([]byte("gama"))
+
+		code, err := s.WriteBatch(b)
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+
+		var e entry.Entry
+		code, n, err = s.ReadEntry(&e)
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+		require.Equal(t, "alpha", string(e))
+		require.Equal(t, 13, n)
+
+		code, n, err = s.ReadEntry(&e)
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+		require.Equal(t, "beta", string(e))
+		require.Equal(t, 12, n)
+
+		code, n, err = s.ReadEntry(&e)
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+		require.Equal(t, "gama", string(e))
+		require.Equal(t, 12, n)
+
+		code, n, err = s.ReadEntry(&e)
+		require.NoError(t, err)
+		require.Equal(t, common.SegmentNoMoreReadStrong, code)
+		require.Equal(t, 0, n)
+	})
+
+	t.Run("Seal", func(t *testing.T) {
+		s, source := newSegment(t, 100)
+		defer func() { _ = s.Close() }()
+
+		_, err := s.Reading(source)
+		require.NoError(t, err)
+
+		// empty segment is kept writable
+		s.Seal()
+		code, err := s.WriteEntry([]byte{1, 2})
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+
+		s.Seal()
+		s.Seal()
+		code, err = s.WriteEntry([]byte{3})
+		require.NoError(t, err)
+		require.Equal(t, common.SegmentNoMoreWrite, code)
+
+		var e entry.Entry
+		code, _, err = s.ReadEntry(&e)
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+		require.EqualValues(t, []byte{1, 2}, e)
+
+		code, _, _ = s.ReadEntry(&e)
+		require.Equal(t, common.SegmentNoMoreReadStrong, code)
+	})
+}
@@ -0,0 +1,285 @@
+package segmem
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/linxGnu/pqueue/common"
+	"github.com/linxGnu/pqueue/entry"
+)
+
+const (
+	// HeaderSize is size of entry format header, which segment is accounted with as if it was
+	// file-backed.
+	HeaderSize = 4
+
+	// [Length - uint32][Checksum - uint32] of EntryV1
+	entryHeaderSize = 8
+)
+
+var errInvalidOffset = fmt.Errorf("offset is not at boundary of entries")
+
+// record is an entry, or a chunk of large entry, kept in memory.
+type record struct {
+	e      entry.Entry
+	id     []byte
+	chunk  entry.Chunk
+	offset int64 // offset of record inside segment
+}
+
+// Segment represents a portion (segment) of a non-durable queue, whose entries are kept in memory.
+//
+// Entries are accounted as if they were written with EntryV1 format, so that size limit and read
+// offsets behave as file-backed segments. Metadata and large entries are supported regardless.
+type Segment struct {
+	mu      sync.RWMutex
+	records []record // guarded by mu, entries are appended as a whole
+
+	roff int // index of next read record
+
+	numEntries uint32 // updated under mu
+	maxEntries uint32
+	maxBytes   int64  // zero means no limit
+	written    int64  // updated under mu
+	sealed     uint32 // set when no more entries would be written
+	rotated    bool   // sealed by Seal, rejects upcoming entries
+}
+
+// Settings of segment.
+type Settings struct {
+	MaxEntries uint32
+
+	// MaxBytes is max size of segment. Entries which would exceed it are rejected with
+	// common.SegmentNoMoreWrite, unless segment is empty. Zero means no limit.
+	MaxBytes int64
+}
+
+// NewSegment creates segment taking at most maxEntries.
+func NewSegment(maxEntries uint32) *Segment {
+	return NewSegmentWithSettings(Settings{MaxEntries: maxEntries})
+}
+
+// NewSegmentWithSettings creates segment with custom settings.
+func NewSegmentWithSettings(settings Settings) *Segment {
+	return &Segment{
+		maxEntries: settings.MaxEntries,
+		maxBytes:   settings.MaxBytes,
+		written:    HeaderSize,
+	}
+}
+
+// Close segment, its entries are released.
+func (s *Segment) Close() error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	s.records = nil
+	s.mu.Unlock()
+	atomic.StoreUint32(&s.sealed, 1)
+	return nil
+}
+
+// Reading restarts reading from the first entry. There is no source to read from, it's ignored.
+// Returned n is HeaderSize, so that read offsets match Size.
+func (s *Segment) Reading(_ io.ReadSeekCloser) (int, error) {
+	s.roff = 0
+	return HeaderSize, nil
+}
+
+// WriteEntry to segment.
+func (s *Segment) WriteEntry(e entry.Entry) (common.ErrCode, error) {
+	return s.WriteEntryWithMeta(e, entry.Meta{})
+}
+
+// WriteEntryWithMeta writes entry along with its metadata to segment. Both are copied.
+func (s *Segment) WriteEntryWithMeta(e entry.Entry, meta entry.Meta) (common.ErrCode, error) {
+	// check entry size
+	if len(e) == 0 {
+		return common.NoError, nil
+	}
+	if len(e) > common.MaxEntrySize {
+		return common.EntryTooBig, common.ErrEntryTooBig
+	}
+	if len(meta.ID) > common.MaxEntryIDSize {
+		return common.EntryTooBig, common.ErrEntryIDTooLong
+	}
+
+	if s.full(int64(len(e) + len(meta.ID))) {
+		return common.SegmentNoMoreWrite, nil
+	}
+
+	s.append(1, record{e: clone(e), id: clone(meta.ID)})
+	return common.NoError, nil
+}
+
+// WriteBatch to segment. Entries of batch are kept one by one.
+func (s *Segment) WriteBatch(b entry.Batch) (common.ErrCode, error) {
+	// check entry size
+	if !b.ValidateSize(common.MaxEntrySize) {
+		return common.EntryTooBig, common.ErrEntryTooBig
+	}
+	if b.Len() == 0 {
+		return common.NoError, nil
+	}
+
+	if s.full(int64(b.Size())) {
+		return common.SegmentNoMoreWrite, nil
+	}
+
+	records := make([]record, b.Len())
+	for i := range records {
+		records[i].e = clone(b.Entry(i))
+	}
+	s.append(uint32(len(records)), records...)
+
+	return common.NoError, nil
+}
+
+// WriteStream writes a large entry of given size from r, chunk by chunk. Nothing is written if r fails,
+// common.EntryWriteErr is returned in this case.
+func (s *Segment) WriteStream(r io.Reader, size int64, chunkSize int, meta entry.Meta) (common.ErrCode, error) {
+	if size <= 0 {
+		return common.NoError, nil
+	}
+	if len(meta.ID) > common.MaxEntryIDSize {
+		return common.EntryTooBig, common.ErrEntryIDTooLong
+	}
+	if chunkSize <= 0 || chunkSize > common.MaxEntrySize {
+		chunkSize = common.MaxEntrySize
+	}
+
+	if s.full(size + int64(len(meta.ID))) {
+		return common.SegmentNoMoreWrite, nil
+	}
+
+	var records []record
+	for offset := int64(0); offset < size; {
+		n := int64(chunkSize)
+		if remain := size - offset; remain < n {
+			n = remain
+		}
+
+		chunk := make(entry.Entry, n)
+
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return common.EntryWriteErr, err
+		}
+
+		records = append(records, record{e: chunk, chunk: entry.Chunk{Total: size, Offset: offset}})
+		offset += int64(len(chunk))
+	}
+	records[0].id = clone(meta.ID) // stored with the first chunk only
+
+	s.append(1, records...)
+	return common.NoError, nil
+}
+
+// full returns true if segment could not take entries of given size. Segment is sealed if they
+// would exceed max bytes, so that readers know its ending.
+func (s *Segment) full(size int64) bool {
+	if s.numEntries >= s.maxEntries || s.rotated || atomic.LoadUint32(&s.sealed) == 1 {
+		return true
+	}
+
+	if s.maxBytes > 0 && s.numEntries > 0 && s.written+size > s.maxBytes {
+		atomic.StoreUint32(&s.sealed, 1)
+		return true
+	}
+
+	return false
+}
+
+// append records of given number of entries, seals segment once it's full.
+func (s *Segment) append(entries uint32, records ...record) {
+	s.mu.Lock()
+	for i := range records {
+		records[i].offset = s.written
+		s.written += int64(entryHeaderSize + len(records[i].e) + len(records[i].id))
+	}
+	s.records = append(s.records, records...)
+
+	s.numEntries += entries
+	s.mu.Unlock()
+
+	if s.numEntries >= s.maxEntries || (s.maxBytes > 0 && s.written >= s.maxBytes) {
+		atomic.StoreUint32(&s.sealed, 1)
+	}
+}
+
+// Size returns number of bytes accounted for segment, from its entry format header.
+func (s *Segment) Size() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.written
+}
+
+// Seal segment, upcoming entries are rejected with common.SegmentNoMoreWrite. It's no-op
+// if segment is empty or sealed already.
+func (s *Segment) Seal() {
+	if s.numEntries == 0 || s.rotated {
+		return
+	}
+
+	s.rotated = true
+	atomic.StoreUint32(&s.sealed, 1)
+}
+
+// ReadEntry from segment.
+func (s *Segment) ReadEntry(e *entry.Entry) (common.ErrCode, int, error) {
+	return s.ReadEntryWithMeta(e, nil)
+}
+
+// ReadEntryWithMeta reads entry along with its metadata from segment. Both are copied into
+// given buffers.
+func (s *Segment) ReadEntryWithMeta(e *entry.Entry, meta *entry.Meta) (common.ErrCode, int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.roff >= len(s.records) {
+		if atomic.LoadUint32(&s.sealed) == 1 {
+			return common.SegmentNoMoreReadStrong, 0, nil
+		}
+		return common.SegmentNoMoreReadWeak, 0, nil
+	}
+
+	rec := &s.records[s.roff]
+	s.roff++
+
+	e.CloneFrom(rec.e)
+	if meta != nil {
+		meta.ID = append(meta.ID[:0], rec.id...)
+		meta.Chunk, meta.Codec, meta.Batch = rec.chunk, 0, 0
+	}
+	return common.NoError, entryHeaderSize + len(rec.e) + len(rec.id), nil
+}
+
+// SeekToRead - offset from beginning of Segment, which must be at boundary of entries.
+func (s *Segment) SeekToRead(offset int64) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i := sort.Search(len(s.records), func(i int) bool {
+		return s.records[i].offset >= offset
+	})
+	if i == len(s.records) && offset != s.written || i < len(s.records) && s.records[i].offset != offset {
+		return errInvalidOffset
+	}
+
+	s.roff = i
+	return nil
+}
+
+func clone(b []byte) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+	return append(make([]byte, 0, len(b)), b...)
+}
@@ -0,0 +1,276 @@
+package segmem
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/linxGnu/pqueue/common"
+	"github.com/linxGnu/pqueue/entry"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSegmentReadWrite(t *testing.T) {
+	t.Run("Closing", func(t *testing.T) {
+		var s *Segment
+		require.NoError(t, s.Close())
+	})
+
+	t.Run("Happy", func(t *testing.T) {
+		s := NewSegment(2)
+		defer func() { _ = s.Close() }()
+
+		// reading
+		n, err := s.Reading(nil)
+		require.NoError(t, err)
+		require.Equal(t, HeaderSize, n)
+
+		code, err := s.WriteEntry([]byte{})
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+
+		alpha := []byte("alpha")
+		code, err = s.WriteEntry(alpha)
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+		alpha[0] = 'A' // entry is copied
+
+		var e entry.Entry
+		code, n, err = s.ReadEntry(&e)
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+		require.Equal(t, "alpha", string(e))
+		require.Equal(t, 13, n)
+
+		code, n, err = s.ReadEntry(&e)
+		require.NoError(t, err)
+		require.Equal(t, common.SegmentNoMoreReadWeak, code)
+		require.Equal(t, 0, n)
+
+		code, err = s.WriteEntryWithMeta([]byte("beta"), entry.Meta{ID: []byte("id")})
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+
+		var meta entry.Meta
+		code, n, err = s.ReadEntryWithMeta(&e, &meta)
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+		require.Equal(t, "beta", string(e))
+		require.Equal(t, "id", string(meta.ID))
+		require.Equal(t, 14, n)
+
+		code, err = s.WriteEntry([]byte("gamma"))
+		require.NoError(t, err)
+		require.Equal(t, common.SegmentNoMoreWrite, code)
+
+		code, n, err = s.ReadEntry(&e)
+		require.NoError(t, err)
+		require.Equal(t, common.SegmentNoMoreReadStrong, code)
+		require.Equal(t, 0, n)
+		require.EqualValues(t, 4+13+14, s.Size())
+
+		// seek to the second entry, then the ending
+		require.NoError(t, s.SeekToRead(17))
+		code, _, _ = s.ReadEntry(&e)
+		require.Equal(t, common.NoError, code)
+		require.Equal(t, "beta", string(e))
+
+		require.NoError(t, s.SeekToRead(31))
+		code, _, _ = s.ReadEntry(&e)
+		require.Equal(t, common.SegmentNoMoreReadStrong, code)
+
+		require.Error(t, s.SeekToRead(8))
+		require.Error(t, s.SeekToRead(32))
+
+		// read again from beginning
+		_, _ = s.Reading(nil)
+		code, _, _ = s.ReadEntry(&e)
+		require.Equal(t, common.NoError, code)
+		require.Equal(t, "alpha", string(e))
+	})
+
+	t.Run("HappyBatch", func(t *testing.T) {
+		s := NewSegment(3)
+		defer func() { _ = s.Close() }()
+
+		b := entry.NewBatch(2)
+		code, err := s.WriteBatch(b)
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+
+		b.Append([]byte{1, 2, 3})
+		b.Append([]byte{4, 5})
+		code, err = s.WriteBatch(b)
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+
+		var e entry.Entry
+		code, n, err := s.ReadEntry(&e)
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+		require.EqualValues(t, []byte{1, 2, 3}, e)
+		require.Equal(t, 11, n)
+
+		code, n, err = s.ReadEntry(&e)
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+		require.EqualValues(t, []byte{4, 5}, e)
+		require.Equal(t, 10, n)
+
+		code, _, _ = s.ReadEntry(&e)
+		require.Equal(t, common.SegmentNoMoreReadWeak, code)
+
+		code, err = s.WriteEntry([]byte{6})
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+
+		code, err = s.WriteBatch(b)
+		require.NoError(t, err)
+		require.Equal(t, common.SegmentNoMoreWrite, code)
+
+		code, _, _ = s.ReadEntry(&e)
+		require.Equal(t, common.NoError, code)
+		code, _, _ = s.ReadEntry(&e)
+		require.Equal(t, common.SegmentNoMoreReadStrong, code)
+	})
+
+	t.Run("Stream", func(t *testing.T) {
+		s := NewSegment(3)
+		defer func() { _ = s.Close() }()
+
+		payload := bytes.Repeat([]byte{1, 2, 3}, 5)
+		code, err := s.WriteStream(bytes.NewReader(payload), int64(len(payload)), 4, entry.Meta{ID: []byte("id")})
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+
+		// broken reader, nothing is written
+		code, err = s.WriteStream(bytes.NewReader(payload), 100, 4, entry.Meta{})
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		require.Equal(t, common.EntryWriteErr, code)
+
+		code, err = s.WriteStream(errReader{}, 10, 4, entry.Meta{})
+		require.Error(t, err)
+		require.Equal(t, common.EntryWriteErr, code)
+
+		var (
+			e      entry.Entry
+			meta   entry.Meta
+			joined []byte
+		)
+		for offset := int64(0); offset < int64(len(payload)); {
+			code, _, err = s.ReadEntryWithMeta(&e, &meta)
+			require.NoError(t, err)
+			require.Equal(t, common.NoError, code)
+			require.Equal(t, entry.Chunk{Total: int64(len(payload)), Offset: offset}, meta.Chunk)
+			if offset == 0 {
+				require.Equal(t, "id", string(meta.ID))
+			} else {
+				require.Empty(t, meta.ID)
+			}
+
+			joined = append(joined, e...)
+			offset += int64(len(e))
+		}
+		require.Equal(t, payload, joined)
+
+		code, _, _ = s.ReadEntry(&e)
+		require.Equal(t, common.SegmentNoMoreReadWeak, code)
+
+		code, err = s.WriteStream(nil, 0, 4, entry.Meta{})
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+	})
+
+	t.Run("TooBig", func(t *testing.T) {
+		s := NewSegment(3)
+		defer func() { _ = s.Close() }()
+
+		code, err := s.WriteEntryWithMeta([]byte{1}, entry.Meta{ID: make([]byte, common.MaxEntryIDSize+1)})
+		require.ErrorIs(t, err, common.ErrEntryIDTooLong)
+		require.Equal(t, common.EntryTooBig, code)
+
+		code, err = s.WriteStream(nil, 10, 4, entry.Meta{ID: make([]byte, common.MaxEntryIDSize+1)})
+		require.ErrorIs(t, err, common.ErrEntryIDTooLong)
+		require.Equal(t, common.EntryTooBig, code)
+	})
+
+	t.Run("MaxBytes", func(t *testing.T) {
+		s := NewSegmentWithSettings(Settings{MaxEntries: 100, MaxBytes: 45})
+
+		// [Entry Format] + 2 * [Length][Checksum][Entry]
+		for i := 0; i < 2; i++ {
+			code, err := s.WriteEntry(make([]byte, 10))
+			require.NoError(t, err)
+			require.Equal(t, common.NoError, code)
+		}
+
+		// would exceed
+		code, err := s.WriteEntry(make([]byte, 10))
+		require.NoError(t, err)
+		require.Equal(t, common.SegmentNoMoreWrite, code)
+
+		b := entry.NewBatch(2)
+		b.Append([]byte{1})
+		code, err = s.WriteBatch(b)
+		require.NoError(t, err)
+		require.Equal(t, common.SegmentNoMoreWrite, code)
+
+		var e entry.Entry
+		for i := 0; i < 2; i++ {
+			code, _, err = s.ReadEntry(&e)
+			require.NoError(t, err)
+			require.Equal(t, common.NoError, code)
+		}
+		code, _, _ = s.ReadEntry(&e)
+		require.Equal(t, common.SegmentNoMoreReadStrong, code)
+
+		// empty segment takes entry regardless of its size
+		s = NewSegmentWithSettings(Settings{MaxEntries: 100, MaxBytes: 45})
+
+		code, err = s.WriteEntry(make([]byte, 100))
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+
+		code, err = s.WriteEntry([]byte{1})
+		require.NoError(t, err)
+		require.Equal(t, common.SegmentNoMoreWrite, code)
+	})
+
+	t.Run("Seal", func(t *testing.T) {
+		s := NewSegment(100)
+
+		// empty segment is kept writable
+		s.Seal()
+		code, err := s.WriteEntry([]byte{1, 2})
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+
+		s.Seal()
+		s.Seal()
+		code, err = s.WriteEntry([]byte{3})
+		require.NoError(t, err)
+		require.Equal(t, common.SegmentNoMoreWrite, code)
+
+		var e entry.Entry
+		code, _, err = s.ReadEntry(&e)
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+		require.EqualValues(t, []byte{1, 2}, e)
+
+		code, _, _ = s.ReadEntry(&e)
+		require.Equal(t, common.SegmentNoMoreReadStrong, code)
+
+		// entries are released
+		require.NoError(t, s.Close())
+		code, _, _ = s.ReadEntry(&e)
+		require.Equal(t, common.SegmentNoMoreReadStrong, code)
+	})
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	return 0, errors.New("broken")
+}
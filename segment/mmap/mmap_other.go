@@ -0,0 +1,18 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package segmmap
+
+import "github.com/linxGnu/pqueue/common"
+
+func mmap(uintptr, int64, bool) ([]byte, error) {
+	return nil, common.ErrSegmentNotMappable
+}
+
+func munmap([]byte) error {
+	return nil
+}
+
+func msync([]byte) error {
+	return nil
+}
@@ -0,0 +1,34 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package segmmap
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+func mmap(fd uintptr, size int64, writable bool) ([]byte, error) {
+	prot := syscall.PROT_READ
+	if writable {
+		prot |= syscall.PROT_WRITE
+	}
+	return syscall.Mmap(int(fd), 0, int(size), prot, syscall.MAP_SHARED)
+}
+
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
+
+// msync flushes mapped file to disk, synchronously.
+func msync(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)), syscall.MS_SYNC)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
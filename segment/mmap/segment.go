@@ -0,0 +1,406 @@
+package segmmap
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/linxGnu/pqueue/common"
+	"github.com/linxGnu/pqueue/entry"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+const (
+	// DefaultSize is default size of segment file.
+	DefaultSize = 64 << 20
+
+	// [Length - uint32][Checksum - uint32]
+	entryHeaderSize = 8
+)
+
+var errInvalidOffset = fmt.Errorf("offset is out of mapped segment")
+
+// File is memory-mappable file, i.e *os.File.
+type File interface {
+	io.ReadWriteSeeker
+	io.Closer
+	Fd() uintptr
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+}
+
+// Segment represents a portion (segment) of a persistent queue, backed by memory-mapped file
+// of fixed size, see common.SegmentV3.
+//
+// Entries read from Segment are views into mapped file. They are valid until the next call
+// and must not be modified.
+type Segment struct {
+	readOnly bool
+
+	f      File      // writable file, nil if readonly
+	source io.Closer // reading source
+	data   []byte    // mapped file
+
+	start int64 // offset of entry format header inside file
+	woff  int64 // offset of next written entry
+	roff  int64 // offset of next read entry
+
+	offset     uint32
+	numEntries uint32
+	maxEntries uint32
+	sealed     uint32 // set when no more entries would be written
+	rotated    bool   // sealed by Seal, rejects upcoming entries
+}
+
+// NewReadOnlySegment creates new Segment for readonly. Source must be File, positioned right
+// after segment format header.
+func NewReadOnlySegment(source io.ReadSeekCloser) (*Segment, int, error) {
+	// get entry format
+	var buf [4]byte
+	n, err := io.ReadFull(source, buf[:])
+	if err != nil {
+		return nil, n, err
+	}
+	if common.Endianese.Uint32(buf[:]) != common.EntryV1 {
+		return nil, n, common.ErrEntryUnsupportedFormat
+	}
+
+	f, ok := source.(File)
+	if !ok {
+		return nil, n, common.ErrSegmentNotMappable
+	}
+
+	roff, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, n, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, n, err
+	}
+
+	data, err := mmap(f.Fd(), info.Size(), false)
+	if err != nil {
+		return nil, n, err
+	}
+
+	// ok now
+	return &Segment{
+		readOnly: true,
+		source:   source,
+		data:     data,
+		start:    roff - int64(n),
+		roff:     roff,
+	}, n, nil
+}
+
+// Settings of writable segment.
+type Settings struct {
+	EntryFormat common.EntryFormat
+	MaxEntries  uint32
+
+	// Size of segment file, which is preallocated and mapped as a whole. Entries which would
+	// exceed it are rejected with common.SegmentNoMoreWrite, or common.EntryTooBig if segment
+	// is empty. Zero means DefaultSize.
+	Size int64
+}
+
+// NewSegment from file, positioned right after segment format header.
+func NewSegment(f File, entryFormat common.EntryFormat, maxEntries uint32) (*Segment, error) {
+	return NewSegmentWithSettings(f, Settings{
+		EntryFormat: entryFormat,
+		MaxEntries:  maxEntries,
+	})
+}
+
+// NewSegmentWithSettings creates writable segment with custom settings. Only EntryV1 is supported.
+func NewSegmentWithSettings(f File, settings Settings) (*Segment, error) {
+	if settings.EntryFormat != common.EntryV1 {
+		return nil, common.ErrEntryUnsupportedFormat
+	}
+
+	size := settings.Size
+	if size <= 0 {
+		size = DefaultSize
+	}
+
+	start, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if size < start+4 {
+		_ = f.Close()
+		return nil, common.ErrSegmentTooSmall
+	}
+
+	// preallocate and map
+	if err = f.Truncate(size); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	data, err := mmap(f.Fd(), size, true)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	// write header: [EntryFormat]
+	common.Endianese.PutUint32(data[start:], settings.EntryFormat)
+
+	// ok now
+	return &Segment{
+		readOnly:   false,
+		f:          f,
+		data:       data,
+		start:      start,
+		woff:       start + 4,
+		roff:       start + 4,
+		maxEntries: settings.MaxEntries,
+	}, nil
+}
+
+// Close segment. Mapped file is flushed if writable, then unmapped.
+func (s *Segment) Close() (err error) {
+	if s == nil {
+		return
+	}
+
+	if s.data != nil {
+		if !s.readOnly {
+			err = msync(s.data)
+		}
+		err = multierror.Append(err, munmap(s.data)).ErrorOrNil()
+		s.data = nil
+	}
+	if s.f != nil {
+		err = multierror.Append(err, s.f.Close()).ErrorOrNil()
+		s.f = nil
+	}
+	if s.source != nil {
+		err = multierror.Append(err, s.source.Close()).ErrorOrNil()
+		s.source = nil
+	}
+	return
+}
+
+// Reading from source. Entries are read from mapped file of writable segment, source is closed
+// along with segment.
+func (s *Segment) Reading(source io.ReadSeekCloser) (n int, err error) {
+	// should bypass header
+	var dummy [4]byte
+	if n, err = io.ReadFull(source, dummy[:]); err == nil {
+		if s.source != nil {
+			_ = s.source.Close()
+		}
+		s.source = source
+		s.roff = s.start + 4
+		s.offset = 0
+	}
+	return
+}
+
+// WriteEntry to segment.
+func (s *Segment) WriteEntry(e entry.Entry) (common.ErrCode, error) {
+	return s.WriteEntryWithMeta(e, entry.Meta{})
+}
+
+// WriteEntryWithMeta writes entry to segment. EntryV1 does not carry metadata.
+func (s *Segment) WriteEntryWithMeta(e entry.Entry, meta entry.Meta) (common.ErrCode, error) {
+	// check entry size
+	if len(e) == 0 {
+		return common.NoError, nil
+	}
+	if len(e) > common.MaxEntrySize {
+		return common.EntryTooBig, common.ErrEntryTooBig
+	}
+	if len(meta.ID) > common.MaxEntryIDSize {
+		return common.EntryTooBig, common.ErrEntryIDTooLong
+	}
+
+	if code, err := s.reserve(entryHeaderSize + int64(len(e))); code != common.NoError {
+		return code, err
+	}
+
+	code, err := e.MarshalEncoded(s.writer(), common.EntryV1, meta, nil)
+	s.afterWrite(code, 1, entryHeaderSize+int64(len(e)))
+
+	return code, err
+}
+
+// WriteBatch to segment.
+func (s *Segment) WriteBatch(b entry.Batch) (common.ErrCode, error) {
+	// check entry size
+	if !b.ValidateSize(common.MaxEntrySize) {
+		return common.EntryTooBig, common.ErrEntryTooBig
+	}
+	if b.Len() == 0 {
+		return common.NoError, nil
+	}
+
+	size := int64(b.Len()*entryHeaderSize + b.Size())
+	if code, err := s.reserve(size); code != common.NoError {
+		return code, err
+	}
+
+	code, err := b.Marshal(s.writer(), common.EntryV1)
+	s.afterWrite(code, uint32(b.Len()), size)
+
+	return code, err
+}
+
+// WriteStream is not supported, EntryV1 does not support chunked entries.
+func (s *Segment) WriteStream(_ io.Reader, size int64, _ int, _ entry.Meta) (common.ErrCode, error) {
+	if size <= 0 {
+		return common.NoError, nil
+	}
+	return common.EntryUnsupportedFormat, common.ErrEntryUnsupportedFormat
+}
+
+// reserve checks that entries of given size fit into segment. Segment is sealed if they would
+// exceed its size, so that readers know its ending.
+func (s *Segment) reserve(size int64) (common.ErrCode, error) {
+	if s.readOnly || s.numEntries >= s.maxEntries || s.rotated || atomic.LoadUint32(&s.sealed) == 1 {
+		return common.SegmentNoMoreWrite, nil
+	}
+
+	if s.woff+size > int64(len(s.data)) {
+		if s.numEntries == 0 {
+			return common.EntryTooBig, common.ErrEntryTooBig
+		}
+
+		s.seal()
+		return common.SegmentNoMoreWrite, nil
+	}
+
+	return common.NoError, nil
+}
+
+func (s *Segment) writer() io.Writer {
+	return &mappedWriter{data: s.data[s.woff:]}
+}
+
+// afterWrite accounts written entries and seals segment once it's full or corrupted.
+func (s *Segment) afterWrite(code common.ErrCode, entries uint32, size int64) {
+	if code == common.NoError {
+		s.woff += size
+	}
+
+	if (code == common.NoError && atomic.AddUint32(&s.numEntries, entries) >= s.maxEntries) ||
+		(code == common.NoError && s.woff+entryHeaderSize >= int64(len(s.data))) ||
+		code == common.SegmentCorrupted || code == common.EntryWriteErr {
+		s.seal()
+	}
+}
+
+// seal flushes mapped file, readers know the ending of segment since then.
+func (s *Segment) seal() {
+	_ = msync(s.data)
+	atomic.StoreUint32(&s.sealed, 1)
+}
+
+// Size returns number of bytes written to segment, from its entry format header. It's zero
+// if segment is readonly.
+func (s *Segment) Size() int64 {
+	if s.readOnly {
+		return 0
+	}
+	return s.woff - s.start
+}
+
+// Seal writable segment, upcoming entries are rejected with common.SegmentNoMoreWrite. It's no-op
+// if segment is readonly, empty or sealed already.
+func (s *Segment) Seal() {
+	if s.readOnly || s.numEntries == 0 || s.rotated {
+		return
+	}
+
+	s.rotated = true
+	if atomic.LoadUint32(&s.sealed) == 0 {
+		s.seal()
+	}
+}
+
+// ReadEntry from segment. Entry is a view into mapped file, valid until the next call.
+func (s *Segment) ReadEntry(e *entry.Entry) (common.ErrCode, int, error) {
+	return s.ReadEntryWithMeta(e, nil)
+}
+
+// ReadEntryWithMeta reads entry from segment, metadata is always empty. Entry is a view into
+// mapped file, valid until the next call.
+func (s *Segment) ReadEntryWithMeta(e *entry.Entry, meta *entry.Meta) (common.ErrCode, int, error) {
+	if !s.readOnly {
+		// readable?
+		sealed := atomic.LoadUint32(&s.sealed) == 1
+		if s.offset == atomic.LoadUint32(&s.numEntries) {
+			if sealed || s.offset >= s.maxEntries {
+				return common.SegmentNoMoreReadStrong, 0, nil
+			}
+
+			return common.SegmentNoMoreReadWeak, 0, nil
+		}
+
+		s.offset++
+	}
+
+	if meta != nil {
+		*meta = entry.Meta{ID: meta.ID[:0]}
+	}
+	return s.readEntry(e)
+}
+
+func (s *Segment) readEntry(e *entry.Entry) (common.ErrCode, int, error) {
+	// entries are followed by zeros
+	if s.roff+entryHeaderSize > int64(len(s.data)) || common.Endianese.Uint32(s.data[s.roff:]) == 0 {
+		if s.readOnly || atomic.LoadUint32(&s.sealed) == 1 {
+			return common.SegmentNoMoreReadStrong, 0, nil
+		}
+		return common.SegmentNoMoreReadWeak, 0, nil
+	}
+
+	sizeAndSum := common.Endianese.Uint64(s.data[s.roff:])
+	size := int64(sizeAndSum >> 32)
+	if size > common.MaxEntrySize || s.roff+entryHeaderSize+size > int64(len(s.data)) {
+		return common.SegmentCorrupted, entryHeaderSize, common.ErrEntryTooBig
+	}
+
+	begin, end := s.roff+entryHeaderSize, s.roff+entryHeaderSize+size
+	payload := s.data[begin:end:end] // appending never writes into mapped file
+	if crc32.ChecksumIEEE(payload) != uint32(sizeAndSum) {
+		return common.SegmentCorrupted, int(end - s.roff), common.ErrEntryInvalidCheckSum
+	}
+
+	*e = payload
+	s.roff = end
+
+	return common.NoError, int(entryHeaderSize + size), nil
+}
+
+// SeekToRead - offset from beginning of Segment.
+func (s *Segment) SeekToRead(offset int64) error {
+	if offset < s.start || offset > int64(len(s.data)) {
+		return errInvalidOffset
+	}
+	s.roff = offset
+	return nil
+}
+
+// mappedWriter writes into mapped file.
+type mappedWriter struct {
+	data []byte
+}
+
+func (w *mappedWriter) Write(p []byte) (int, error) {
+	if len(p) > len(w.data) {
+		return 0, io.ErrShortWrite
+	}
+
+	n := copy(w.data, p)
+	w.data = w.data[n:]
+	return n, nil
+}
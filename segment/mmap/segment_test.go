@@ -0,0 +1,301 @@
+package segmmap
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/linxGnu/pqueue/common"
+	"github.com/linxGnu/pqueue/entry"
+	"github.com/linxGnu/pqueue/segment"
+	"github.com/linxGnu/pqueue/segment/internal/segmenttest"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newSegmentFile creates segment file along with its segment format header, returns it for
+// writing and its path.
+func newSegmentFile(t *testing.T) (*os.File, string) {
+	path := filepath.Join(t.TempDir(), "segment")
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_EXCL, 0o600)
+	require.NoError(t, err)
+
+	var header [4]byte
+	common.Endianese.PutUint32(header[:], common.SegmentV3)
+	_, err = f.Write(header[:])
+	require.NoError(t, err)
+
+	return f, path
+}
+
+// openSegmentFile for reading, right after segment format header.
+func openSegmentFile(t *testing.T, path string) *os.File {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+
+	_, err = f.Seek(4, 0)
+	require.NoError(t, err)
+	return f
+}
+
+func TestSegment(t *testing.T) {
+	t.Run("NewSegmentFailure", func(t *testing.T) {
+		{
+			f, _ := newSegmentFile(t)
+			_, err := NewSegment(f, common.EntryV2, 4)
+			require.ErrorIs(t, err, common.ErrEntryUnsupportedFormat)
+			_ = f.Close()
+		}
+
+		{
+			f, _ := newSegmentFile(t)
+			_, err := NewSegmentWithSettings(f, Settings{EntryFormat: common.EntryV1, MaxEntries: 4, Size: 6})
+			require.ErrorIs(t, err, common.ErrSegmentTooSmall)
+		}
+	})
+
+	t.Run("NewSegmentOK", func(t *testing.T) {
+		f, path := newSegmentFile(t)
+		s, err := NewSegmentWithSettings(f, Settings{EntryFormat: common.EntryV1, MaxEntries: 4, Size: 4096})
+		require.NoError(t, err)
+		require.EqualValues(t, 4, s.Size())
+		require.NoError(t, s.Close())
+
+		// preallocated
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		require.EqualValues(t, 4096, info.Size())
+	})
+
+	t.Run("Seek", func(t *testing.T) {
+		f, path := newSegmentFile(t)
+
+		s, err := NewSegment(f, common.EntryV1, 2)
+		require.NoError(t, err)
+		defer func() { _ = s.Close() }()
+
+		_, err = s.Reading(openSegmentFile(t, path))
+		require.NoError(t, err)
+
+		for _, data := range []string{"alpha", "beta"} {
+			code, err := s.WriteEntry([]byte(data))
+			require.NoError(t, err)
+			require.Equal(t, common.NoError, code)
+		}
+
+		require.NoError(t, s.SeekToRead(8))
+		require.Error(t, s.SeekToRead(DefaultSize+1))
+		require.EqualValues(t, 4+13+12, s.Size())
+	})
+
+	segmenttest.Run(t, func(t *testing.T, maxEntries uint32) (segment.Segment, io.ReadSeekCloser) {
+		f, path := newSegmentFile(t)
+		s, err := NewSegment(f, common.EntryV1, maxEntries)
+		require.NoError(t, err)
+		return s, openSegmentFile(t, path)
+	})
+}
+
+func TestNewSegmentReadWrite(t *testing.T) {
+	t.Run("Closing", func(t *testing.T) {
+		var s *Segment
+		require.NoError(t, s.Close())
+	})
+
+	t.Run("Unsupported", func(t *testing.T) {
+		f, _ := newSegmentFile(t)
+
+		s, err := NewSegment(f, common.EntryV1, 2)
+		require.NoError(t, err)
+		defer func() { _ = s.Close() }()
+
+		code, err := s.WriteStream(bytes.NewReader([]byte{1}), 1, 1, entry.Meta{})
+		require.ErrorIs(t, err, common.ErrEntryUnsupportedFormat)
+		require.Equal(t, common.EntryUnsupportedFormat, code)
+
+		code, err = s.WriteEntryWithMeta([]byte{1}, entry.Meta{Batch: 1})
+		require.ErrorIs(t, err, common.ErrEntryUnsupportedFormat)
+		require.Equal(t, common.EntryUnsupportedFormat, code)
+	})
+
+	t.Run("Size", func(t *testing.T) {
+		f, path := newSegmentFile(t)
+
+		s, err := NewSegmentWithSettings(f, Settings{
+			EntryFormat: common.EntryV1,
+			MaxEntries:  100,
+			Size:        4 + 4 + 2*18 + 10,
+		})
+		require.NoError(t, err)
+		defer func() { _ = s.Close() }()
+
+		_, err = s.Reading(openSegmentFile(t, path))
+		require.NoError(t, err)
+
+		// [Entry Format] + 2 * [Length][Checksum][Entry]
+		for i := 0; i < 2; i++ {
+			code, err := s.WriteEntry(make([]byte, 10))
+			require.NoError(t, err)
+			require.Equal(t, common.NoError, code)
+		}
+
+		// would exceed
+		code, err := s.WriteEntry(make([]byte, 10))
+		require.NoError(t, err)
+		require.Equal(t, common.SegmentNoMoreWrite, code)
+
+		b := entry.NewBatch(2)
+		b.Append([]byte{1})
+		code, err = s.WriteBatch(b)
+		require.NoError(t, err)
+		require.Equal(t, common.SegmentNoMoreWrite, code)
+
+		var e entry.Entry
+		for i := 0; i < 2; i++ {
+			code, _, err = s.ReadEntry(&e)
+			require.NoError(t, err)
+			require.Equal(t, common.NoError, code)
+		}
+		code, _, _ = s.ReadEntry(&e)
+		require.Equal(t, common.SegmentNoMoreReadStrong, code)
+
+		// empty segment could not take entry larger than itself
+		f, _ = newSegmentFile(t)
+		s, err = NewSegmentWithSettings(f, Settings{
+			EntryFormat: common.EntryV1,
+			MaxEntries:  100,
+			Size:        64,
+		})
+		require.NoError(t, err)
+		defer func() { _ = s.Close() }()
+
+		code, err = s.WriteEntry(make([]byte, 100))
+		require.ErrorIs(t, err, common.ErrEntryTooBig)
+		require.Equal(t, common.EntryTooBig, code)
+
+		code, err = s.WriteEntry([]byte{1})
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+	})
+
+	t.Run("View", func(t *testing.T) {
+		f, path := newSegmentFile(t)
+
+		s, err := NewSegment(f, common.EntryV1, 100)
+		require.NoError(t, err)
+		defer func() { _ = s.Close() }()
+
+		_, err = s.Reading(openSegmentFile(t, path))
+		require.NoError(t, err)
+
+		_, err = s.WriteEntry([]byte("alpha"))
+		require.NoError(t, err)
+
+		var e entry.Entry
+		code, _, err := s.ReadEntry(&e)
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+
+		// entry refers to mapped file, appending does not write into it
+		require.Equal(t, &s.data[4+4+8], &e[0])
+		require.Equal(t, len(e), cap(e))
+		_ = append(e, 'x')
+		require.Zero(t, s.data[4+4+8+5])
+	})
+
+	t.Run("ReadOnly", func(t *testing.T) {
+		// entry format header missing
+		{
+			_, path := newSegmentFile(t)
+			_, _, err := NewReadOnlySegment(openSegmentFile(t, path))
+			require.Error(t, err)
+		}
+
+		// unsupported format
+		{
+			f, path := newSegmentFile(t)
+			_, err := f.Write([]byte{0, 0, 0, 0xff})
+			require.NoError(t, err)
+
+			_, n, err := NewReadOnlySegment(openSegmentFile(t, path))
+			require.ErrorIs(t, err, common.ErrEntryUnsupportedFormat)
+			require.Equal(t, 4, n)
+		}
+
+		// not mappable
+		{
+			_, n, err := NewReadOnlySegment(nopCloser{bytes.NewReader([]byte{0, 0, 0, 0})})
+			require.ErrorIs(t, err, common.ErrSegmentNotMappable)
+			require.Equal(t, 4, n)
+		}
+
+		// corrupt
+		{
+			f, path := newSegmentFile(t)
+			_, err := f.Write([]byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1})
+			require.NoError(t, err)
+
+			s, n, err := NewReadOnlySegment(openSegmentFile(t, path))
+			require.NoError(t, err)
+			require.Equal(t, 4, n)
+
+			var e entry.Entry
+			code, _, err := s.ReadEntry(&e)
+			require.ErrorIs(t, err, common.ErrEntryInvalidCheckSum)
+			require.Equal(t, common.SegmentCorrupted, code)
+			require.NoError(t, s.Close())
+		}
+
+		// written by writable segment, followed by zeros
+		{
+			f, path := newSegmentFile(t)
+
+			w, err := NewSegmentWithSettings(f, Settings{EntryFormat: common.EntryV1, MaxEntries: 100, Size: 1024})
+			require.NoError(t, err)
+			for _, data := range []string{"alpha", "beta"} {
+				code, err := w.WriteEntry([]byte(data))
+				require.NoError(t, err)
+				require.Equal(t, common.NoError, code)
+			}
+			require.NoError(t, w.Close())
+
+			s, n, err := NewReadOnlySegment(openSegmentFile(t, path))
+			require.NoError(t, err)
+			require.Equal(t, 4, n)
+			require.Zero(t, s.Size())
+
+			var e entry.Entry
+			for _, data := range []string{"alpha", "beta"} {
+				code, _, err := s.ReadEntry(&e)
+				require.NoError(t, err)
+				require.Equal(t, common.NoError, code)
+				require.Equal(t, data, string(e))
+			}
+
+			code, n, err := s.ReadEntry(&e)
+			require.NoError(t, err)
+			require.Equal(t, common.SegmentNoMoreReadStrong, code)
+			require.Equal(t, 0, n)
+
+			// seek to the second one
+			require.NoError(t, s.SeekToRead(4+4+13))
+			code, _, err = s.ReadEntry(&e)
+			require.NoError(t, err)
+			require.Equal(t, common.NoError, code)
+			require.Equal(t, "beta", string(e))
+
+			code, _ = s.WriteEntry([]byte("gamma"))
+			require.Equal(t, common.SegmentNoMoreWrite, code)
+			require.NoError(t, s.Close())
+		}
+	})
+}
+
+type nopCloser struct {
+	*bytes.Reader
+}
+
+func (nopCloser) Close() error { return nil }
@@ -12,7 +12,12 @@ type Segment interface {
 	io.Closer
 	Reading(io.ReadSeekCloser) (int, error)
 	ReadEntry(*entry.Entry) (common.ErrCode, int, error)
+	ReadEntryWithMeta(*entry.Entry, *entry.Meta) (common.ErrCode, int, error)
 	WriteEntry(entry.Entry) (common.ErrCode, error)
+	WriteEntryWithMeta(entry.Entry, entry.Meta) (common.ErrCode, error)
 	WriteBatch(entry.Batch) (common.ErrCode, error)
+	WriteStream(io.Reader, int64, int, entry.Meta) (common.ErrCode, error)
 	SeekToRead(int64) error
+	Seal()
+	Size() int64
 }
@@ -0,0 +1,120 @@
+package segv1
+
+import (
+	"hash/crc32"
+	"io"
+
+	"github.com/linxGnu/pqueue/common"
+)
+
+const (
+	// indexInterval is number of entries between index points of footer.
+	indexInterval = 64
+
+	// [Entries][Bytes][Index Length]
+	footerHeaderSize = 8 + 8 + 4
+
+	// [Footer Size][Checksum][Magic]
+	footerTrailerSize = 4 + 4 + 4
+
+	indexPointSize = 8 + 8
+)
+
+// Footer summarizes sealed segment, see common.SegmentV2.
+type Footer struct {
+	Entries uint64       // number of entries, chunks of a large entry are counted as one
+	Bytes   int64        // size of entries along with entry format header
+	Index   []IndexPoint // sparse index, in order of entries
+}
+
+// IndexPoint locates entry of given ordinal inside segment.
+type IndexPoint struct {
+	Entry  uint64
+	Offset int64 // relative to entry format header
+}
+
+// Seek returns the nearest index point at or before entry of given ordinal.
+func (f *Footer) Seek(entry uint64) (p IndexPoint, ok bool) {
+	for _, point := range f.Index {
+		if point.Entry > entry {
+			break
+		}
+		p, ok = point, true
+	}
+	return
+}
+
+func (f *Footer) marshal() []byte {
+	size := footerHeaderSize + len(f.Index)*indexPointSize + footerTrailerSize
+	buf := make([]byte, size)
+
+	common.Endianese.PutUint64(buf, f.Entries)
+	common.Endianese.PutUint64(buf[8:], uint64(f.Bytes))
+	common.Endianese.PutUint32(buf[16:], uint32(len(f.Index)))
+
+	data := buf[footerHeaderSize:]
+	for _, point := range f.Index {
+		common.Endianese.PutUint64(data, point.Entry)
+		common.Endianese.PutUint64(data[8:], uint64(point.Offset))
+		data = data[indexPointSize:]
+	}
+
+	common.Endianese.PutUint32(data, uint32(size))
+	common.Endianese.PutUint32(data[4:], crc32.ChecksumIEEE(buf[:size-8]))
+	copy(data[8:], common.SegmentMagic)
+
+	return buf
+}
+
+// ReadFooter reads footer of sealed segment, whose size is given. Entries of segment start at
+// offset. common.ErrSegmentFooterMissing is returned if segment is not sealed or its footer is corrupted.
+func ReadFooter(r io.ReaderAt, size, offset int64) (*Footer, error) {
+	var trailer [footerTrailerSize]byte
+	if size < offset+int64(len(segmentEnding))+footerHeaderSize+footerTrailerSize {
+		return nil, common.ErrSegmentFooterMissing
+	}
+	if _, err := r.ReadAt(trailer[:], size-footerTrailerSize); err != nil {
+		return nil, err
+	}
+	if string(trailer[8:]) != common.SegmentMagic {
+		return nil, common.ErrSegmentFooterMissing
+	}
+
+	footerSize := int64(common.Endianese.Uint32(trailer[:]))
+	if footerSize < footerHeaderSize+footerTrailerSize ||
+		footerSize > size-offset-int64(len(segmentEnding)) {
+		return nil, common.ErrSegmentFooterMissing
+	}
+
+	buf := make([]byte, footerSize)
+	if _, err := r.ReadAt(buf, size-footerSize); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(buf[:footerSize-8]) != common.Endianese.Uint32(trailer[4:]) {
+		return nil, common.ErrSegmentFooterMissing
+	}
+
+	f := &Footer{
+		Entries: common.Endianese.Uint64(buf),
+		Bytes:   int64(common.Endianese.Uint64(buf[8:])),
+	}
+
+	// footer follows ending of entries
+	points := int64(common.Endianese.Uint32(buf[16:]))
+	if footerHeaderSize+points*indexPointSize+footerTrailerSize != footerSize ||
+		offset+f.Bytes+int64(len(segmentEnding))+footerSize != size {
+		return nil, common.ErrSegmentFooterMissing
+	}
+
+	f.Index = make([]IndexPoint, points)
+	data := buf[footerHeaderSize:]
+	for i := range f.Index {
+		f.Index[i] = IndexPoint{
+			Entry:  common.Endianese.Uint64(data),
+			Offset: int64(common.Endianese.Uint64(data[8:])),
+		}
+		data = data[indexPointSize:]
+	}
+
+	return f, nil
+}
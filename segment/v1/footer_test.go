@@ -0,0 +1,69 @@
+package segv1
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/linxGnu/pqueue/common"
+	"github.com/linxGnu/pqueue/entry"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFooter(t *testing.T) {
+	buffer := bytes.NewBuffer(make([]byte, 0, 4096))
+
+	s, err := NewSegmentWithSettings(&mockWriter{Buffer: buffer}, Settings{
+		EntryFormat: common.EntryV1,
+		MaxEntries:  200,
+		Footer:      true,
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		code, err := s.WriteEntry([]byte{byte(i)})
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
+	}
+
+	// not sealed yet
+	_, err = ReadFooter(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()), 0)
+	require.Equal(t, common.ErrSegmentFooterMissing, err)
+
+	b := entry.NewBatch(100)
+	for i := 100; i < 200; i++ {
+		b.Append([]byte{byte(i)})
+	}
+	code, err := s.WriteBatch(b)
+	require.NoError(t, err)
+	require.Equal(t, common.NoError, code)
+
+	// sealed once full
+	data := buffer.Bytes()
+	footer, err := ReadFooter(bytes.NewReader(data), int64(len(data)), 0)
+	require.NoError(t, err)
+	require.EqualValues(t, 200, footer.Entries)
+	require.EqualValues(t, 4+100*9+100*9, footer.Bytes)                         // [Entry Format] + entries
+	require.Equal(t, []IndexPoint{{Entry: 64, Offset: 4 + 64*9}}, footer.Index) // batch is not split
+
+	p, ok := footer.Seek(63)
+	require.False(t, ok)
+	p, ok = footer.Seek(199)
+	require.True(t, ok)
+	require.EqualValues(t, 64, p.Entry)
+
+	// entry is at index point
+	var e entry.Entry
+	_, _, err = e.Unmarshal(bytes.NewReader(data[p.Offset:]), common.EntryV1)
+	require.NoError(t, err)
+	require.EqualValues(t, []byte{64}, e)
+
+	// corrupted
+	corrupted := append([]byte{}, data...)
+	corrupted[len(corrupted)-13]++
+	_, err = ReadFooter(bytes.NewReader(corrupted), int64(len(corrupted)), 0)
+	require.Equal(t, common.ErrSegmentFooterMissing, err)
+
+	_, err = ReadFooter(bytes.NewReader(data), int64(len(data)), 1)
+	require.Equal(t, common.ErrSegmentFooterMissing, err)
+}
@@ -2,6 +2,7 @@ package segv1
 
 import (
 	"io"
+	"math"
 	"sync/atomic"
 
 	"github.com/linxGnu/pqueue/common"
@@ -15,16 +16,47 @@ type Segment struct {
 	readOnly bool
 
 	entryFormat common.EntryFormat
+	enc         *entry.Encoding // decryption of entries, nil if disabled
 	w           entry.Writer
 
 	offset     uint32
 	numEntries uint32
 	maxEntries uint32
+	maxBytes   int64           // zero means no limit
+	written    *countingWriter // bytes written to segment
+	sealed     uint32          // set when no more entries would be written
+	rotated    bool            // sealed by Seal, rejects upcoming entries
+	footer     *Footer         // written on sealing, nil if disabled
 	r          entry.Reader
+
+	meta    entry.Meta // scratch metadata, used when caller does not need it
+	inChunk bool       // reading chunks of a large entry
+
+	// batch frame being read
+	frame     entry.Frame // remaining entries
+	frameLeft int         // number of remaining entries
+	frameSize int         // size of frame inside segment
 }
 
 // NewReadOnlySegment creates new Segment for readonly.
 func NewReadOnlySegment(source io.ReadSeekCloser) (*Segment, int, error) {
+	return NewReadOnlySegmentWithKeys(source, nil)
+}
+
+// NewReadOnlySegmentWithKeys creates new Segment for readonly, entries are decrypted with key
+// from keys. *common.KeyNotFoundError is returned if key of segment is missing.
+func NewReadOnlySegmentWithKeys(source io.ReadSeekCloser, keys entry.KeyProvider) (*Segment, int, error) {
+	return newReadOnlySegment(source, keys, false)
+}
+
+// NewAuthenticatedSegment creates new Segment for readonly, whose entries must be authenticated
+// (EntryV4) with key from keys. Segment of other entry format is untrusted, common.ErrEntryAuthentication
+// is returned for it.
+func NewAuthenticatedSegment(source io.ReadSeekCloser, keys entry.KeyProvider) (*Segment, int, error) {
+	return newReadOnlySegment(source, keys, true)
+}
+
+func newReadOnlySegment(source io.ReadSeekCloser, keys entry.KeyProvider, authenticated bool) (*Segment, int, error) {
 	// get entry format
 	var buf [4]byte
 	n, err := io.ReadFull(source, buf[:])
@@ -33,49 +65,243 @@ func NewReadOnlySegment(source io.ReadSeekCloser) (*Segment, int, error) {
 	}
 
 	// check entry format
+	var enc *entry.Encoding
 	entryFormat := common.Endianese.Uint32(buf[:])
+	if authenticated && entryFormat != common.EntryV4 {
+		return nil, n, common.ErrEntryAuthentication
+	}
+
 	switch entryFormat {
-	case common.EntryV1:
+	case common.EntryV1, common.EntryV2, common.EntryV5, common.EntryV6, common.EntryV7:
+
+	case common.EntryV3, common.EntryV4:
+		keyID, n_, err := readKeyID(source)
+		if n += n_; err != nil {
+			return nil, n, err
+		}
+
+		if enc, err = loadKey(keys, keyID, entryFormat); err != nil {
+			return nil, n, err
+		}
 
 	default:
 		return nil, n, common.ErrEntryUnsupportedFormat
 	}
 
+	r := newSegmentReader(newBufferReader(source), entryFormat)
+	r.enc = enc
+
 	// ok now
 	return &Segment{
 		readOnly:    true,
 		entryFormat: entryFormat,
-		r:           newSegmentReader(newBufferReader(source), entryFormat),
+		enc:         enc,
+		r:           r,
 	}, n, nil
 }
 
+// CountEntries reads through readonly segment and counts its entries, without decrypting or
+// authenticating them, so that key of segment is not needed. Entries of batch frame are counted
+// one by one, large entry counts once its last chunk is read. Counting stops at ending or broken
+// entry. Source is not closed.
+func CountEntries(source io.ReadSeekCloser) (count uint64, err error) {
+	var buf [4]byte
+	if _, err = io.ReadFull(source, buf[:]); err != nil {
+		return
+	}
+
+	entryFormat := common.Endianese.Uint32(buf[:])
+	if hasKeyID(entryFormat) {
+		if _, _, err = readKeyID(source); err != nil {
+			return
+		}
+	}
+
+	r := newSegmentReader(newBufferReader(source), entryFormat)
+	r.enc = &entry.Encoding{Opaque: true}
+
+	var (
+		e    entry.Entry
+		meta entry.Meta
+	)
+	for {
+		if code, _, _ := r.ReadEntryWithMeta(&e, &meta); code != common.NoError {
+			return
+		}
+
+		switch {
+		case meta.Batch > 0:
+			count += uint64(meta.Batch)
+
+		case meta.Chunk.Total == 0 || meta.Chunk.IsLast(len(e)):
+			count++
+		}
+	}
+}
+
+// readKeyID reads [Key ID Length - uint8][Key ID - bytes] from segment header.
+func readKeyID(r io.Reader) (string, int, error) {
+	var size [1]byte
+	n, err := io.ReadFull(r, size[:])
+	if err != nil {
+		return "", n, err
+	}
+
+	keyID := make([]byte, size[0])
+	n_, err := io.ReadFull(r, keyID)
+	return string(keyID), n + n_, err
+}
+
+func loadKey(keys entry.KeyProvider, keyID string, entryFormat common.EntryFormat) (*entry.Encoding, error) {
+	if keys == nil {
+		return nil, &common.KeyNotFoundError{KeyID: keyID}
+	}
+
+	key, err := keys.Key(keyID)
+	if err != nil || key == nil {
+		return nil, &common.KeyNotFoundError{KeyID: keyID, Err: err}
+	}
+
+	enc := &entry.Encoding{}
+	if err = setKey(enc, entryFormat, key); err != nil {
+		return nil, err
+	}
+	return enc, nil
+}
+
+// setKey prepares sealer (EntryV3) or signer (EntryV4) of encoding with key.
+func setKey(enc *entry.Encoding, entryFormat common.EntryFormat, key []byte) (err error) {
+	if entryFormat == common.EntryV3 {
+		enc.Sealer, err = entry.NewSealer(key)
+	} else {
+		enc.Signer, err = entry.NewSigner(key)
+	}
+	return
+}
+
+// Settings of writable segment.
+type Settings struct {
+	EntryFormat common.EntryFormat
+	MaxEntries  uint32
+
+	// Codec compresses payload of entries, which are not smaller than CompressionThreshold.
+	// EntryV1 and EntryV7 formats do not support compression. Nil means no compression.
+	Codec                entry.Codec
+	CompressionThreshold int
+
+	// CompressBatch writes entries of batch as one frame, compressed by Codec.
+	CompressBatch bool
+
+	// KeyProvider supplies encryption key for EntryV3 format, or authentication key for EntryV4 format.
+	KeyProvider entry.KeyProvider
+
+	// NoBlockChecksum writes blocks of EntryV7 format without checksum.
+	NoBlockChecksum bool
+
+	// MaxBytes is max size of segment. Entries which would exceed it are rejected with
+	// common.SegmentNoMoreWrite, unless segment is empty. Zero means no limit.
+	MaxBytes int64
+
+	// Footer writes footer along with sparse index of entries when segment is sealed,
+	// see common.SegmentV2 and ReadFooter.
+	Footer bool
+}
+
 // NewSegment from path.
 func NewSegment(w io.WriteCloser, entryFormat common.EntryFormat, maxEntries uint32) (*Segment, error) {
-	switch entryFormat {
-	case common.EntryV1:
+	return NewSegmentWithSettings(w, Settings{
+		EntryFormat: entryFormat,
+		MaxEntries:  maxEntries,
+	})
+}
+
+// NewSegmentWithSettings creates writable segment with custom settings.
+func NewSegmentWithSettings(w io.WriteCloser, settings Settings) (*Segment, error) {
+	switch settings.EntryFormat {
+	case common.EntryV1, common.EntryV7:
+		if settings.Codec != nil || settings.CompressBatch {
+			return nil, common.ErrEntryUnsupportedFormat
+		}
+
+	case common.EntryV2, common.EntryV3, common.EntryV4, common.EntryV5, common.EntryV6:
+		if settings.CompressBatch && settings.Codec == nil {
+			return nil, common.ErrCodecRequired
+		}
 
 	default:
 		return nil, common.ErrEntryUnsupportedFormat
 	}
 
-	// write header: [EntryFormat]
-	var buf [4]byte
-	common.Endianese.PutUint32(buf[:], uint32(entryFormat))
-	_, err := w.Write(buf[:])
-	if err != nil {
+	enc := &entry.Encoding{NoChecksum: settings.NoBlockChecksum}
+	if settings.Codec != nil {
+		enc.Compressor = &entry.Compressor{
+			Codec:     settings.Codec,
+			Threshold: settings.CompressionThreshold,
+		}
+	}
+
+	// write header: [EntryFormat], followed by [Key ID Length][Key ID] for EntryV3/EntryV4
+	header := make([]byte, 4, 5)
+	common.Endianese.PutUint32(header, uint32(settings.EntryFormat))
+
+	if hasKeyID(settings.EntryFormat) {
+		keyID, err := currentKey(settings.KeyProvider, enc, settings.EntryFormat)
+		if err != nil {
+			_ = w.Close()
+			return nil, err
+		}
+
+		header = append(header, byte(len(keyID)))
+		header = append(header, keyID...)
+	}
+
+	if _, err := w.Write(header); err != nil {
 		_ = w.Close()
 		return nil, err
 	}
 
+	written := &countingWriter{WriteCloser: w, n: int64(len(header))}
+	sw := newSegmentWriter(written, settings.EntryFormat)
+	sw.compressBatch = settings.CompressBatch
+	sw.enc = enc
+	if settings.Footer {
+		sw.footer = &Footer{Bytes: written.n}
+	}
+
 	// ok now
 	return &Segment{
 		readOnly:    false,
-		entryFormat: entryFormat,
-		maxEntries:  maxEntries,
-		w:           newSegmentWriter(w, entryFormat),
+		entryFormat: settings.EntryFormat,
+		enc:         enc,
+		maxEntries:  settings.MaxEntries,
+		maxBytes:    settings.MaxBytes,
+		written:     written,
+		footer:      sw.footer,
+		w:           sw,
 	}, nil
 }
 
+func currentKey(keys entry.KeyProvider, enc *entry.Encoding, entryFormat common.EntryFormat) (string, error) {
+	if keys == nil {
+		return "", common.ErrEntryKeyRequired
+	}
+
+	keyID, key, err := keys.CurrentKey()
+	if err != nil {
+		return "", err
+	}
+	if len(keyID) > math.MaxUint8 {
+		return "", common.ErrKeyIDTooLong
+	}
+
+	return keyID, setKey(enc, entryFormat, key)
+}
+
+// hasKeyID returns true if segment header of entry format records key ID.
+func hasKeyID(entryFormat common.EntryFormat) bool {
+	return entryFormat == common.EntryV3 || entryFormat == common.EntryV4
+}
+
 // Close segment.
 func (s *Segment) Close() (err error) {
 	if s == nil {
@@ -90,15 +316,35 @@ func (s *Segment) Close() (err error) {
 	return
 }
 
-// Reading from source.
+// Reading from source. Source is read up to bytes written so far, so that space preallocated
+// behind them is not taken as ending of segment.
 func (s *Segment) Reading(source io.ReadSeekCloser) (n int, err error) {
-	// should bypass entryFormat
+	if s.written != nil {
+		start, err := source.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
+		source = &writtenReader{ReadSeekCloser: source, written: s.written, start: start, pos: start}
+	}
+
+	// should bypass header
 	var dummy [4]byte
-	n, err = io.ReadFull(source, dummy[:])
+	if n, err = io.ReadFull(source, dummy[:]); err == nil && hasKeyID(s.entryFormat) {
+		var n_ int
+		_, n_, err = readKeyID(source)
+		n += n_
+	}
 
-	// no problem?
+	// no problem? start reading from beginning
 	if err == nil {
-		s.r = newSegmentReader(newBufferReader(source), s.entryFormat)
+		if s.r != nil {
+			_ = s.r.Close()
+		}
+		r := newSegmentReader(newBufferReader(source), s.entryFormat)
+		r.enc = s.enc
+		s.r = r
+		s.offset = 0
+		s.resetReading()
 	}
 
 	return
@@ -106,6 +352,11 @@ func (s *Segment) Reading(source io.ReadSeekCloser) (n int, err error) {
 
 // WriteEntry to segment.
 func (s *Segment) WriteEntry(e entry.Entry) (common.ErrCode, error) {
+	return s.WriteEntryWithMeta(e, entry.Meta{})
+}
+
+// WriteEntryWithMeta writes entry along with its metadata to segment.
+func (s *Segment) WriteEntryWithMeta(e entry.Entry, meta entry.Meta) (common.ErrCode, error) {
 	// check entry size
 	if len(e) == 0 {
 		return common.NoError, nil
@@ -113,24 +364,128 @@ func (s *Segment) WriteEntry(e entry.Entry) (common.ErrCode, error) {
 	if len(e) > common.MaxEntrySize {
 		return common.EntryTooBig, common.ErrEntryTooBig
 	}
+	if len(meta.ID) > common.MaxEntryIDSize {
+		return common.EntryTooBig, common.ErrEntryIDTooLong
+	}
 
-	return s.writeEntry(e)
+	return s.writeEntry(e, meta)
 }
 
-func (s *Segment) writeEntry(e entry.Entry) (common.ErrCode, error) {
-	if s.numEntries >= s.maxEntries {
+func (s *Segment) writeEntry(e entry.Entry, meta entry.Meta) (common.ErrCode, error) {
+	if s.full(int64(len(e) + len(meta.ID))) {
 		return common.SegmentNoMoreWrite, nil
 	}
 
-	code, err := s.w.WriteEntry(e)
-	if (code == common.NoError && atomic.AddUint32(&s.numEntries, 1) >= s.maxEntries) ||
-		code == common.SegmentCorrupted {
-		_ = s.w.Close()
+	s.addIndexPoint()
+	code, err := s.w.WriteEntryWithMeta(e, meta)
+	s.afterWrite(code, 1)
+
+	return code, err
+}
+
+// WriteStream writes a large entry of given size from r, chunk by chunk. EntryV1, EntryV3 and EntryV7
+// do not support chunked entries.
+func (s *Segment) WriteStream(r io.Reader, size int64, chunkSize int, meta entry.Meta) (common.ErrCode, error) {
+	if size <= 0 {
+		return common.NoError, nil
+	}
+	if len(meta.ID) > common.MaxEntryIDSize {
+		return common.EntryTooBig, common.ErrEntryIDTooLong
+	}
+	switch s.entryFormat {
+	case common.EntryV1, common.EntryV3, common.EntryV7:
+		return common.EntryUnsupportedFormat, common.ErrEntryUnsupportedFormat
+	}
+	if chunkSize <= 0 || chunkSize > common.MaxEntrySize {
+		chunkSize = common.MaxEntrySize
+	}
+
+	if s.full(size + int64(len(meta.ID))) {
+		return common.SegmentNoMoreWrite, nil
 	}
 
+	s.addIndexPoint()
+	code, err := s.w.WriteStream(r, size, chunkSize, meta)
+	s.afterWrite(code, 1)
+
 	return code, err
 }
 
+// full returns true if segment could not take entries of given size. Segment is sealed if they
+// would exceed max bytes, so that readers know its ending.
+func (s *Segment) full(size int64) bool {
+	if s.numEntries >= s.maxEntries || s.rotated {
+		return true
+	}
+
+	if s.maxBytes > 0 && s.numEntries > 0 && s.written.n+size > s.maxBytes {
+		if atomic.LoadUint32(&s.sealed) == 0 {
+			s.seal()
+		}
+		return true
+	}
+
+	return false
+}
+
+// addIndexPoint of the next entry into footer, every indexInterval entries.
+func (s *Segment) addIndexPoint() {
+	if s.footer == nil {
+		return
+	}
+
+	var last uint64
+	if n := len(s.footer.Index); n > 0 {
+		last = s.footer.Index[n-1].Entry
+	}
+	if next := uint64(s.numEntries); next >= last+indexInterval {
+		s.footer.Index = append(s.footer.Index, IndexPoint{Entry: next, Offset: s.written.n})
+	}
+}
+
+// afterWrite accounts written entries and closes writer once segment is full or corrupted.
+func (s *Segment) afterWrite(code common.ErrCode, entries uint32) {
+	if s.footer != nil {
+		s.footer.Bytes = s.written.n
+		if code == common.NoError {
+			s.footer.Entries += uint64(entries)
+		}
+	}
+
+	if (code == common.NoError && atomic.AddUint32(&s.numEntries, entries) >= s.maxEntries) ||
+		(code == common.NoError && s.maxBytes > 0 && s.written.n >= s.maxBytes) ||
+		code == common.SegmentCorrupted {
+		s.seal()
+	}
+}
+
+func (s *Segment) seal() {
+	_ = s.w.Close()
+	atomic.StoreUint32(&s.sealed, 1)
+}
+
+// Size returns number of bytes written to segment, from its entry format header. It's zero
+// if segment is readonly.
+func (s *Segment) Size() int64 {
+	if s.written == nil {
+		return 0
+	}
+	return s.written.n
+}
+
+// Seal writable segment, upcoming entries are rejected with common.SegmentNoMoreWrite. It's no-op
+// if segment is readonly, empty or sealed already.
+func (s *Segment) Seal() {
+	if s.readOnly || s.numEntries == 0 || s.rotated {
+		return
+	}
+
+	s.rotated = true
+	if atomic.LoadUint32(&s.sealed) == 0 {
+		s.seal()
+	}
+}
+
 // WriteBatch to segment.
 func (s *Segment) WriteBatch(b entry.Batch) (common.ErrCode, error) {
 	// check entry size
@@ -141,25 +496,34 @@ func (s *Segment) WriteBatch(b entry.Batch) (common.ErrCode, error) {
 }
 
 func (s *Segment) writeBatch(b entry.Batch) (common.ErrCode, error) {
-	if s.numEntries >= s.maxEntries {
+	if s.full(int64(b.Size())) {
 		return common.SegmentNoMoreWrite, nil
 	}
 
+	s.addIndexPoint()
 	code, err := s.w.WriteBatch(b)
-	if (code == common.NoError && atomic.AddUint32(&s.numEntries, uint32(b.Len())) >= s.maxEntries) ||
-		code == common.SegmentCorrupted {
-		_ = s.w.Close()
-	}
+	s.afterWrite(code, uint32(b.Len()))
 
 	return code, err
 }
 
 // ReadEntry from segment.
 func (s *Segment) ReadEntry(e *entry.Entry) (common.ErrCode, int, error) {
-	if !s.readOnly {
+	return s.ReadEntryWithMeta(e, nil)
+}
+
+// ReadEntryWithMeta reads entry along with its metadata from segment.
+func (s *Segment) ReadEntryWithMeta(e *entry.Entry, meta *entry.Meta) (common.ErrCode, int, error) {
+	if meta == nil {
+		meta = &s.meta
+	}
+
+	// chunks of a large entry are counted as one entry
+	if !s.readOnly && !s.inChunk {
 		// readable?
+		sealed := atomic.LoadUint32(&s.sealed) == 1
 		if s.offset == atomic.LoadUint32(&s.numEntries) {
-			if s.offset >= s.maxEntries {
+			if sealed || s.offset >= s.maxEntries {
 				_ = s.r.Close()
 				return common.SegmentNoMoreReadStrong, 0, nil
 			}
@@ -170,11 +534,49 @@ func (s *Segment) ReadEntry(e *entry.Entry) (common.ErrCode, int, error) {
 		s.offset++
 	}
 
-	return s.readEntry(e)
+	if s.frameLeft > 0 {
+		return s.nextInFrame(e, meta)
+	}
+
+	code, n, err := s.readEntry(e, meta)
+	if code == common.NoError {
+		if meta.Batch > 0 {
+			// entries of frame are returned one by one
+			s.frame = append(s.frame[:0], *e...)
+			s.frameLeft, s.frameSize = meta.Batch, n
+			return s.nextInFrame(e, meta)
+		}
+
+		s.inChunk = meta.Chunk.Total > 0 && !meta.Chunk.IsLast(len(*e))
+	}
+	return code, n, err
+}
+
+// nextInFrame returns next entry of batch frame. Read size is zero until the last entry,
+// which takes whole frame size.
+func (s *Segment) nextInFrame(e *entry.Entry, meta *entry.Meta) (common.ErrCode, int, error) {
+	next, rest, err := s.frame.Next()
+	if err != nil || (s.frameLeft == 1) != (len(rest) == 0) {
+		if err == nil {
+			err = common.ErrEntryCorruptedMeta
+		}
+		s.resetReading()
+		_ = s.r.Close()
+		return common.SegmentCorrupted, 0, err
+	}
+
+	e.CloneFrom(next)
+	meta.ID, meta.Chunk, meta.Batch = meta.ID[:0], entry.Chunk{}, 0
+
+	s.frame = rest
+	if s.frameLeft--; s.frameLeft > 0 {
+		return common.NoError, 0, nil
+	}
+	return common.NoError, s.frameSize, nil
 }
 
-func (s *Segment) readEntry(e *entry.Entry) (common.ErrCode, int, error) {
-	code, n, err := s.r.ReadEntry(e)
+func (s *Segment) readEntry(e *entry.Entry, meta *entry.Meta) (common.ErrCode, int, error) {
+	code, n, err := s.r.ReadEntryWithMeta(e, meta)
 
 	switch code {
 	case common.NoError:
@@ -191,6 +593,9 @@ func (s *Segment) readEntry(e *entry.Entry) (common.ErrCode, int, error) {
 		}
 		return common.SegmentNoMoreReadWeak, 0, nil
 
+	case common.EntryUnauthenticated, common.EntryUndecryptable:
+		return code, n, err
+
 	default: // corrupted
 		_ = s.r.Close()
 		return common.SegmentCorrupted, n, err
@@ -200,5 +605,11 @@ func (s *Segment) readEntry(e *entry.Entry) (common.ErrCode, int, error) {
 // SeekToRead - offset from beginning of Segment.
 func (s *Segment) SeekToRead(offset int64) error {
 	_, err := s.r.Seek(offset, 0)
+	s.resetReading() // offset is always at boundary of entries/frames
 	return err
 }
+
+func (s *Segment) resetReading() {
+	s.inChunk = false
+	s.frame, s.frameLeft = s.frame[:0], 0
+}
@@ -3,6 +3,7 @@ package segv1
 import (
 	"bufio"
 	"io"
+	"sync/atomic"
 
 	"github.com/linxGnu/pqueue/common"
 	"github.com/linxGnu/pqueue/entry"
@@ -36,9 +37,40 @@ func (r *bufferReader) Close() error {
 	return r.r.Close()
 }
 
+// writtenReader reads source of writable segment, up to bytes written so far. Preallocated space
+// following them is never read ahead, it would be taken as ending of segment otherwise.
+type writtenReader struct {
+	io.ReadSeekCloser
+	written *countingWriter
+	start   int64 // offset of entry format header inside source
+	pos     int64
+}
+
+func (r *writtenReader) Read(p []byte) (n int, err error) {
+	limit := r.start + atomic.LoadInt64(&r.written.n)
+	if r.pos >= limit {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > limit-r.pos {
+		p = p[:limit-r.pos]
+	}
+
+	n, err = r.ReadSeekCloser.Read(p)
+	r.pos += int64(n)
+	return
+}
+
+func (r *writtenReader) Seek(offset int64, whence int) (ret int64, err error) {
+	if ret, err = r.ReadSeekCloser.Seek(offset, whence); err == nil {
+		r.pos = ret
+	}
+	return
+}
+
 type segmentReader struct {
 	r           io.ReadSeekCloser
 	entryFormat common.EntryFormat
+	enc         *entry.Encoding // decryption/authentication, nil if disabled
 }
 
 func newSegmentReader(r io.ReadSeekCloser, entryFormat common.EntryFormat) *segmentReader {
@@ -55,7 +87,12 @@ func (s *segmentReader) Close() error {
 
 // ReadEntry into destination.
 func (s *segmentReader) ReadEntry(dst *entry.Entry) (common.ErrCode, int, error) {
-	code, n, err := dst.Unmarshal(s.r, s.entryFormat)
+	return s.ReadEntryWithMeta(dst, nil)
+}
+
+// ReadEntryWithMeta into destination.
+func (s *segmentReader) ReadEntryWithMeta(dst *entry.Entry, meta *entry.Meta) (common.ErrCode, int, error) {
+	code, n, err := dst.UnmarshalEncoded(s.r, s.entryFormat, meta, s.enc)
 	switch code {
 	case common.NoError:
 		return common.NoError, n, nil
@@ -69,6 +106,12 @@ func (s *segmentReader) ReadEntry(dst *entry.Entry) (common.ErrCode, int, error)
 	case common.EntryTooBig:
 		return common.SegmentCorrupted, n, common.ErrEntryTooBig
 
+	case common.EntryUnauthenticated: // forged entry is read entirely, the next one is readable
+		return common.EntryUnauthenticated, n, err
+
+	case common.EntryUndecryptable:
+		return common.EntryUndecryptable, n, err
+
 	default:
 		return common.SegmentCorrupted, n, err
 	}
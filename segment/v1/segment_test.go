@@ -2,10 +2,16 @@ package segv1
 
 import (
 	"bytes"
+	"compress/flate"
+	"io"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/linxGnu/pqueue/common"
 	"github.com/linxGnu/pqueue/entry"
+	"github.com/linxGnu/pqueue/segment"
+	"github.com/linxGnu/pqueue/segment/internal/segmenttest"
 
 	"github.com/stretchr/testify/require"
 )
@@ -24,8 +30,20 @@ func TestSegment(t *testing.T) {
 	})
 
 	t.Run("NewSegmentOK", func(t *testing.T) {
-		_, err := NewSegment(&mockWriter{Buffer: bytes.NewBuffer(make([]byte, 0, 16))}, common.EntryV1, 4)
+		buffer := bytes.NewBuffer(make([]byte, 0, 16))
+		s, err := NewSegment(&mockWriter{Buffer: buffer}, common.EntryV1, 4)
+		require.NoError(t, err)
+
+		_, err = s.Reading(newMockReadSeeker(buffer))
+		require.NoError(t, err)
+		require.NoError(t, s.SeekToRead(0))
+	})
+
+	segmenttest.Run(t, func(t *testing.T, maxEntries uint32) (segment.Segment, io.ReadSeekCloser) {
+		buffer := bytes.NewBuffer(make([]byte, 0, 128))
+		s, err := NewSegment(&mockWriter{Buffer: buffer}, common.EntryV1, maxEntries)
 		require.NoError(t, err)
+		return s, newMockReadSeeker(buffer)
 	})
 }
 
@@ -35,125 +53,139 @@ func TestNewSegmentReadWrite(t *testing.T) {
 		require.NoError(t, s.Close())
 	})
 
-	t.Run("Happy", func(t *testing.T) {
-		buffer := bytes.NewBuffer(make([]byte, 0, 16))
-
-		s, err := NewSegment(&mockWriter{Buffer: buffer}, common.EntryV1, 2)
+	t.Run("WriteError", func(t *testing.T) {
+		s, err := NewSegment(&mockWriter{Buffer: bytes.NewBuffer(make([]byte, 0, 16))}, common.EntryV1, 2)
 		require.NoError(t, err)
 
-		// reading
-		n, err := s.Reading(newMockReadSeeker(buffer))
-		require.NoError(t, err)
-		require.Equal(t, 4, n)
+		// hiject another writer
+		s.w = newSegmentWriter(&mockWriterErr{onWrite: true}, common.EntryV1)
 
 		code, err := s.WriteEntry([]byte{})
 		require.NoError(t, err)
 		require.Equal(t, common.NoError, code)
 
 		code, err = s.WriteEntry([]byte("alpha"))
-		require.NoError(t, err)
-		require.Equal(t, common.NoError, code)
+		require.Error(t, err)
+		require.Equal(t, common.SegmentCorrupted, code)
 
-		var e entry.Entry
-		code, n, err = s.ReadEntry(&e)
-		require.NoError(t, err)
-		require.Equal(t, common.NoError, code)
-		require.Equal(t, "alpha", string(e))
-		require.Equal(t, 13, n)
+		b := entry.NewBatch(2)
+		b.Append([]byte{1, 2, 3})
 
-		code, n, err = s.ReadEntry(&e)
-		require.NoError(t, err)
-		require.Equal(t, common.SegmentNoMoreReadWeak, code)
-		require.Equal(t, 0, n)
+		code, err = s.WriteBatch(b)
+		require.Error(t, err)
+		require.Equal(t, common.SegmentCorrupted, code)
+	})
 
-		code, err = s.WriteEntry([]byte("beta"))
+	t.Run("MaxBytes", func(t *testing.T) {
+		buffer := bytes.NewBuffer(make([]byte, 0, 128))
+
+		s, err := NewSegmentWithSettings(&mockWriter{Buffer: buffer}, Settings{
+			EntryFormat: common.EntryV1,
+			MaxEntries:  100,
+			MaxBytes:    45,
+		})
 		require.NoError(t, err)
-		require.Equal(t, common.NoError, code)
 
-		code, n, err = s.ReadEntry(&e)
+		_, err = s.Reading(newMockReadSeeker(buffer))
 		require.NoError(t, err)
-		require.Equal(t, common.NoError, code)
-		require.Equal(t, "beta", string(e))
-		require.Equal(t, 12, n)
 
-		code, err = s.WriteEntry([]byte("gamma"))
+		// [Entry Format] + 2 * [Length][Checksum][Entry]
+		for i := 0; i < 2; i++ {
+			code, err := s.WriteEntry(make([]byte, 10))
+			require.NoError(t, err)
+			require.Equal(t, common.NoError, code)
+		}
+
+		// would exceed
+		code, err := s.WriteEntry(make([]byte, 10))
 		require.NoError(t, err)
 		require.Equal(t, common.SegmentNoMoreWrite, code)
 
-		code, n, err = s.ReadEntry(&e)
+		b := entry.NewBatch(2)
+		b.Append([]byte{1})
+		code, err = s.WriteBatch(b)
 		require.NoError(t, err)
+		require.Equal(t, common.SegmentNoMoreWrite, code)
+
+		var e entry.Entry
+		for i := 0; i < 2; i++ {
+			code, _, err = s.ReadEntry(&e)
+			require.NoError(t, err)
+			require.Equal(t, common.NoError, code)
+		}
+		code, _, _ = s.ReadEntry(&e)
 		require.Equal(t, common.SegmentNoMoreReadStrong, code)
-		require.Equal(t, 0, n)
 
-		require.NoError(t, s.SeekToRead(0))
-	})
+		// empty segment takes entry regardless of its size
+		s, err = NewSegmentWithSettings(&mockWriter{Buffer: bytes.NewBuffer(nil)}, Settings{
+			EntryFormat: common.EntryV1,
+			MaxEntries:  100,
+			MaxBytes:    45,
+		})
+		require.NoError(t, err)
 
-	t.Run("HappyBatch", func(t *testing.T) {
-		buffer := bytes.NewBuffer(make([]byte, 0, 16))
+		code, err = s.WriteEntry(make([]byte, 100))
+		require.NoError(t, err)
+		require.Equal(t, common.NoError, code)
 
-		s, err := NewSegment(&mockWriter{Buffer: buffer}, common.EntryV1, 2)
+		code, err = s.WriteEntry([]byte{1})
 		require.NoError(t, err)
+		require.Equal(t, common.SegmentNoMoreWrite, code)
+	})
 
-		// reading
-		n, err := s.Reading(newMockReadSeeker(buffer))
+	t.Run("Preallocated", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "segment")
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
 		require.NoError(t, err)
-		require.Equal(t, 4, n)
+		require.NoError(t, f.Truncate(64<<10)) // zeros behind entries
 
-		b := entry.NewBatch(3)
-		b.Append([]byte("alpha"))
-		b.Append([]byte("beta"))
-		b.Append([]byte("gama"))
+		s, err := NewSegment(f, common.EntryV1, 100)
+		require.NoError(t, err)
 
-		code, err := s.WriteBatch(b)
+		fr, err := os.Open(path)
+		require.NoError(t, err)
+		_, err = s.Reading(fr)
+		require.NoError(t, err)
+
+		code, err := s.WriteEntry([]byte("alpha"))
 		require.NoError(t, err)
 		require.Equal(t, common.NoError, code)
 
 		var e entry.Entry
-		code, n, err = s.ReadEntry(&e)
+		code, _, err = s.ReadEntry(&e)
 		require.NoError(t, err)
 		require.Equal(t, common.NoError, code)
 		require.Equal(t, "alpha", string(e))
-		require.Equal(t, 13, n)
 
-		code, n, err = s.ReadEntry(&e)
+		// zeros are not read ahead, they would be taken as ending
+		code, err = s.WriteEntry([]byte("beta"))
 		require.NoError(t, err)
 		require.Equal(t, common.NoError, code)
-		require.Equal(t, "beta", string(e))
-		require.Equal(t, 12, n)
 
-		code, n, err = s.ReadEntry(&e)
+		code, _, err = s.ReadEntry(&e)
 		require.NoError(t, err)
 		require.Equal(t, common.NoError, code)
-		require.Equal(t, "gama", string(e))
-		require.Equal(t, 12, n)
+		require.Equal(t, "beta", string(e))
 
-		code, n, err = s.ReadEntry(&e)
-		require.NoError(t, err)
-		require.Equal(t, common.SegmentNoMoreReadStrong, code)
-		require.Equal(t, 0, n)
-	})
+		code, _, _ = s.ReadEntry(&e)
+		require.Equal(t, common.SegmentNoMoreReadWeak, code)
+		require.NoError(t, s.Close())
 
-	t.Run("WriteError", func(t *testing.T) {
-		s, err := NewSegment(&mockWriter{Buffer: bytes.NewBuffer(make([]byte, 0, 16))}, common.EntryV1, 2)
+		// zeros look like ending for readonly segment
+		fr, err = os.Open(path)
 		require.NoError(t, err)
-
-		// hiject another writer
-		s.w = newSegmentWriter(&mockWriterErr{onWrite: true}, common.EntryV1)
-
-		code, err := s.WriteEntry([]byte{})
+		r, _, err := NewReadOnlySegment(fr)
 		require.NoError(t, err)
-		require.Equal(t, common.NoError, code)
-
-		code, err = s.WriteEntry([]byte("alpha"))
-		require.Error(t, err)
-		require.Equal(t, common.SegmentCorrupted, code)
-
-		b := entry.NewBatch(2)
-		b.Append([]byte{1, 2, 3})
-
-		code, err = s.WriteBatch(b)
-		require.Error(t, err)
-		require.Equal(t, common.SegmentCorrupted, code)
+		for _, expect := range []string{"alpha", "beta"} {
+			code, _, err = r.ReadEntry(&e)
+			require.NoError(t, err)
+			require.Equal(t, common.NoError, code)
+			require.Equal(t, expect, string(e))
+		}
+		code, _, err = r.ReadEntry(&e)
+		require.NoError(t, err)
+		require.Equal(t, common.SegmentNoMoreReadStrong, code)
+		_ = r.Close() // closed on reaching ending
 	})
 
 	t.Run("ReadOnly", func(t *testing.T) {
@@ -166,12 +198,20 @@ func TestNewSegmentReadWrite(t *testing.T) {
 
 		// unsupported format
 		{
-			buffer := bytes.NewBuffer([]byte{0, 0, 0, 5})
+			buffer := bytes.NewBuffer([]byte{0, 0, 0, 0xff})
 			_, n, err := NewReadOnlySegment(newMockReadSeeker(buffer))
 			require.Error(t, err)
 			require.Equal(t, 4, n)
 		}
 
+		// untrusted format
+		{
+			buffer := bytes.NewBuffer([]byte{0, 0, 0, 0})
+			_, n, err := NewAuthenticatedSegment(newMockReadSeeker(buffer), nil)
+			require.Equal(t, common.ErrEntryAuthentication, err)
+			require.Equal(t, 4, n)
+		}
+
 		// corrupt
 		{
 			buffer := bytes.NewBuffer([]byte{0, 0, 0, 0, 1})
@@ -213,20 +253,20 @@ func TestNewSegmentReadWrite(t *testing.T) {
 
 			var e entry.Entry
 
-			code, n, err := s.readEntry(&e)
+			code, n, err := s.readEntry(&e, nil)
 			require.NoError(t, err)
 			require.Equal(t, common.SegmentNoMoreReadStrong, code)
 			require.Equal(t, 0, n)
 
 			// hijack the state
 			s.readOnly = false
-			code, n, err = s.readEntry(&e)
+			code, n, err = s.readEntry(&e, nil)
 			require.NoError(t, err)
 			require.Equal(t, common.SegmentNoMoreReadWeak, code)
 			require.Equal(t, 0, n)
 
 			_, _ = buffer.Write(segmentEnding)
-			code, n, err = s.readEntry(&e)
+			code, n, err = s.readEntry(&e, nil)
 			require.NoError(t, err)
 			require.Equal(t, common.SegmentNoMoreReadStrong, code)
 			require.Equal(t, 0, n)
@@ -319,3 +359,48 @@ func TestNewSegmentReadWrite(t *testing.T) {
 // 		require.Equal(t, 1, collectValue[i])
 // 	}
 // }
+
+type mockKeys struct{}
+
+func (mockKeys) CurrentKey() (string, []byte, error) {
+	return "k1", bytes.Repeat([]byte{1}, 32), nil
+}
+
+func (mockKeys) Key(string) ([]byte, error) {
+	return nil, nil
+}
+
+func TestCountEntries(t *testing.T) {
+	codec, err := entry.NewFlateCodec(flate.BestSpeed)
+	require.NoError(t, err)
+
+	for _, format := range []common.EntryFormat{common.EntryV3, common.EntryV4} {
+		buffer := bytes.NewBuffer(make([]byte, 0, 256))
+		s, err := NewSegmentWithSettings(&mockWriter{Buffer: buffer}, Settings{
+			EntryFormat:   format,
+			MaxEntries:    10,
+			Codec:         codec,
+			CompressBatch: true,
+			KeyProvider:   mockKeys{},
+		})
+		require.NoError(t, err)
+
+		_, err = s.WriteEntry([]byte("alpha"))
+		require.NoError(t, err)
+
+		b := entry.NewBatch(3)
+		b.Append([]byte("beta"))
+		b.Append([]byte("gamma"))
+		b.Append([]byte("delta"))
+		_, err = s.WriteBatch(b)
+		require.NoError(t, err)
+
+		// key is missing
+		_, _, err = NewReadOnlySegmentWithKeys(newMockReadSeeker(bytes.NewBuffer(buffer.Bytes())), mockKeys{})
+		require.Error(t, err)
+
+		count, err := CountEntries(newMockReadSeeker(buffer))
+		require.NoError(t, err)
+		require.EqualValues(t, 4, count)
+	}
+}
@@ -3,6 +3,7 @@ package segv1
 import (
 	"bufio"
 	"io"
+	"sync/atomic"
 
 	"github.com/linxGnu/pqueue/common"
 	"github.com/linxGnu/pqueue/entry"
@@ -16,6 +17,24 @@ type segmentWriter struct {
 	w           *bufio.Writer
 	underlying  io.WriteCloser
 	entryFormat common.EntryFormat
+	enc         *entry.Encoding // compression and encryption, nil if disabled
+
+	compressBatch bool   // write batch as one frame
+	frame         []byte // scratch payload of batch frame
+
+	footer *Footer // written after ending, nil if disabled
+}
+
+// countingWriter counts bytes written to underlying writer.
+type countingWriter struct {
+	n int64 // updated atomically, readers of segment are bounded by it
+	io.WriteCloser
+}
+
+func (c *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = c.WriteCloser.Write(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return
 }
 
 func newSegmentWriter(w io.WriteCloser, entryFormat common.EntryFormat) *segmentWriter {
@@ -28,13 +47,21 @@ func newSegmentWriter(w io.WriteCloser, entryFormat common.EntryFormat) *segment
 
 func (s *segmentWriter) Close() (err error) {
 	_, err = s.w.Write(segmentEnding)
+	if err == nil && s.footer != nil {
+		_, err = s.w.Write(s.footer.marshal())
+	}
 	err = multierror.Append(err, s.w.Flush(), s.underlying.Close()).ErrorOrNil()
 	return
 }
 
 // WriteEntry to underlying writer.
 func (s *segmentWriter) WriteEntry(e entry.Entry) (common.ErrCode, error) {
-	_, err := e.Marshal(s.w, s.entryFormat)
+	return s.WriteEntryWithMeta(e, entry.Meta{})
+}
+
+// WriteEntryWithMeta to underlying writer.
+func (s *segmentWriter) WriteEntryWithMeta(e entry.Entry, meta entry.Meta) (common.ErrCode, error) {
+	_, err := e.MarshalEncoded(s.w, s.entryFormat, meta, s.enc)
 	if err == nil {
 		err = s.w.Flush()
 	}
@@ -46,7 +73,12 @@ func (s *segmentWriter) WriteEntry(e entry.Entry) (common.ErrCode, error) {
 
 // WriteEntry to underlying writer.
 func (s *segmentWriter) WriteBatch(b entry.Batch) (common.ErrCode, error) {
-	_, err := b.Marshal(s.w, s.entryFormat)
+	var err error
+	if s.compressBatch && b.Len() > 1 {
+		err = s.writeFrame(b)
+	} else {
+		_, err = b.MarshalEncoded(s.w, s.entryFormat, s.enc)
+	}
 	if err == nil {
 		err = s.w.Flush()
 	}
@@ -55,3 +87,53 @@ func (s *segmentWriter) WriteBatch(b entry.Batch) (common.ErrCode, error) {
 	}
 	return common.SegmentCorrupted, err
 }
+
+// writeFrame writes entries of batch as one frame, unless the frame exceeds size limitation.
+func (s *segmentWriter) writeFrame(b entry.Batch) (err error) {
+	s.frame = b.AppendFrame(s.frame[:0])
+	if len(s.frame) > common.MaxEntrySize {
+		_, err = b.MarshalEncoded(s.w, s.entryFormat, s.enc)
+		return
+	}
+
+	meta := entry.Meta{Batch: b.Len()}
+	_, err = entry.Entry(s.frame).MarshalEncoded(s.w, s.entryFormat, meta, s.enc)
+	return
+}
+
+// WriteStream writes payload of given size from r as chunks to underlying writer.
+func (s *segmentWriter) WriteStream(r io.Reader, size int64, chunkSize int, meta entry.Meta) (common.ErrCode, error) {
+	if int64(chunkSize) > size {
+		chunkSize = int(size)
+	}
+	buf := make(entry.Entry, chunkSize)
+
+	chunkMeta := meta
+	for offset := int64(0); offset < size; {
+		chunk := buf
+		if remain := size - offset; remain < int64(len(chunk)) {
+			chunk = chunk[:remain]
+		}
+
+		// partial chunks might be flushed already, segment is not usable anymore
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return common.SegmentCorrupted, err
+		}
+
+		chunkMeta.Chunk = entry.Chunk{Total: size, Offset: offset}
+		if _, err := chunk.MarshalEncoded(s.w, s.entryFormat, chunkMeta, s.enc); err != nil {
+			return common.SegmentCorrupted, err
+		}
+
+		chunkMeta.ID = nil // stored with the first chunk only
+		offset += int64(len(chunk))
+	}
+
+	if err := s.w.Flush(); err != nil {
+		return common.SegmentCorrupted, err
+	}
+	return common.NoError, nil
+}
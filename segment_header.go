@@ -1,22 +1,49 @@
 package pqueue
 
 import (
+	"hash/crc32"
 	"io"
+	"time"
 
 	"github.com/linxGnu/pqueue/common"
 )
 
+const (
+	segmentHeaderV1Size = 4
+
+	// [Segment Format][Magic][Created][Sequence][Base][Checksum]
+	segmentHeaderV2Size = 4 + 4 + 8 + 8 + 8 + 4
+)
+
+// segmentInfo is recorded in header of SegmentV2.
+type segmentInfo struct {
+	created time.Time
+	seq     uint64
+	base    uint64
+}
+
 type segmentHeadWriter interface {
-	WriteHeader(io.WriteCloser, common.SegmentFormat) error
+	WriteHeader(io.WriteCloser, common.SegmentFormat, segmentInfo) error
 	ReadHeader(io.ReadCloser) (common.SegmentFormat, error)
 }
 
 type segmentHeader struct{}
 
-func (s *segmentHeader) WriteHeader(w io.WriteCloser, format common.SegmentFormat) (err error) {
-	var buf [4]byte
+func (s *segmentHeader) WriteHeader(w io.WriteCloser, format common.SegmentFormat, info segmentInfo) (err error) {
+	var buf [segmentHeaderV2Size]byte
 	common.Endianese.PutUint32(buf[:], format)
-	if _, err = w.Write(buf[:]); err != nil {
+
+	header := buf[:segmentHeaderV1Size]
+	if format == common.SegmentV2 {
+		copy(buf[4:], common.SegmentMagic)
+		common.Endianese.PutUint64(buf[8:], uint64(info.created.UnixNano()))
+		common.Endianese.PutUint64(buf[16:], info.seq)
+		common.Endianese.PutUint64(buf[24:], info.base)
+		common.Endianese.PutUint32(buf[32:], crc32.ChecksumIEEE(buf[:32]))
+		header = buf[:]
+	}
+
+	if _, err = w.Write(header); err != nil {
 		_ = w.Close()
 	}
 	return
@@ -24,11 +51,30 @@ func (s *segmentHeader) WriteHeader(w io.WriteCloser, format common.SegmentForma
 
 func (s *segmentHeader) ReadHeader(r io.ReadCloser) (format common.SegmentFormat, err error) {
 	// read segment header
-	var buf [4]byte
-	if _, err = io.ReadFull(r, buf[:]); err != nil {
-		_ = r.Close()
-	} else {
+	var buf [segmentHeaderV2Size]byte
+	if _, err = io.ReadFull(r, buf[:segmentHeaderV1Size]); err == nil {
 		format = common.Endianese.Uint32(buf[:])
+
+		// validate header of SegmentV2
+		if format == common.SegmentV2 {
+			if _, err = io.ReadFull(r, buf[segmentHeaderV1Size:]); err == nil &&
+				(string(buf[4:8]) != common.SegmentMagic ||
+					crc32.ChecksumIEEE(buf[:32]) != common.Endianese.Uint32(buf[32:])) {
+				err = common.ErrSegmentCorruptedHeader
+			}
+		}
+	}
+
+	if err != nil {
+		_ = r.Close()
 	}
 	return
 }
+
+// segmentHeaderSize returns size of segment header of given format.
+func segmentHeaderSize(format common.SegmentFormat) int64 {
+	if format == common.SegmentV2 {
+		return segmentHeaderV2Size
+	}
+	return segmentHeaderV1Size
+}
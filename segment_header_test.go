@@ -2,7 +2,11 @@ package pqueue
 
 import (
 	"bytes"
+	"io"
 	"testing"
+	"time"
+
+	"github.com/linxGnu/pqueue/common"
 
 	"github.com/stretchr/testify/require"
 )
@@ -12,12 +16,35 @@ func TestSegmentHeadRW(t *testing.T) {
 
 	t.Run("Happy", func(t *testing.T) {
 		buf := bytes.NewBuffer([]byte{})
-		require.NoError(t, sh.WriteHeader(&mockWriterErr{buf: buf}, 123))
+		require.NoError(t, sh.WriteHeader(&mockWriterErr{buf: buf}, 123, segmentInfo{}))
 		require.Equal(t, []byte{0, 0, 0, 123}, buf.Bytes())
 	})
 
+	t.Run("V2", func(t *testing.T) {
+		buf := bytes.NewBuffer([]byte{})
+		info := segmentInfo{created: time.Unix(0, 1), seq: 2, base: 3}
+		require.NoError(t, sh.WriteHeader(&mockWriterErr{buf: buf}, common.SegmentV2, info))
+		require.EqualValues(t, segmentHeaderV2Size, buf.Len())
+		data := append([]byte{}, buf.Bytes()...)
+
+		format, err := sh.ReadHeader(io.NopCloser(buf))
+		require.NoError(t, err)
+		require.Equal(t, common.SegmentV2, format)
+
+		// foreign or corrupted
+		for _, i := range []int{5, 20} {
+			corrupted := append([]byte{}, data...)
+			corrupted[i]++
+			_, err = sh.ReadHeader(io.NopCloser(bytes.NewReader(corrupted)))
+			require.Equal(t, common.ErrSegmentCorruptedHeader, err)
+		}
+
+		_, err = sh.ReadHeader(io.NopCloser(bytes.NewReader(data[:10])))
+		require.Error(t, err)
+	})
+
 	t.Run("Error", func(t *testing.T) {
 		buf := bytes.NewBuffer([]byte{})
-		require.Error(t, sh.WriteHeader(&mockWriterErr{buf: buf, onWrite: true}, 123))
+		require.Error(t, sh.WriteHeader(&mockWriterErr{buf: buf, onWrite: true}, 123, segmentInfo{}))
 	})
 }
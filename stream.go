@@ -0,0 +1,98 @@
+package pqueue
+
+import (
+	"container/list"
+	"io"
+
+	"github.com/linxGnu/pqueue/entry"
+)
+
+// Stream is a dequeued entry, whose payload is read from segment chunk by chunk. Memory usage
+// is bounded by chunk size regardless of entry size.
+//
+// Large entry is committed as dequeued once its Stream is closed. Until then, Stream of large
+// entry holds the reader lock of queue: every Dequeue, Peek, Seek, DropHead and Purge is blocked,
+// so are retention cleanup, archiving and Close of queue. Stream must be read promptly and always
+// closed, a leaked Stream blocks consumers forever.
+type Stream struct {
+	Position uint64
+	ID       []byte
+	Size     int64
+
+	q     *queue // nil if entry is committed already
+	front *list.Element
+	rec   entry.Record // current chunk
+	chunk entry.Entry  // unread part of current chunk
+	read  int64        // bytes of entry read from segment
+	err   error
+}
+
+// DequeueReader dequeues an entry as Stream. Returned Stream must be closed promptly, other
+// consumers are blocked until then (see Stream).
+func (q *queue) DequeueReader() (*Stream, bool) {
+	q.rLock.Lock()
+
+	s := &Stream{}
+	front, ok := q.dequeueHead(&s.rec)
+	if !ok {
+		q.rLock.Unlock()
+		return nil, false
+	}
+
+	s.Position, s.ID = s.rec.Position, s.rec.ID
+	s.chunk, s.read = s.rec.Entry, int64(len(s.rec.Entry))
+
+	if s.rec.Chunk.Total == 0 { // entry is in memory already
+		s.Size = s.read
+		q.commitOffset()
+		q.rLock.Unlock()
+		return s, true
+	}
+
+	s.Size = s.rec.Chunk.Total
+	s.q, s.front = q, front
+	s.rec.ID = nil
+	return s, true
+}
+
+// Read payload of entry.
+func (s *Stream) Read(p []byte) (n int, err error) {
+	for len(s.chunk) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.q == nil || s.read >= s.Size {
+			return 0, io.EOF
+		}
+		s.nextChunk()
+	}
+
+	n = copy(p, s.chunk)
+	s.chunk = s.chunk[n:]
+	return
+}
+
+func (s *Stream) nextChunk() {
+	if s.err = s.q.readChunk(s.front, s.Size, s.read, &s.rec); s.err == nil {
+		s.chunk = s.rec.Entry
+		s.read += int64(len(s.chunk))
+	}
+}
+
+// Close stream. Unread chunks are skipped, the entry is committed as dequeued.
+func (s *Stream) Close() error {
+	if s.q == nil {
+		return nil
+	}
+
+	for s.err == nil && s.read < s.Size {
+		s.nextChunk()
+	}
+	if s.err == nil {
+		s.q.commitOffset()
+	}
+
+	s.q.rLock.Unlock()
+	s.q, s.front, s.chunk = nil, nil, nil
+	return s.err
+}
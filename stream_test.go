@@ -0,0 +1,164 @@
+package pqueue
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/linxGnu/pqueue/common"
+	"github.com/linxGnu/pqueue/entry"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueueStream(t *testing.T) {
+	dataDir := filepath.Join(tmpDir, "pqueue_stream")
+	_ = os.RemoveAll(dataDir)
+	err := os.MkdirAll(dataDir, 0o777)
+	require.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(dataDir)
+	}()
+
+	t.Run("UnsupportedFormat", func(t *testing.T) {
+		q, err := New(dataDir, 3)
+		require.NoError(t, err)
+
+		_, err = q.EnqueueReader(bytes.NewReader([]byte{1}), 1)
+		require.Equal(t, common.ErrEntryUnsupportedFormat, err)
+		require.NoError(t, q.Purge())
+		_ = q.Close()
+	})
+
+	settings := QueueSettings{
+		DataDir:              dataDir,
+		EntryFormat:          common.EntryV2,
+		MaxEntriesPerSegment: 3,
+		StreamChunkSize:      10,
+	}
+
+	large := make([]byte, 95)
+	rand.Read(large)
+
+	q, err := NewWithSettings(settings)
+	require.NoError(t, err)
+
+	for i := 0; i < 4; i++ {
+		pos, err := q.Enqueue([]byte{byte(i)})
+		require.NoError(t, err)
+		require.EqualValues(t, 2*i, pos)
+
+		pos, err = q.EnqueueReader(bytes.NewReader(large), int64(len(large)))
+		require.NoError(t, err)
+		require.EqualValues(t, 2*i+1, pos)
+	}
+
+	// r fails: entry is discarded
+	_, err = q.EnqueueReader(bytes.NewReader(large[:50]), int64(len(large)))
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+
+	pos, err := q.Enqueue([]byte{4})
+	require.NoError(t, err)
+	require.EqualValues(t, 8, pos)
+
+	// assembled
+	var r entry.Record
+	require.True(t, q.DequeueRecord(&r))
+	require.EqualValues(t, []byte{0}, r.Entry)
+	require.True(t, q.DequeueRecord(&r))
+	require.EqualValues(t, 1, r.Position)
+	require.EqualValues(t, large, r.Entry)
+
+	// streamed
+	s, ok := q.DequeueReader()
+	require.True(t, ok)
+	require.EqualValues(t, 1, s.Size)
+	require.NoError(t, s.Close())
+
+	s, ok = q.DequeueReader()
+	require.True(t, ok)
+	require.EqualValues(t, 3, s.Position)
+	require.EqualValues(t, len(large), s.Size)
+	data, err := io.ReadAll(s)
+	require.NoError(t, err)
+	require.Equal(t, large, data)
+	require.NoError(t, s.Close())
+
+	// closed without reading all
+	require.True(t, q.DequeueRecord(&r))
+	s, ok = q.DequeueReader()
+	require.True(t, ok)
+	_, err = io.ReadFull(s, make([]byte, 15))
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	require.True(t, q.DequeueRecord(&r))
+	require.EqualValues(t, 6, r.Position)
+	_ = q.Close()
+
+	// persisted across restarts
+	q, err = NewWithSettings(settings)
+	require.NoError(t, err)
+
+	require.Equal(t, 1, q.DropHead(1))
+	require.True(t, q.DequeueRecord(&r))
+	require.EqualValues(t, 8, r.Position)
+	require.EqualValues(t, []byte{4}, r.Entry)
+	require.False(t, q.DequeueRecord(&r))
+
+	pos, err = q.Enqueue([]byte{5})
+	require.NoError(t, err)
+	require.EqualValues(t, 9, pos)
+
+	_, err = q.EnqueueReader(bytes.NewReader(large[:50]), int64(len(large)))
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+
+	pos, err = q.Enqueue([]byte{6})
+	require.NoError(t, err)
+	require.EqualValues(t, 10, pos)
+	_ = q.Close()
+
+	// discarded entry is skipped after restarting
+	q, err = NewWithSettings(settings)
+	require.NoError(t, err)
+
+	for i := 5; i <= 6; i++ {
+		require.True(t, q.DequeueRecord(&r))
+		require.EqualValues(t, i+4, r.Position)
+		require.EqualValues(t, []byte{byte(i)}, r.Entry)
+	}
+	require.False(t, q.DequeueRecord(&r))
+
+	// producers are not blocked until r is ready
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, err := q.EnqueueReader(pr, int64(len(large)))
+		done <- err
+	}()
+
+	pos, err = q.Enqueue([]byte{7})
+	require.NoError(t, err)
+	require.EqualValues(t, 11, pos)
+
+	_, err = pw.Write(large)
+	require.NoError(t, err)
+	require.NoError(t, <-done)
+
+	require.True(t, q.DequeueRecord(&r))
+	require.EqualValues(t, []byte{7}, r.Entry)
+	require.True(t, q.DequeueRecord(&r))
+	require.EqualValues(t, 12, r.Position)
+	require.EqualValues(t, large, r.Entry)
+
+	// r fails before first chunk
+	pr, pw = io.Pipe()
+	_ = pw.CloseWithError(io.ErrClosedPipe)
+	_, err = q.EnqueueReader(pr, int64(len(large)))
+	require.Equal(t, io.ErrClosedPipe, err)
+	require.False(t, q.DequeueRecord(&r))
+	_ = q.Close()
+}
@@ -0,0 +1,98 @@
+package pqueue
+
+import (
+	"hash/crc32"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/linxGnu/pqueue/common"
+	"github.com/linxGnu/pqueue/vfs"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// [Timestamp - int64][Entry - uint64][Offset - int64][Checksum - uint32]
+const timePointSize = 8 + 8 + 8 + 4
+
+// Time index layout:
+//
+// [Record][Record]...
+//
+// Record layout:
+//
+// [Timestamp - int64][Entry - uint64][Offset - int64][Checksum - uint32]
+//
+// Note:
+// - `Timestamp` is unix nano when entry was enqueued
+// - `Entry` is index of entry inside segment, `Offset` is byte offset of the entry (or batch
+// frame containing it) inside segment file
+// - `Checksum` is crc32_IEEE of preceding bytes of record
+// - records are appended at most once per TimeIndexInterval, torn record at the end is ignored
+type timePoint struct {
+	ts     int64
+	entry  uint64
+	offset int64
+}
+
+func timeIndexFilePath(segmentFilePath string) string {
+	return segmentFilePath + segTimeIndexFileSuffix
+}
+
+// appendTimePoint to time index file.
+func appendTimePoint(fs vfs.FS, path string, p timePoint) (err error) {
+	var buf [timePointSize]byte
+	common.Endianese.PutUint64(buf[:], uint64(p.ts))
+	common.Endianese.PutUint64(buf[8:], p.entry)
+	common.Endianese.PutUint64(buf[16:], uint64(p.offset))
+	common.Endianese.PutUint32(buf[24:], crc32.ChecksumIEEE(buf[:24]))
+
+	f, err := fs.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return
+	}
+
+	_, err = f.Write(buf[:])
+	return multierror.Append(err, f.Close()).ErrorOrNil()
+}
+
+// loadTimeIndex reads points of time index file, until the first corrupted one.
+func loadTimeIndex(fs vfs.FS, path string) ([]timePoint, error) {
+	data, err := vfs.ReadFile(fs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	points := make([]timePoint, 0, len(data)/timePointSize)
+	for ; len(data) >= timePointSize; data = data[timePointSize:] {
+		if crc32.ChecksumIEEE(data[:24]) != common.Endianese.Uint32(data[24:]) {
+			break
+		}
+
+		points = append(points, timePoint{
+			ts:     int64(common.Endianese.Uint64(data)),
+			entry:  common.Endianese.Uint64(data[8:]),
+			offset: int64(common.Endianese.Uint64(data[16:])),
+		})
+	}
+	return points, nil
+}
+
+// seekTimePoint returns the point of the first entry which might be enqueued at or after t.
+// Entries following a point are enqueued within interval after it, otherwise another point
+// would be recorded.
+func seekTimePoint(points []timePoint, t time.Time, interval time.Duration) (p timePoint, ok bool) {
+	if len(points) == 0 {
+		return
+	}
+
+	ts := t.UnixNano()
+	i := sort.Search(len(points), func(i int) bool {
+		return points[i].ts >= ts
+	})
+	if i > 0 && (i == len(points) || ts-points[i-1].ts < int64(interval)) {
+		i-- // t might fall into entries following the previous point
+	}
+
+	return points[i], true
+}
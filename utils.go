@@ -3,6 +3,7 @@ package pqueue
 import (
 	"container/list"
 	"fmt"
+	"math"
 	"os"
 	"path"
 	"path/filepath"
@@ -10,96 +11,401 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/linxGnu/pqueue/common"
+	"github.com/linxGnu/pqueue/entry"
+	segv1 "github.com/linxGnu/pqueue/segment/v1"
+	"github.com/linxGnu/pqueue/vfs"
 )
 
 type file struct {
-	modTime time.Time
-	path    string
+	path     string
+	seq      uint64 // order of segment file
+	base     uint64
+	hasBase  bool // legacy segment file does not have base position in its name
+	archived bool // segment file is in archive directory
 }
 
 func load(settings QueueSettings, segHeader segmentHeadWriter) (*queue, error) {
-	if settings.MaxEntriesPerSegment <= 0 {
-		settings.MaxEntriesPerSegment = DefaultMaxEntriesPerSegment
+	setDefaults(&settings)
+	if settings.CompressionThreshold <= 0 {
+		settings.CompressionThreshold = DefaultCompressionThreshold
+	}
+	if settings.Codec != nil && entry.LookupCodec(settings.Codec.ID()) == nil {
+		return nil, common.ErrEntryUnknownCodec
+	}
+	if settings.ArchiveCodec != nil && entry.LookupCodec(settings.ArchiveCodec.ID()) == nil {
+		return nil, common.ErrEntryUnknownCodec
 	}
 
-	files, err := loadFileInfos(settings.DataDir, fileInfoExtractor)
+	if settings.FS == nil {
+		settings.FS = vfs.OS
+	}
+
+	// data directory is used by single queue at a time
+	lock, err := settings.FS.Lock(filepath.Join(settings.DataDir, lockFileName))
 	if err != nil {
 		return nil, err
 	}
 
-	segments := list.New()
+	q, err := loadSegments(settings, segHeader)
+	if err != nil {
+		_ = lock.Close()
+		return nil, err
+	}
+	q.lock = lock
+
+	q.startBackground()
+	return q, nil
+}
+
+// loadSegments of data directory and creates new segment for upcoming entries.
+func loadSegments(settings QueueSettings, segHeader segmentHeadWriter) (*queue, error) {
+	files, err := loadFileInfos(settings.FS, settings.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(settings.ArchiveDir) > 0 {
+		if files, err = loadArchivedFileInfos(settings.FS, settings.DataDir, settings.ArchiveDir, files); err != nil {
+			return nil, err
+		}
+	}
+
+	// manifest takes precedence, it's rebuilt from files if missing or corrupted
+	m := newManifest(settings.FS, filepath.Join(settings.DataDir, manifestFileName))
+	if m.load() == nil {
+		if len(settings.ArchiveDir) == 0 {
+			for i := range m.records {
+				if m.records[i].archived {
+					return nil, common.ErrArchiveDirRequired
+				}
+			}
+		}
+		var purged []file
+		if files, purged = m.order(files); len(purged) > 0 {
+			removePurgedFiles(settings.FS, purged)
+		}
+	}
+	m.records = m.records[:0]
+
+	q := &queue{
+		settings:      settings,
+		segHeadWriter: segHeader,
+		segments:      list.New(),
+		retained:      list.New(),
+	}
+
 	for i := range files {
-		segments.PushBack(&segment{
+		seg := &segment{
 			readable: false,
 			path:     files[i].path,
+			base:     q.nextPos,
+			archived: files[i].archived,
+		}
+		if files[i].hasBase && files[i].base > seg.base {
+			seg.base = files[i].base
+		}
+		q.segments.PushBack(seg)
+		m.records = append(m.records, manifestRecord{
+			name:     filepath.Base(seg.path),
+			base:     seg.base,
+			archived: seg.archived,
 		})
+
+		// base position of the next segment
+		if i+1 < len(files) && files[i+1].hasBase {
+			q.nextPos = files[i+1].base
+		} else {
+			count, _ := q.countEntries(seg.path)
+			q.nextPos = seg.base + count
+		}
 	}
 
-	// create new segment for upcoming entries
-	q := &queue{
-		settings:      settings,
-		segHeadWriter: segHeader,
+	// remembered IDs for deduplication, the ones of purged entries are forgotten
+	q.manifest = m
+	if settings.DedupMaxIDs > 0 || settings.DedupWindow > 0 {
+		if err = q.loadDedup(time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	// create new segment for upcoming entries, manifest is persisted along with it
+	for i := range files {
+		if files[i].seq >= q.nextSeq {
+			q.nextSeq = files[i].seq + 1
+		}
 	}
 
 	seg, err := q.newSegment()
 	if err != nil {
 		return nil, err
 	}
-	segments.PushBack(seg)
+	q.segments.PushBack(seg)
 
-	q.segments = segments
 	return q, nil
 }
 
-func loadFileInfos(dir string, infoExtractor func(os.DirEntry) (os.FileInfo, error)) ([]file, error) {
-	fileList, err := os.ReadDir(dir)
+// removePurgedFiles removes segment files left behind by purging, along with their offset trackers
+// and time indexes.
+func removePurgedFiles(fs vfs.FS, files []file) {
+	for i := range files {
+		_ = fs.Remove(files[i].path)
+		_ = fs.Remove(offsetFilePath(files[i].path))
+		_ = fs.Remove(timeIndexFilePath(files[i].path))
+	}
+}
+
+// setDefaults of segment limits and chunk size.
+func setDefaults(settings *QueueSettings) {
+	if settings.MaxEntriesPerSegment <= 0 {
+		if settings.MaxBytesPerSegment > 0 {
+			settings.MaxEntriesPerSegment = math.MaxUint32
+		} else {
+			settings.MaxEntriesPerSegment = DefaultMaxEntriesPerSegment
+		}
+	}
+	if settings.StreamChunkSize <= 0 || settings.StreamChunkSize > common.MaxEntrySize {
+		settings.StreamChunkSize = DefaultStreamChunkSize
+	}
+}
+
+// startBackground routines of queue, which are stopped by Close.
+func (q *queue) startBackground() {
+	settings := &q.settings
+	q.closing = make(chan struct{})
+
+	// cleanup retained segments in background
+	if settings.RetainConsumed && (settings.RetentionMaxAge > 0 || settings.RetentionMaxBytes > 0) {
+		interval := settings.RetentionCheckInterval
+		if interval <= 0 {
+			interval = DefaultRetentionCheckInterval
+		}
+
+		q.wg.Add(1)
+		go q.runRetention(interval)
+	}
+
+	// seal aged segments in background
+	if settings.MaxSegmentAge > 0 {
+		q.wg.Add(1)
+		go q.runRotation(settings.MaxSegmentAge)
+	}
+
+	// archive cold segments in background
+	if len(settings.ArchiveDir) > 0 {
+		interval := settings.ArchiveCheckInterval
+		if interval <= 0 {
+			interval = DefaultArchiveCheckInterval
+		}
+
+		q.wg.Add(1)
+		go q.runArchiving(interval)
+	}
+}
+
+// loadFileInfos lists segment files of dir in order of their sequence.
+func loadFileInfos(fs vfs.FS, dir string) ([]file, error) {
+	fileList, err := fs.ReadDir(dir)
 	if err != nil {
 		return nil, err
 	}
 
 	files := make([]file, 0, len(fileList))
-	for i := range fileList {
-		fileName := fileList[i].Name()
+	for _, fileName := range fileList {
 
 		if strings.HasPrefix(fileName, segPrefix) &&
-			!strings.HasSuffix(fileName, segOffsetFileSuffix) {
-			// extract file info
-			info, e := infoExtractor(fileList[i])
-			if e != nil {
-				return nil, e
-			}
-
-			// add to list
-			files = append(files, file{
-				path:    filepath.Join(dir, fileList[i].Name()),
-				modTime: info.ModTime(),
-			})
+			!strings.HasSuffix(fileName, segOffsetFileSuffix) &&
+			!strings.HasSuffix(fileName, segTimeIndexFileSuffix) &&
+			!strings.HasSuffix(fileName, segTempFileSuffix) {
+			files = append(files, parseSegmentName(dir, fileName))
 		}
 	}
 
-	sort.Slice(files, func(i, j int) bool {
-		return files[i].modTime.Before(files[j].modTime)
-	})
+	sortFiles(files)
+	return files, nil
+}
+
+// loadArchivedFileInfos adds segment files of archive directory to files of data directory, in
+// order of their sequence. Interrupted archiving or restoring is cleaned up: partial copies are
+// removed, so is archive of segment which is found in data directory too.
+func loadArchivedFileInfos(fs vfs.FS, dataDir, archiveDir string, files []file) ([]file, error) {
+	if err := fs.MkdirAll(archiveDir, 0o700); err != nil {
+		return nil, err
+	}
+	removeTempFiles(fs, dataDir)
+	removeTempFiles(fs, archiveDir)
+
+	archived, err := loadFileInfos(fs, archiveDir)
+	if err != nil {
+		return nil, err
+	}
+
+	hot := make(map[string]struct{}, len(files))
+	for i := range files {
+		hot[filepath.Base(files[i].path)] = struct{}{}
+	}
+
+	for _, f := range archived {
+		if _, ok := hot[filepath.Base(f.path)]; ok {
+			dst := filepath.Join(dataDir, filepath.Base(f.path))
+			_ = fs.Rename(timeIndexFilePath(f.path), timeIndexFilePath(dst))
+			_ = fs.Remove(f.path)
+			continue
+		}
+
+		f.archived = true
+		files = append(files, f)
+	}
 
+	sortFiles(files)
 	return files, nil
 }
 
-func fileInfoExtractor(f os.DirEntry) (os.FileInfo, error) {
-	return f.Info()
+// removeTempFiles removes files of dir which are being written by archiving or restoring.
+func removeTempFiles(fs vfs.FS, dir string) {
+	names, err := fs.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, name := range names {
+		if strings.HasPrefix(name, archiveTempPrefix) {
+			_ = fs.Remove(filepath.Join(dir, name))
+		}
+	}
+}
+
+// sortFiles in order of their sequence.
+func sortFiles(files []file) {
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].seq != files[j].seq {
+			return files[i].seq < files[j].seq
+		}
+		return files[i].path < files[j].path
+	})
 }
 
-func createFile(dir, prefix string) (f *os.File, err error) {
-	prefix = path.Join(dir, prefix)
+// parseSegmentName extracts sequence and base position from name of segment file: seg_<seq>_<base>.
+// Legacy segment files are named by their creation time (unix nano), which works as sequence.
+func parseSegmentName(dir, fileName string) (f file) {
+	f.path = filepath.Join(dir, fileName)
+
+	seq := fileName[len(segPrefix):]
+	if sep := strings.LastIndex(fileName, segBaseSeparator); sep >= len(segPrefix) {
+		var e error
+		f.base, e = strconv.ParseUint(fileName[sep+len(segBaseSeparator):], 10, 64)
+		f.hasBase = e == nil
+		seq = fileName[len(segPrefix):sep]
+	}
+	f.seq, _ = strconv.ParseUint(seq, 10, 64)
+
+	return
+}
 
-	for attempt := 0; attempt < 10_000; attempt++ {
-		name := prefix + strconv.FormatInt(time.Now().UnixNano(), 10)
+// createSegmentFile creates segment file with given sequence and base position. Sequence is
+// increased if file exists already, the used one is returned. So it is if offset tracker or time
+// index of removed segment is left behind, they would be taken by the new segment otherwise.
+func createSegmentFile(fs vfs.FS, dir string, seq, base uint64) (f vfs.File, _ uint64, err error) {
+	for attempt := 0; attempt < 10_000; attempt, seq = attempt+1, seq+1 {
+		name := path.Join(dir, fmt.Sprintf("%s%020d%s%d", segPrefix, seq, segBaseSeparator, base))
+		if isStale(fs, offsetFilePath(name)) || isStale(fs, timeIndexFilePath(name)) {
+			continue
+		}
 
-		f, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		f, err = vfs.CreateExclusive(fs, name, 0o600)
 		if !os.IsExist(err) {
-			return
+			return f, seq, err
 		}
 	}
 
 	err = fmt.Errorf("creating file but fail. path: %s", dir)
 	return
 }
+
+// isStale returns true if file of removed segment exists.
+func isStale(fs vfs.FS, path string) bool {
+	_, err := fs.Stat(path)
+	return err == nil
+}
+
+// countEntries reads through segment file and counts its entries. Footer of sealed SegmentV2
+// is taken instead if available. Entries whose key is missing are counted without decrypting them.
+func (q *queue) countEntries(path string) (uint64, error) {
+	if footer, err := q.readFooter(path); err == nil {
+		return footer.Entries, nil
+	}
+
+	count, err := q.scanEntries(&segment{path: path}, nil)
+	if isKeyMissing(err) {
+		count, err = q.countOpaqueEntries(path)
+	}
+	return count, err
+}
+
+// countOpaqueEntries counts entries of segment file without their key, see segv1.CountEntries.
+func (q *queue) countOpaqueEntries(path string) (count uint64, err error) {
+	format, f, err := q.openSegmentForRead(path)
+	if err != nil {
+		return
+	}
+
+	if format == common.SegmentV1 || format == common.SegmentV2 {
+		count, err = segv1.CountEntries(f)
+	} else {
+		err = common.ErrSegmentUnsupportedFormat
+	}
+
+	_ = f.Close()
+	return
+}
+
+// scanEntries reads through segment file, calls fn (if not nil) for every entry. Segment
+// is opened separately, reading state of s is untouched. Error is returned if segment could
+// not be opened.
+func (q *queue) scanEntries(s *segment, fn func(*entry.Record)) (count uint64, err error) {
+	format, f, err := q.openSegmentForRead(s.path)
+	if err != nil {
+		return
+	}
+
+	reader := &segment{path: s.path}
+	if _, err = q.startReadingSegment(format, reader, f); err != nil {
+		_ = f.Close()
+		return
+	}
+
+	var (
+		r  entry.Record
+		id []byte // of large entry, stored with its first chunk
+	)
+	for {
+		code, _, _ := reader.seg.ReadEntryWithMeta(&r.Entry, &r.Meta)
+		if code == common.EntryUnauthenticated || code == common.EntryUndecryptable { // entry still takes its position
+			count++
+			continue
+		}
+		if code != common.NoError {
+			break
+		}
+
+		// large entry counts once its last chunk is read
+		if chunk := r.Chunk; chunk.Total > 0 {
+			if chunk.Offset == 0 {
+				id = append(id[:0], r.ID...)
+			}
+			if !chunk.IsLast(len(r.Entry)) {
+				continue
+			}
+			r.ID = append(r.ID[:0], id...)
+		}
+
+		if fn != nil {
+			r.Position = s.base + count
+			fn(&r)
+		}
+		count++
+	}
+
+	_ = reader.seg.Close()
+	return
+}
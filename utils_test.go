@@ -1,18 +1,20 @@
 package pqueue
 
 import (
-	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/linxGnu/pqueue/common"
+	"github.com/linxGnu/pqueue/vfs"
 
 	"github.com/stretchr/testify/require"
 )
 
 func TestLoadInfos(t *testing.T) {
 	t.Run("Invalid", func(t *testing.T) {
-		_, err := loadFileInfos("/abc", nil)
+		_, err := loadFileInfos(vfs.OS, "/abc")
 		require.Error(t, err)
 	})
 
@@ -25,17 +27,50 @@ func TestLoadInfos(t *testing.T) {
 		require.NoError(t, err)
 		require.NoError(t, f2.Close())
 
-		_, err = loadFileInfos(tmpDir, func(os.DirEntry) (os.FileInfo, error) {
-			return nil, fmt.Errorf("fake error")
-		})
-		require.Error(t, err)
-
-		files, err := loadFileInfos(tmpDir, fileInfoExtractor)
+		files, err := loadFileInfos(vfs.OS, tmpDir)
 		require.NoError(t, err)
 		for i := range files {
 			_ = os.Remove(files[i].path)
 		}
 	})
+
+	t.Run("Sequence", func(t *testing.T) {
+		dir := filepath.Join(tmpDir, "pqueue_load_infos")
+		_ = os.RemoveAll(dir)
+		require.NoError(t, os.MkdirAll(dir, 0o777))
+		defer func() {
+			_ = os.RemoveAll(dir)
+		}()
+
+		for _, name := range []string{"seg_10_7", "seg_9", "seg_00000000000000000002_3", "seg_10_7.offset", "manifest"} {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0o644))
+		}
+
+		// touched file does not change ordering
+		require.NoError(t, os.Chtimes(filepath.Join(dir, "seg_00000000000000000002_3"), time.Now(), time.Now().Add(time.Hour)))
+
+		files, err := loadFileInfos(vfs.OS, dir)
+		require.NoError(t, err)
+		require.Equal(t, []file{
+			{path: filepath.Join(dir, "seg_00000000000000000002_3"), seq: 2, base: 3, hasBase: true},
+			{path: filepath.Join(dir, "seg_9"), seq: 9},
+			{path: filepath.Join(dir, "seg_10_7"), seq: 10, base: 7, hasBase: true},
+		}, files)
+
+		// sequence is taken already
+		f, seq, err := createSegmentFile(vfs.OS, dir, 2, 3)
+		require.NoError(t, err)
+		require.EqualValues(t, 3, seq)
+		require.Equal(t, filepath.Join(dir, "seg_00000000000000000003_3"), f.Name())
+		require.NoError(t, f.Close())
+
+		// offset tracker of removed segment is left behind
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "seg_00000000000000000004_5.offset"), nil, 0o644))
+		f, seq, err = createSegmentFile(vfs.OS, dir, 4, 5)
+		require.NoError(t, err)
+		require.EqualValues(t, 5, seq)
+		require.NoError(t, f.Close())
+	})
 }
 
 func TestLoading(t *testing.T) {
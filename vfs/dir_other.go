@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package vfs
+
+import "os"
+
+// syncDir only checks that directory exists, directories are not synced on other platforms.
+func syncDir(dir string) error {
+	_, err := os.Stat(dir)
+	return err
+}
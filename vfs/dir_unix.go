@@ -0,0 +1,20 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package vfs
+
+import "os"
+
+// syncDir syncs directory, so that its entries are durable.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	err = f.Sync()
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
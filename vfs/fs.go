@@ -0,0 +1,73 @@
+// Package vfs abstracts file system which queue stores its files on.
+package vfs
+
+import (
+	"io"
+	"os"
+)
+
+// File is an opened file of FS, i.e *os.File.
+type File interface {
+	io.ReadWriteSeeker
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// FS is file system. Errors are reported as by package os, i.e os.IsNotExist and os.IsExist
+// work with them.
+type FS interface {
+	// OpenFile opens named file with flags (os.O_RDONLY, os.O_CREATE, os.O_EXCL...) and permission,
+	// as os.OpenFile does.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+
+	// Remove named file or empty directory.
+	Remove(name string) error
+
+	// Rename file, replacing newpath if it exists.
+	Rename(oldpath, newpath string) error
+
+	// SyncDir makes creating, renaming and removing files inside directory durable.
+	SyncDir(dir string) error
+
+	// ReadDir returns names of entries inside directory, sorted.
+	ReadDir(dir string) ([]string, error)
+
+	// MkdirAll creates directory along with its missing parents.
+	MkdirAll(dir string, perm os.FileMode) error
+
+	// Stat returns info of named file.
+	Stat(name string) (os.FileInfo, error)
+
+	// Lock takes exclusive lock of named file, which is created if missing. Lock is released
+	// by closing returned Closer. common.ErrFileLocked is returned if it's held already.
+	Lock(name string) (io.Closer, error)
+}
+
+// Open named file for reading.
+func Open(fs FS, name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// CreateExclusive creates named file for reading and writing. It fails if file exists already.
+func CreateExclusive(fs FS, name string, perm os.FileMode) (File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+}
+
+// ReadFile reads whole named file.
+func ReadFile(fs FS, name string) ([]byte, error) {
+	f, err := Open(fs, name)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(f)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return data, err
+}
@@ -0,0 +1,195 @@
+package vfs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/linxGnu/pqueue/common"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFS(t *testing.T) {
+	t.Run("OS", func(t *testing.T) {
+		testFS(t, OS, t.TempDir())
+	})
+
+	t.Run("Mem", func(t *testing.T) {
+		testFS(t, NewMem(), "/data")
+	})
+}
+
+func testFS(t *testing.T, fs FS, dir string) {
+	require.NoError(t, fs.MkdirAll(filepath.Join(dir, "sub"), 0o700))
+	require.NoError(t, fs.MkdirAll(dir, 0o700))
+
+	info, err := fs.Stat(filepath.Join(dir, "sub"))
+	require.NoError(t, err)
+	require.True(t, info.IsDir())
+
+	// missing file or parent
+	_, err = Open(fs, filepath.Join(dir, "a"))
+	require.True(t, os.IsNotExist(err))
+	_, err = CreateExclusive(fs, filepath.Join(dir, "missing", "a"), 0o600)
+	require.True(t, os.IsNotExist(err))
+	_, err = fs.Stat(filepath.Join(dir, "a"))
+	require.True(t, os.IsNotExist(err))
+
+	// create and write
+	f, err := CreateExclusive(fs, filepath.Join(dir, "a"), 0o600)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "a"), f.Name())
+
+	_, err = CreateExclusive(fs, filepath.Join(dir, "a"), 0o600)
+	require.True(t, os.IsExist(err))
+
+	_, err = f.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("world"), 10)
+	require.NoError(t, err)
+	require.NoError(t, f.Sync())
+
+	info, err = f.Stat()
+	require.NoError(t, err)
+	require.EqualValues(t, 15, info.Size())
+
+	// gap is filled with zeros
+	buf := make([]byte, 15)
+	_, err = f.ReadAt(buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, "hello\x00\x00\x00\x00\x00world", string(buf))
+
+	_, err = f.ReadAt(buf, 10)
+	require.Equal(t, io.EOF, err)
+
+	off, err := f.Seek(-5, io.SeekEnd)
+	require.NoError(t, err)
+	require.EqualValues(t, 10, off)
+	n, err := f.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "world", string(buf[:n]))
+	_, err = f.Read(buf)
+	require.Equal(t, io.EOF, err)
+
+	require.NoError(t, f.Truncate(5))
+	require.NoError(t, f.Close())
+
+	data, err := ReadFile(fs, filepath.Join(dir, "a"))
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+
+	// appending
+	f, err = fs.OpenFile(filepath.Join(dir, "a"), os.O_WRONLY|os.O_APPEND, 0o600)
+	require.NoError(t, err)
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("!"))
+	require.NoError(t, err)
+	_, err = f.Read(buf)
+	require.Error(t, err) // write only
+	require.NoError(t, f.Close())
+
+	data, err = ReadFile(fs, filepath.Join(dir, "a"))
+	require.NoError(t, err)
+	require.Equal(t, "hello!", string(data))
+
+	// read only
+	f, err = Open(fs, filepath.Join(dir, "a"))
+	require.NoError(t, err)
+	_, err = f.Write([]byte("x"))
+	require.Error(t, err)
+	require.NoError(t, f.Close())
+
+	// truncating
+	f, err = fs.OpenFile(filepath.Join(dir, "a"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	info, err = fs.Stat(filepath.Join(dir, "a"))
+	require.NoError(t, err)
+	require.EqualValues(t, 0, info.Size())
+	require.False(t, info.IsDir())
+
+	// listing, renaming, removing
+	f, err = CreateExclusive(fs, filepath.Join(dir, "b"), 0o600)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("bb"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	names, err := fs.ReadDir(dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b", "sub"}, names)
+
+	_, err = fs.ReadDir(filepath.Join(dir, "missing"))
+	require.True(t, os.IsNotExist(err))
+
+	require.NoError(t, fs.Rename(filepath.Join(dir, "b"), filepath.Join(dir, "sub", "c")))
+	require.NoError(t, fs.Rename(filepath.Join(dir, "sub", "c"), filepath.Join(dir, "a"))) // replaced
+	require.True(t, os.IsNotExist(fs.Rename(filepath.Join(dir, "b"), filepath.Join(dir, "c"))))
+
+	data, err = ReadFile(fs, filepath.Join(dir, "a"))
+	require.NoError(t, err)
+	require.Equal(t, "bb", string(data))
+
+	names, err = fs.ReadDir(dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "sub"}, names)
+
+	require.NoError(t, fs.SyncDir(dir))
+	require.True(t, os.IsNotExist(fs.SyncDir(filepath.Join(dir, "missing"))))
+
+	require.NoError(t, fs.Remove(filepath.Join(dir, "a")))
+	require.True(t, os.IsNotExist(fs.Remove(filepath.Join(dir, "a"))))
+	require.NoError(t, fs.Remove(filepath.Join(dir, "sub")))
+
+	names, err = fs.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, names)
+
+	// locking
+	lock, err := fs.Lock(filepath.Join(dir, "lock"))
+	require.NoError(t, err)
+
+	_, err = fs.Lock(filepath.Join(dir, "lock"))
+	require.ErrorIs(t, err, common.ErrFileLocked)
+
+	require.NoError(t, lock.Close())
+	lock, err = fs.Lock(filepath.Join(dir, "lock"))
+	require.NoError(t, err)
+	require.NoError(t, lock.Close())
+}
+
+func TestMemFile(t *testing.T) {
+	fs := NewMem()
+
+	f, err := CreateExclusive(fs, "a", 0o600)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{1, 2, 3})
+	require.NoError(t, err)
+
+	// removed file is kept by its handles
+	require.NoError(t, fs.Remove("a"))
+	buf := make([]byte, 3)
+	_, err = f.ReadAt(buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 3}, buf)
+
+	_, err = f.Seek(-1, io.SeekStart)
+	require.Error(t, err)
+
+	require.NoError(t, f.Close())
+	require.Error(t, f.Close())
+	_, err = f.Read(buf)
+	require.Error(t, err)
+
+	_, err = fs.OpenFile("/", os.O_RDONLY, 0)
+	require.Error(t, err)
+
+	// directory with entries is not removed
+	require.NoError(t, fs.MkdirAll("/x/y", 0o700))
+	require.Error(t, fs.Remove("/x"))
+	_, err = CreateExclusive(fs, "/x/y", 0o600)
+	require.Error(t, err)
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package vfs
+
+import "os"
+
+// lockFile is no-op, files are not locked on other platforms.
+func lockFile(*os.File) error {
+	return nil
+}
@@ -0,0 +1,21 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package vfs
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"github.com/linxGnu/pqueue/common"
+)
+
+// lockFile takes exclusive advisory lock (flock) of file, without blocking.
+func lockFile(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return common.ErrFileLocked
+	}
+	return err
+}
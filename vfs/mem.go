@@ -0,0 +1,439 @@
+package vfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/linxGnu/pqueue/common"
+)
+
+// memFS is file system kept in memory. Directories "." and "/" always exist.
+type memFS struct {
+	mu    sync.Mutex
+	files map[string]*memData
+	dirs  map[string]time.Time // modification time of directories
+	locks map[string]bool
+}
+
+// NewMem creates empty file system, which is kept in memory. Opened files keep their data
+// after being removed or renamed, as files of operating system do.
+func NewMem() FS {
+	now := time.Now()
+	return &memFS{
+		files: make(map[string]*memData),
+		dirs:  map[string]time.Time{".": now, "/": now},
+		locks: make(map[string]bool),
+	}
+}
+
+func (m *memFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = filepath.Clean(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, ok := m.files[name]
+	switch {
+	case ok && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+
+	case !ok && flag&os.O_CREATE == 0:
+		if _, isDir := m.dirs[name]; isDir {
+			return nil, &os.PathError{Op: "open", Path: name, Err: errIsDir}
+		}
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+
+	case !ok:
+		if _, isDir := m.dirs[filepath.Dir(name)]; !isDir {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		if _, isDir := m.dirs[name]; isDir {
+			return nil, &os.PathError{Op: "open", Path: name, Err: errIsDir}
+		}
+
+		d = &memData{mode: perm, modTime: time.Now()}
+		m.files[name] = d
+	}
+
+	if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		_ = d.truncate(0)
+	}
+
+	return &memFile{name: name, data: d, flag: flag}, nil
+}
+
+func (m *memFS) Remove(name string) error {
+	name = filepath.Clean(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+
+	if _, ok := m.dirs[name]; ok {
+		if len(m.list(name)) > 0 {
+			return &os.PathError{Op: "remove", Path: name, Err: errNotEmpty}
+		}
+		delete(m.dirs, name)
+		return nil
+	}
+
+	return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+}
+
+func (m *memFS) Rename(oldpath, newpath string) error {
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, ok := m.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	if _, isDir := m.dirs[filepath.Dir(newpath)]; !isDir {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+
+	delete(m.files, oldpath)
+	m.files[newpath] = d
+	return nil
+}
+
+func (m *memFS) SyncDir(dir string) error {
+	dir = filepath.Clean(dir)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.dirs[dir]; !ok {
+		return &os.PathError{Op: "sync", Path: dir, Err: os.ErrNotExist}
+	}
+	return nil
+}
+
+func (m *memFS) ReadDir(dir string) ([]string, error) {
+	dir = filepath.Clean(dir)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.dirs[dir]; !ok {
+		return nil, &os.PathError{Op: "readdir", Path: dir, Err: os.ErrNotExist}
+	}
+
+	names := m.list(dir)
+	sort.Strings(names)
+	return names, nil
+}
+
+// list names of files and directories inside dir.
+func (m *memFS) list(dir string) (names []string) {
+	for name := range m.files {
+		if filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	for name := range m.dirs {
+		if name != dir && filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	return
+}
+
+func (m *memFS) MkdirAll(dir string, _ os.FileMode) error {
+	dir = filepath.Clean(dir)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for p := dir; ; p = filepath.Dir(p) {
+		if _, ok := m.files[p]; ok {
+			return &os.PathError{Op: "mkdir", Path: p, Err: errNotDir}
+		}
+		if _, ok := m.dirs[p]; ok {
+			return nil
+		}
+		m.dirs[p] = time.Now()
+	}
+}
+
+func (m *memFS) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if d, ok := m.files[name]; ok {
+		return d.stat(name), nil
+	}
+	if modTime, ok := m.dirs[name]; ok {
+		return &memFileInfo{name: filepath.Base(name), mode: os.ModeDir | 0o755, modTime: modTime}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (m *memFS) Lock(name string) (io.Closer, error) {
+	f, err := m.OpenFile(name, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	_ = f.Close()
+
+	name = filepath.Clean(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.locks[name] {
+		return nil, common.ErrFileLocked
+	}
+	m.locks[name] = true
+
+	return &memLock{fs: m, name: name}, nil
+}
+
+// memLock releases lock of file on closing.
+type memLock struct {
+	fs   *memFS
+	name string
+	once sync.Once
+}
+
+func (l *memLock) Close() error {
+	l.once.Do(func() {
+		l.fs.mu.Lock()
+		delete(l.fs.locks, l.name)
+		l.fs.mu.Unlock()
+	})
+	return nil
+}
+
+// memData is content of file, shared by its opened handles.
+type memData struct {
+	mu      sync.RWMutex
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (d *memData) stat(name string) os.FileInfo {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return &memFileInfo{name: filepath.Base(name), size: int64(len(d.data)), mode: d.mode, modTime: d.modTime}
+}
+
+func (d *memData) readAt(p []byte, off int64) (int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if off >= int64(len(d.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, d.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (d *memData) writeAt(p []byte, off int64) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if end := off + int64(len(p)); end > int64(len(d.data)) {
+		d.grow(end)
+	}
+	copy(d.data[off:], p)
+	d.modTime = time.Now()
+	return len(p)
+}
+
+func (d *memData) size() int64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return int64(len(d.data))
+}
+
+func (d *memData) truncate(size int64) error {
+	if size < 0 {
+		return errInvalidArg
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if size > int64(len(d.data)) {
+		d.grow(size)
+	} else {
+		d.data = d.data[:size]
+	}
+	d.modTime = time.Now()
+	return nil
+}
+
+// grow data up to size, filled with zeros.
+func (d *memData) grow(size int64) {
+	if size <= int64(cap(d.data)) {
+		tail := d.data[len(d.data):size]
+		for i := range tail {
+			tail[i] = 0
+		}
+		d.data = d.data[:size]
+		return
+	}
+
+	data := make([]byte, size, size+size/4)
+	copy(data, d.data)
+	d.data = data
+}
+
+// memFile is opened file of memFS.
+type memFile struct {
+	name   string
+	data   *memData
+	flag   int
+	off    int64
+	closed bool
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) check(op string, write bool) error {
+	if f.closed {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	}
+
+	mode := f.flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)
+	if (write && mode == os.O_RDONLY) || (!write && mode == os.O_WRONLY) {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrPermission}
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+
+	n, err := f.data.readAt(p, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "readat", Path: f.name, Err: errInvalidArg}
+	}
+	return f.data.readAt(p, off)
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+
+	if f.flag&os.O_APPEND != 0 {
+		f.off = f.data.size()
+	}
+	n := f.data.writeAt(p, f.off)
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if off < 0 || f.flag&os.O_APPEND != 0 {
+		return 0, &os.PathError{Op: "writeat", Path: f.name, Err: errInvalidArg}
+	}
+	return f.data.writeAt(p, off), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrClosed}
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.data.size()
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: errInvalidArg}
+	}
+
+	f.off = offset
+	return offset, nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	if f.closed {
+		return nil, &os.PathError{Op: "stat", Path: f.name, Err: os.ErrClosed}
+	}
+	return f.data.stat(f.name), nil
+}
+
+func (f *memFile) Sync() error {
+	if f.closed {
+		return &os.PathError{Op: "sync", Path: f.name, Err: os.ErrClosed}
+	}
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	return f.data.truncate(size)
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i *memFileInfo) Name() string       { return i.name }
+func (i *memFileInfo) Size() int64        { return i.size }
+func (i *memFileInfo) Mode() os.FileMode  { return i.mode }
+func (i *memFileInfo) ModTime() time.Time { return i.modTime }
+func (i *memFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *memFileInfo) Sys() interface{}   { return nil }
+
+var (
+	errIsDir      = fmt.Errorf("is a directory")
+	errNotDir     = fmt.Errorf("not a directory")
+	errNotEmpty   = fmt.Errorf("directory not empty")
+	errInvalidArg = fmt.Errorf("invalid argument")
+)